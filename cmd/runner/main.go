@@ -5,9 +5,14 @@ import (
 	"os"
 	"time"
 
+	"runner/internal/api_docker"
+	"runner/internal/api_kubernetes"
+	"runner/internal/api_portainer"
 	"runner/internal/api_sql"
+	"runner/internal/backend"
 	"runner/internal/ds"
 	"runner/internal/creds"
+	"runner/internal/proxy"
 	"runner/internal/workers"
 )
 
@@ -28,7 +33,28 @@ func main() {
 	ds.LoadConfig()
 	creds.LoadCredentials()
 	api_sql.SyncWithDB()
+
+	switch ds.Backend {
+	case "DOCKER":
+		backend.Active = api_docker.Backend{}
+	case "KUBERNETES":
+		backend.Active = api_kubernetes.NewBackend()
+	case "PORTAINER":
+		backend.Active = api_portainer.Backend{}
+		go workers.JWTRefreshWorker()
+	}
+
+	workers.CheckTargetHealth() //Resources of every target should be known before the RESERVED_RESOURCES strategy places instances
+	go workers.HealthCheckWorker()
 	go workers.NewWorker(10 * time.Second).Run()
-	go workers.JWTRefreshWorker()
+	workers.StartLaunchWorkers()
+	go workers.ReconcileWorker()
+	workers.RestoreProxyRoutes()
+	if proxy.HttpEnabled() {
+		go proxy.ServeHttp()
+	}
+	if proxy.TcpEnabled() {
+		go proxy.ServeTcp()
+	}
 	workers.HandleRequests()
 }
\ No newline at end of file
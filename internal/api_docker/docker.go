@@ -0,0 +1,337 @@
+package api_docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+type dockerClient struct {
+	base_url string
+	client   *http.Client
+}
+
+var clients map[string]*dockerClient = make(map[string]*dockerClient) //DockerUrl -> dockerClient
+var clientsLock sync.Mutex
+
+func getClient(docker_url string) (*dockerClient, error) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	if client, ok := clients[docker_url]; ok {
+		return client, nil
+	}
+
+	credentials, ok := creds.DockerCreds[docker_url]
+	if !ok {
+		return nil, fmt.Errorf("docker host %s is not specified in credentials", docker_url)
+	}
+
+	u, err := url.Parse(docker_url)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *dockerClient
+	switch u.Scheme {
+	case "unix":
+		socket_path := u.Path
+		client = &dockerClient{base_url: "http://docker", client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket_path)
+			},
+		}}}
+	case "tcp", "http", "https":
+		if credentials.Ca_Cert == "" {
+			client = &dockerClient{base_url: "http://" + u.Host, client: &http.Client{}}
+			break
+		}
+		tls_config, err := loadTLSConfig(credentials)
+		if err != nil {
+			return nil, err
+		}
+		client = &dockerClient{base_url: "https://" + u.Host, client: &http.Client{Transport: &http.Transport{TLSClientConfig: tls_config}}}
+	default:
+		return nil, fmt.Errorf("unsupported docker url scheme %s", u.Scheme)
+	}
+
+	clients[docker_url] = client
+	return client, nil
+}
+
+func loadTLSConfig(credentials ds.DockerCredentialsJson) (*tls.Config, error) {
+	ca_cert, err := os.ReadFile(ds.ConfigFolderPath + ds.PS + credentials.Ca_Cert)
+	if err != nil {
+		return nil, err
+	}
+	ca_pool := x509.NewCertPool()
+	if !ca_pool.AppendCertsFromPEM(ca_cert) {
+		return nil, fmt.Errorf("invalid Ca_Cert for docker host %s", credentials.Url)
+	}
+
+	tls_config := &tls.Config{RootCAs: ca_pool}
+	if credentials.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(ds.ConfigFolderPath+ds.PS+credentials.Cert, ds.ConfigFolderPath+ds.PS+credentials.Key)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+	return tls_config, nil
+}
+
+// Sends a request to the Docker Engine API, returning the response body if the request was successful
+func dockerRequest(docker_url string, method string, path string, request_body interface{}) ([]byte, error) {
+	client, err := getClient(docker_url)
+	if err != nil {
+		return nil, err
+	}
+
+	var json_body []byte
+	if request_body != nil {
+		json_body, err = json.Marshal(request_body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Debug("docker", method, path) //Not the body, which holds the env of instances (secrets and flags)
+
+	var body []byte
+	err = backend.RetryRequest(method, "docker "+method+" "+docker_url+path, func() error {
+		var err error
+		body, err = _dockerRequest(client, method, path, json_body, "application/json")
+		return err
+	})
+	return body, err
+}
+
+func _dockerRequest(client *dockerClient, method string, path string, request_body []byte, content_type string) ([]byte, error) {
+	req, err := http.NewRequest(method, client.base_url+path, bytes.NewReader(request_body))
+	if err != nil {
+		return nil, err
+	}
+	if request_body != nil {
+		req.Header.Set("Content-Type", content_type)
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, backend.Unreachable(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, backend.Unreachable(err)
+	}
+	if resp.StatusCode >= 300 {
+		var raw struct {
+			Message string
+		}
+		if err := json.Unmarshal(body, &raw); err != nil || raw.Message == "" {
+			raw.Message = string(body)
+		}
+		return nil, backend.DockerError(resp.StatusCode, raw.Message)
+	}
+
+	return body, nil
+}
+
+func CreateContainer(docker_url string, name string, body containerCreateBody) (string, error) {
+	resp, err := dockerRequest(docker_url, "POST", "/containers/create?name="+url.QueryEscape(name), body)
+	if err != nil {
+		return "", err
+	}
+
+	var raw struct {
+		Id string
+	}
+	if err := json.Unmarshal(resp, &raw); err != nil {
+		return "", err
+	}
+	return raw.Id, nil
+}
+
+// Extracts the tar archive at / in the container
+func PutArchive(docker_url string, id string, archive []byte) error {
+	client, err := getClient(docker_url)
+	if err != nil {
+		return err
+	}
+	path := "/containers/" + id + "/archive?path=/"
+	return backend.Retry("docker PUT "+docker_url+path, func() error {
+		_, err := _dockerRequest(client, "PUT", path, archive, "application/x-tar")
+		return err
+	})
+}
+
+func StartContainer(docker_url string, id string) error {
+	_, err := dockerRequest(docker_url, "POST", "/containers/"+id+"/start", nil)
+	return err
+}
+
+// Waits for the container to exit, returning its exit code
+func WaitContainer(docker_url string, id string) (int, error) {
+	resp, err := dockerRequest(docker_url, "POST", "/containers/"+id+"/wait", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var raw struct {
+		StatusCode int
+	}
+	if err := json.Unmarshal(resp, &raw); err != nil {
+		return 0, err
+	}
+	return raw.StatusCode, nil
+}
+
+// Stops the container, giving it timeout seconds to exit after SIGTERM before it is killed
+func StopContainer(docker_url string, id string, timeout int) error {
+	_, err := dockerRequest(docker_url, "POST", "/containers/"+id+"/stop?t="+strconv.Itoa(timeout), nil)
+	var docker_err *backend.Error
+	if errors.As(err, &docker_err) && docker_err.Status_Code == http.StatusNotModified { //The container already stopped
+		return nil
+	}
+	return err
+}
+
+func DeleteContainer(docker_url string, id string) error {
+	_, err := dockerRequest(docker_url, "DELETE", "/containers/"+id+"?force=true", nil)
+	return err
+}
+
+func InspectContainer(docker_url string, id string) (string, error) {
+	resp, err := dockerRequest(docker_url, "GET", "/containers/"+id+"/json", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var raw struct {
+		State struct {
+			Status string
+		}
+	}
+	if err := json.Unmarshal(resp, &raw); err != nil {
+		return "", err
+	}
+	return raw.State.Status, nil
+}
+
+// Returns the network that the container was created on
+func ContainerNetwork(docker_url string, id string) (string, error) {
+	resp, err := dockerRequest(docker_url, "GET", "/containers/"+id+"/json", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var raw struct {
+		HostConfig struct {
+			NetworkMode string
+		}
+	}
+	if err := json.Unmarshal(resp, &raw); err != nil {
+		return "", err
+	}
+	return raw.HostConfig.NetworkMode, nil
+}
+
+func ListContainers(docker_url string, filters map[string][]string) ([]DockerContainer, error) {
+	path := "/containers/json?all=1"
+	if len(filters) > 0 {
+		json_filters, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		path += "&filters=" + url.QueryEscape(string(json_filters))
+	}
+
+	resp, err := dockerRequest(docker_url, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []DockerContainer
+	if err := json.Unmarshal(resp, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func ContainerLogs(docker_url string, id string) (string, error) {
+	resp, err := dockerRequest(docker_url, "GET", "/containers/"+id+"/logs?stdout=1&stderr=1&tail=200", nil)
+	if err != nil {
+		return "", err
+	}
+	return backend.DemuxLogs(resp), nil
+}
+
+func CreateNetwork(docker_url string, name string, labels map[string]string, options map[string]string) (string, error) {
+	resp, err := dockerRequest(docker_url, "POST", "/networks/create", map[string]interface{}{"Name": name, "Labels": labels, "Options": options, "CheckDuplicate": true})
+	if err != nil {
+		return "", err
+	}
+
+	var raw struct {
+		Id string
+	}
+	if err := json.Unmarshal(resp, &raw); err != nil {
+		return "", err
+	}
+	return raw.Id, nil
+}
+
+func DeleteNetwork(docker_url string, name string) error {
+	_, err := dockerRequest(docker_url, "DELETE", "/networks/"+url.PathEscape(name), nil)
+	return err
+}
+
+func Ping(docker_url string) error {
+	_, err := dockerRequest(docker_url, "GET", "/_ping", nil)
+	return err
+}
+
+func HostInfo(docker_url string) (ds.HostResources, error) {
+	resp, err := dockerRequest(docker_url, "GET", "/info", nil)
+	if err != nil {
+		return ds.HostResources{}, err
+	}
+
+	var info DockerInfo
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return ds.HostResources{}, err
+	}
+	return info.ToHostResources(), nil
+}
+
+func PullImage(docker_url string, image string) error {
+	path := "/images/create?fromImage=" + url.QueryEscape(image)
+	if !hasTag(image) {
+		path += "&tag=latest" //Otherwise every tag of the image is pulled
+	}
+	_, err := dockerRequest(docker_url, "POST", path, nil)
+	return err
+}
+
+func hasTag(image string) bool {
+	last_component := image[strings.LastIndex(image, "/")+1:]
+	return strings.Contains(last_component, ":") || strings.Contains(last_component, "@")
+}
@@ -0,0 +1,319 @@
+package api_docker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/ds"
+	"runner/internal/yaml"
+)
+
+const stackLabel = "runner.stack" //Docker has no notion of stacks, so the containers of a stack are grouped by this label
+
+// Backend launches instances directly on Docker hosts via the Docker Engine API
+type Backend struct{}
+
+func (Backend) Launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	run := func(script string) error { return runEgressFilter(target.Url, script) }
+	if err := backend.AddEgressRules(options.Instance_Id, options.Egress, run); err != nil {
+		return "", err
+	}
+	id, err := launch(target, ch, ports, discriminant, options)
+	if err != nil {
+		backend.RemoveEgressRules(options.Instance_Id, options.Egress, run)
+	}
+	return id, err
+}
+
+func launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	if ch.Docker_Compose {
+		docker_compose, err := yaml.DockerComposeCopy(ch.Docker_Compose_File, ports, options.HostIps, options.Env)
+		if err != nil {
+			return "", err
+		}
+		return launchStack(target.Url, ch.Challenge_Name+"_"+discriminant, docker_compose, options)
+	}
+
+	network := networkPrefix + ch.Challenge_Name + "_" + discriminant //Every container gets its own network, so that instances cannot reach each other
+	if _, err := CreateNetwork(target.Url, network, nil, options.DockerNetworkOptions(0)); err != nil {
+		return "", err
+	}
+
+	internal_port := ch.Internal_Port + "/tcp"
+	body := containerCreateBody{
+		Image:        ch.Image_Name,
+		Env:          options.EnvList(),
+		Labels:       options.Labels,
+		ExposedPorts: map[string]struct{}{internal_port: {}},
+		HostConfig:   hostConfig{PortBindings: map[string][]portBinding{internal_port: {{HostIp: options.HostIp(0), HostPort: strconv.Itoa(ports[0])}}}, NetworkMode: network, DockerHostLimits: options.DockerHostLimits()},
+	}
+	if ch.Docker_Cmds != "" {
+		body.Cmd = api_sql.DeserializeNL(ch.Docker_Cmds)
+	}
+
+	id, err := CreateContainer(target.Url, ch.Challenge_Name+"_"+discriminant, body)
+	if err != nil {
+		DeleteNetwork(target.Url, network)
+		return "", err
+	}
+	if err := startContainer(target.Url, id, options); err != nil {
+		DeleteContainer(target.Url, id)
+		DeleteNetwork(target.Url, network)
+		return "", err
+	}
+	return id, nil
+}
+
+const networkPrefix = "runner_" //Networks of single container instances, as opposed to networks that containers share (E.g. bridge)
+
+// Writes the files of options to the container and starts it
+func startContainer(docker_url string, id string, options backend.LaunchOptions) error {
+	if err := putFiles(docker_url, id, options); err != nil {
+		return err
+	}
+	return StartContainer(docker_url, id)
+}
+
+// Runs script in a container of ds.EgressFilterImage on the network of the host, see backend.EgressRulesScript
+func runEgressFilter(docker_url string, script string) error {
+	body := containerCreateBody{Image: ds.EgressFilterImage, Cmd: backend.EgressFilterCmd(script), HostConfig: hostConfig{NetworkMode: "host", CapAdd: backend.EgressFilterCapabilities}}
+	id, err := CreateContainer(docker_url, "", body)
+	if errors.Is(err, backend.ErrImageMissing) {
+		if err := PullImage(docker_url, ds.EgressFilterImage); err != nil {
+			return err
+		}
+		id, err = CreateContainer(docker_url, "", body)
+	}
+	if err != nil {
+		return err
+	}
+	defer DeleteContainer(docker_url, id)
+
+	if err := StartContainer(docker_url, id); err != nil {
+		return err
+	}
+	status, err := WaitContainer(docker_url, id)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		logs, _ := ContainerLogs(docker_url, id)
+		return &backend.Error{Message: fmt.Sprintf("egress filter exited with status %d: %s", status, logs)}
+	}
+	return nil
+}
+
+// Deletes the container (stopping it first if graceful), and its network if it has one (containers launched before instances had networks do not)
+func deleteContainer(docker_url string, id string, graceful bool) error {
+	network, err := ContainerNetwork(docker_url, id)
+	if err != nil {
+		return err
+	}
+	if graceful {
+		if err := StopContainer(docker_url, id, ds.StopTimeoutSeconds); err != nil {
+			return err
+		}
+	}
+	if err := DeleteContainer(docker_url, id); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(network, networkPrefix) {
+		return nil
+	}
+	return DeleteNetwork(docker_url, network)
+}
+
+// Launches every service of docker_compose as a container on a network dedicated to the stack, returning the stack name
+func launchStack(docker_url string, stack_name string, docker_compose string, options backend.LaunchOptions) (string, error) {
+	services, err := yaml.DockerComposeServices(docker_compose)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := CreateNetwork(docker_url, stack_name, map[string]string{stackLabel: stack_name}, options.DockerNetworkOptions(0)); err != nil {
+		return "", err
+	}
+
+	for _, service := range services {
+		if err := PullImage(docker_url, service.Image); err != nil {
+			deleteStack(docker_url, stack_name, false)
+			return "", err
+		}
+
+		body := containerCreateBody{
+			Image:            service.Image,
+			Cmd:              service.Command,
+			Env:              service.Environment,
+			Labels:           map[string]string{stackLabel: stack_name},
+			ExposedPorts:     map[string]struct{}{},
+			HostConfig:       hostConfig{PortBindings: map[string][]portBinding{}, NetworkMode: stack_name, DockerHostLimits: options.DockerHostLimits()},
+			NetworkingConfig: &networkingConfig{EndpointsConfig: map[string]endpointConfig{stack_name: {Aliases: []string{service.Name}}}},
+		}
+		for label, value := range options.Labels {
+			body.Labels[label] = value
+		}
+		for _, port := range service.Ports {
+			host_ip, external_port, internal_port, err := yaml.ParsePortMapping(port)
+			if err != nil {
+				deleteStack(docker_url, stack_name, false)
+				return "", err
+			}
+			if !strings.Contains(internal_port, "/") {
+				internal_port += "/tcp"
+			}
+			body.ExposedPorts[internal_port] = struct{}{}
+			body.HostConfig.PortBindings[internal_port] = append(body.HostConfig.PortBindings[internal_port], portBinding{HostIp: host_ip, HostPort: external_port})
+		}
+
+		id, err := CreateContainer(docker_url, stack_name+"_"+service.Name, body)
+		if err != nil {
+			deleteStack(docker_url, stack_name, false)
+			return "", err
+		}
+		if err := startContainer(docker_url, id, options); err != nil {
+			deleteStack(docker_url, stack_name, false)
+			return "", err
+		}
+	}
+
+	return stack_name, nil
+}
+
+// Writes the files of options to the container before it starts
+func putFiles(docker_url string, id string, options backend.LaunchOptions) error {
+	if len(options.Files) == 0 {
+		return nil
+	}
+	archive, err := options.FilesArchive()
+	if err != nil {
+		return err
+	}
+	return PutArchive(docker_url, id, archive)
+}
+
+// Deletes every container of the stack (stopping them first if graceful) and its network
+func deleteStack(docker_url string, stack_name string, graceful bool) error {
+	containers, err := ListContainers(docker_url, map[string][]string{"label": {stackLabel + "=" + stack_name}})
+	if err != nil {
+		return err
+	}
+	for i := 0; graceful && i < len(containers); i++ {
+		if err := StopContainer(docker_url, containers[i].Id, ds.StopTimeoutSeconds); err != nil {
+			return err
+		}
+	}
+	for _, container := range containers {
+		if err := DeleteContainer(docker_url, container.Id); err != nil {
+			return err
+		}
+	}
+	return DeleteNetwork(docker_url, stack_name)
+}
+
+func (Backend) Stop(instance ds.Instance, ch ds.RunnerChallenge, graceful bool) error {
+	var err error
+	if ch.Docker_Compose {
+		err = deleteStack(instance.Portainer_Url, instance.Portainer_Id, graceful)
+	} else {
+		err = deleteContainer(instance.Portainer_Url, instance.Portainer_Id, graceful)
+	}
+	if err != nil {
+		return err
+	}
+	backend.RemoveEgressRules(instance.Instance_Id, ch.GetEgressPolicy(), func(script string) error { return runEgressFilter(instance.Portainer_Url, script) })
+	return nil
+}
+
+func (Backend) Inspect(instance ds.Instance, ch ds.RunnerChallenge) (backend.Status, error) {
+	if !ch.Docker_Compose {
+		state, err := InspectContainer(instance.Portainer_Url, instance.Portainer_Id)
+		if err != nil {
+			return backend.Status{}, err
+		}
+		return backend.Status{State: state}, nil
+	}
+
+	containers, err := ListContainers(instance.Portainer_Url, map[string][]string{"label": {stackLabel + "=" + instance.Portainer_Id}})
+	if err != nil {
+		return backend.Status{}, err
+	}
+	if len(containers) == 0 { //Docker has no notion of stacks, so a stack without containers does not exist
+		return backend.Status{}, &backend.Error{Kind: backend.ErrNotFound, Message: "no such stack " + instance.Portainer_Id}
+	}
+	for _, container := range containers {
+		if container.State != "running" { //A stack is only running if all of its containers are
+			return backend.Status{State: container.State}, nil
+		}
+	}
+	return backend.Status{State: "running"}, nil
+}
+
+func (Backend) List(target ds.Target) ([]backend.Resource, error) {
+	containers, err := ListContainers(target.Url, map[string][]string{"label": backend.RunnerLabelFilters()})
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []backend.Resource
+	stacks := make(map[string]bool)
+	for _, container := range containers {
+		instance_id, _ := strconv.Atoi(container.Labels[backend.InstanceIdLabel])
+		if stack_name := container.Labels[stackLabel]; stack_name != "" {
+			if !stacks[stack_name] {
+				stacks[stack_name] = true
+				resources = append(resources, backend.Resource{Id: stack_name, Name: stack_name, Stack: true, Instance_Id: instance_id})
+			}
+			continue
+		}
+		resources = append(resources, backend.Resource{Id: container.Id, Name: containerName(container), Instance_Id: instance_id})
+	}
+	return resources, nil
+}
+
+func (Backend) Ping(target ds.Target) error {
+	return Ping(target.Url)
+}
+
+func (Backend) Info(target ds.Target) (ds.HostResources, error) {
+	return HostInfo(target.Url)
+}
+
+func (Backend) PublishedPorts(target ds.Target) ([]int, error) {
+	containers, err := ListContainers(target.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return publishedPorts(containers), nil
+}
+
+func (Backend) Logs(instance ds.Instance, ch ds.RunnerChallenge) (string, error) {
+	if !ch.Docker_Compose {
+		return ContainerLogs(instance.Portainer_Url, instance.Portainer_Id)
+	}
+
+	containers, err := ListContainers(instance.Portainer_Url, map[string][]string{"label": {stackLabel + "=" + instance.Portainer_Id}})
+	if err != nil {
+		return "", err
+	}
+
+	logs := ""
+	for _, container := range containers {
+		container_logs, err := ContainerLogs(instance.Portainer_Url, container.Id)
+		if err != nil {
+			return "", err
+		}
+		logs += "==> " + containerName(container) + " <==\n" + container_logs
+	}
+	return logs, nil
+}
+
+func containerName(container DockerContainer) string {
+	if len(container.Names) == 0 {
+		return container.Id
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
@@ -0,0 +1,71 @@
+package api_docker
+
+import (
+	"runner/internal/backend"
+	"runner/internal/ds"
+)
+
+type containerCreateBody struct {
+	Image            string
+	Cmd              []string            `json:",omitempty"`
+	Env              []string            `json:",omitempty"`
+	Labels           map[string]string   `json:",omitempty"`
+	ExposedPorts     map[string]struct{} `json:",omitempty"`
+	HostConfig       hostConfig
+	NetworkingConfig *networkingConfig `json:",omitempty"`
+}
+
+type hostConfig struct {
+	PortBindings map[string][]portBinding `json:",omitempty"`
+	NetworkMode  string                   `json:",omitempty"`
+	CapAdd       []string                 `json:",omitempty"`
+	backend.DockerHostLimits
+}
+
+type portBinding struct {
+	HostIp   string `json:",omitempty"`
+	HostPort string
+}
+
+type networkingConfig struct {
+	EndpointsConfig map[string]endpointConfig
+}
+
+type endpointConfig struct {
+	Aliases []string
+}
+
+type DockerContainer struct {
+	Id     string
+	Names  []string
+	State  string
+	Labels map[string]string
+	Ports  []DockerPort
+}
+
+type DockerPort struct {
+	PrivatePort int
+	PublicPort  int //0 if the port is not published
+	Type        string
+}
+
+func publishedPorts(containers []DockerContainer) []int {
+	ports := []int{}
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if port.PublicPort != 0 {
+				ports = append(ports, port.PublicPort)
+			}
+		}
+	}
+	return ports
+}
+
+type DockerInfo struct {
+	NCPU     int
+	MemTotal int64 //Bytes
+}
+
+func (info DockerInfo) ToHostResources() ds.HostResources {
+	return ds.HostResources{Cpu_Millicores: info.NCPU * 1000, Memory_Mb: int(info.MemTotal / (1024 * 1024))}
+}
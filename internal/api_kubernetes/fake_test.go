@@ -0,0 +1,186 @@
+package api_kubernetes
+
+import (
+	"strings"
+	"sync"
+
+	"runner/internal/backend"
+)
+
+// FakeClientset is an in-memory Clientset, where every Deployment becomes ready immediately
+type FakeClientset struct {
+	lock        sync.Mutex
+	Namespaces  map[string]Namespace
+	Deployments map[string][]Deployment    //Namespace -> Deployments
+	Services    map[string][]Service       //Namespace -> Services
+	Secrets     map[string][]Secret        //Namespace -> Secrets
+	Policies    map[string][]NetworkPolicy //Namespace -> NetworkPolicies
+	Logs        map[string]string          //Pod -> Logs
+	Nodes       []Node
+}
+
+func NewFakeClientset() *FakeClientset {
+	return &FakeClientset{
+		Namespaces:  make(map[string]Namespace),
+		Deployments: make(map[string][]Deployment),
+		Services:    make(map[string][]Service),
+		Secrets:     make(map[string][]Secret),
+		Policies:    make(map[string][]NetworkPolicy),
+		Logs:        make(map[string]string),
+	}
+}
+
+func (f *FakeClientset) CreateNamespace(namespace Namespace) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[namespace.Metadata.Name]; ok {
+		return &backend.Error{Kind: backend.ErrNameConflict, Status_Code: 409, Message: "namespace " + namespace.Metadata.Name + " already exists"}
+	}
+	namespace.Status.Phase = "Active"
+	f.Namespaces[namespace.Metadata.Name] = namespace
+	return nil
+}
+
+func (f *FakeClientset) GetNamespace(name string) (Namespace, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	namespace, ok := f.Namespaces[name]
+	if !ok {
+		return Namespace{}, &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + name + " not found"}
+	}
+	return namespace, nil
+}
+
+func (f *FakeClientset) ListNamespaces(label_selector string) ([]Namespace, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var namespaces []Namespace
+	for _, namespace := range f.Namespaces {
+		if matchesLabelSelector(namespace.Metadata.Labels, label_selector) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+func (f *FakeClientset) DeleteNamespace(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[name]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + name + " not found"}
+	}
+	delete(f.Namespaces, name)
+	delete(f.Deployments, name)
+	delete(f.Services, name)
+	delete(f.Secrets, name)
+	delete(f.Policies, name)
+	return nil
+}
+
+func (f *FakeClientset) CreateDeployment(deployment Deployment) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[deployment.Metadata.Namespace]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + deployment.Metadata.Namespace + " not found"}
+	}
+	deployment.Status.ReadyReplicas = deployment.Spec.Replicas
+	f.Deployments[deployment.Metadata.Namespace] = append(f.Deployments[deployment.Metadata.Namespace], deployment)
+	return nil
+}
+
+func (f *FakeClientset) ListDeployments(namespace string) ([]Deployment, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]Deployment{}, f.Deployments[namespace]...), nil
+}
+
+func (f *FakeClientset) CreateService(service Service) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[service.Metadata.Namespace]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + service.Metadata.Namespace + " not found"}
+	}
+	f.Services[service.Metadata.Namespace] = append(f.Services[service.Metadata.Namespace], service)
+	return nil
+}
+
+func (f *FakeClientset) CreateSecret(secret Secret) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[secret.Metadata.Namespace]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + secret.Metadata.Namespace + " not found"}
+	}
+	f.Secrets[secret.Metadata.Namespace] = append(f.Secrets[secret.Metadata.Namespace], secret)
+	return nil
+}
+
+func (f *FakeClientset) CreateNetworkPolicy(policy NetworkPolicy) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Namespaces[policy.Metadata.Namespace]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Status_Code: 404, Message: "namespace " + policy.Metadata.Namespace + " not found"}
+	}
+	f.Policies[policy.Metadata.Namespace] = append(f.Policies[policy.Metadata.Namespace], policy)
+	return nil
+}
+
+func (f *FakeClientset) ListServices(namespace string) ([]Service, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if namespace != "" {
+		return f.Services[namespace], nil
+	}
+	var services []Service
+	for _, namespace_services := range f.Services {
+		services = append(services, namespace_services...)
+	}
+	return services, nil
+}
+
+func (f *FakeClientset) ListPods(namespace string) ([]Pod, error) { //Every Deployment has a single Pod named after it
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var pods []Pod
+	for _, deployment := range f.Deployments[namespace] {
+		pods = append(pods, Pod{Metadata: ObjectMeta{Name: deployment.Metadata.Name, Namespace: namespace}})
+	}
+	return pods, nil
+}
+
+func (f *FakeClientset) PodLogs(namespace string, pod string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.Logs[pod], nil
+}
+
+func (f *FakeClientset) ListNodes() ([]Node, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.Nodes, nil
+}
+
+func matchesLabelSelector(labels map[string]string, label_selector string) bool { //Only supports comma-separated key=value pairs
+	if label_selector == "" {
+		return true
+	}
+	for _, requirement := range strings.Split(label_selector, ",") {
+		pair := strings.SplitN(requirement, "=", 2)
+		if len(pair) != 2 || labels[pair[0]] != pair[1] {
+			return false
+		}
+	}
+	return true
+}
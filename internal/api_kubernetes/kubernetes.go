@@ -0,0 +1,221 @@
+package api_kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"runner/internal/backend"
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+// Clientset is the subset of the Kubernetes API used by the Backend
+type Clientset interface {
+	CreateNamespace(namespace Namespace) error
+	GetNamespace(name string) (Namespace, error)
+	ListNamespaces(label_selector string) ([]Namespace, error)
+	DeleteNamespace(name string) error
+	CreateDeployment(deployment Deployment) error
+	ListDeployments(namespace string) ([]Deployment, error)
+	CreateService(service Service) error
+	CreateSecret(secret Secret) error
+	CreateNetworkPolicy(policy NetworkPolicy) error
+	ListServices(namespace string) ([]Service, error) //Lists services in every namespace if namespace is ""
+	ListPods(namespace string) ([]Pod, error)
+	PodLogs(namespace string, pod string) (string, error)
+	ListNodes() ([]Node, error)
+}
+
+// Credentials of the service account that the runner uses when running inside the cluster
+const inClusterUrl = "https://kubernetes.default.svc"
+const inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+const inClusterCaCertFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+type restClientset struct {
+	base_url string
+	token    string
+	client   *http.Client
+}
+
+// Creates a Clientset that talks to the Kubernetes API server directly via REST
+func NewRestClientset(credentials ds.KubernetesCredentialsJson) (Clientset, error) {
+	base_url, token, ca_cert_file := credentials.Url, credentials.Token, ""
+	if credentials.Ca_Cert != "" {
+		ca_cert_file = ds.ConfigFolderPath + ds.PS + credentials.Ca_Cert
+	}
+	if base_url == inClusterUrl && token == "" { //Use the service account of the runner's pod
+		raw_token, err := os.ReadFile(inClusterTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token, ca_cert_file = strings.TrimSpace(string(raw_token)), inClusterCaCertFile
+	}
+
+	tls_config := &tls.Config{}
+	if ca_cert_file != "" {
+		ca_cert, err := os.ReadFile(ca_cert_file)
+		if err != nil {
+			return nil, err
+		}
+		ca_pool := x509.NewCertPool()
+		if !ca_pool.AppendCertsFromPEM(ca_cert) {
+			return nil, fmt.Errorf("invalid Ca_Cert for kubernetes cluster %s", credentials.Url)
+		}
+		tls_config.RootCAs = ca_pool
+	}
+
+	return &restClientset{base_url: strings.TrimSuffix(base_url, "/"), token: token, client: &http.Client{Transport: &http.Transport{TLSClientConfig: tls_config}}}, nil
+}
+
+func kubernetesError(status_code int, message string) error {
+	var kind error
+	switch status_code {
+	case http.StatusUnauthorized:
+		kind = backend.ErrAuthExpired
+	case http.StatusNotFound:
+		kind = backend.ErrNotFound
+	case http.StatusConflict:
+		kind = backend.ErrNameConflict
+	case http.StatusUnprocessableEntity:
+		if strings.Contains(message, "already allocated") { //E.g. a NodePort that is used by another service
+			kind = backend.ErrPortConflict
+		}
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		kind = backend.ErrUnreachable
+	}
+	return &backend.Error{Kind: kind, Status_Code: status_code, Message: message}
+}
+
+func (c *restClientset) request(method string, path string, request_body interface{}, response_body interface{}) error {
+	log.Debug("kubernetes", method, path) //Not the body, which holds the env of instances (secrets and flags)
+	var reader *bytes.Reader
+	if request_body != nil {
+		json_body, err := json.Marshal(request_body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(json_body)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.base_url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if request_body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return backend.Unreachable(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return backend.Unreachable(err)
+	}
+	if resp.StatusCode >= 300 {
+		return kubernetesError(resp.StatusCode, method+" "+path+": "+strings.TrimSpace(string(body)))
+	}
+
+	if response_body == nil {
+		return nil
+	}
+	if raw, ok := response_body.(*string); ok { //Logs are plain text
+		*raw = string(body)
+		return nil
+	}
+	return json.Unmarshal(body, response_body)
+}
+
+func (c *restClientset) CreateNamespace(namespace Namespace) error {
+	return c.request("POST", "/api/v1/namespaces", namespace, nil)
+}
+
+func (c *restClientset) GetNamespace(name string) (Namespace, error) {
+	var namespace Namespace
+	err := c.request("GET", "/api/v1/namespaces/"+name, nil, &namespace)
+	return namespace, err
+}
+
+func (c *restClientset) ListNamespaces(label_selector string) ([]Namespace, error) {
+	var list struct {
+		Items []Namespace `json:"items"`
+	}
+	err := c.request("GET", "/api/v1/namespaces?labelSelector="+url.QueryEscape(label_selector), nil, &list)
+	return list.Items, err
+}
+
+func (c *restClientset) DeleteNamespace(name string) error {
+	return c.request("DELETE", "/api/v1/namespaces/"+name, nil, nil) //Deleting a namespace deletes everything inside it
+}
+
+func (c *restClientset) CreateDeployment(deployment Deployment) error {
+	return c.request("POST", "/apis/apps/v1/namespaces/"+deployment.Metadata.Namespace+"/deployments", deployment, nil)
+}
+
+func (c *restClientset) ListDeployments(namespace string) ([]Deployment, error) {
+	var list struct {
+		Items []Deployment `json:"items"`
+	}
+	err := c.request("GET", "/apis/apps/v1/namespaces/"+namespace+"/deployments", nil, &list)
+	return list.Items, err
+}
+
+func (c *restClientset) CreateService(service Service) error {
+	return c.request("POST", "/api/v1/namespaces/"+service.Metadata.Namespace+"/services", service, nil)
+}
+
+func (c *restClientset) CreateSecret(secret Secret) error {
+	return c.request("POST", "/api/v1/namespaces/"+secret.Metadata.Namespace+"/secrets", secret, nil)
+}
+
+func (c *restClientset) CreateNetworkPolicy(policy NetworkPolicy) error {
+	return c.request("POST", "/apis/networking.k8s.io/v1/namespaces/"+policy.Metadata.Namespace+"/networkpolicies", policy, nil)
+}
+
+func (c *restClientset) ListServices(namespace string) ([]Service, error) {
+	var list struct {
+		Items []Service `json:"items"`
+	}
+	path := "/api/v1/services"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + namespace + "/services"
+	}
+	err := c.request("GET", path, nil, &list)
+	return list.Items, err
+}
+
+func (c *restClientset) ListPods(namespace string) ([]Pod, error) {
+	var list struct {
+		Items []Pod `json:"items"`
+	}
+	err := c.request("GET", "/api/v1/namespaces/"+namespace+"/pods", nil, &list)
+	return list.Items, err
+}
+
+func (c *restClientset) PodLogs(namespace string, pod string) (string, error) {
+	var logs string
+	err := c.request("GET", "/api/v1/namespaces/"+namespace+"/pods/"+pod+"/log?tailLines=200", nil, &logs)
+	return logs, err
+}
+
+func (c *restClientset) ListNodes() ([]Node, error) {
+	var list struct {
+		Items []Node `json:"items"`
+	}
+	err := c.request("GET", "/api/v1/nodes", nil, &list)
+	return list.Items, err
+}
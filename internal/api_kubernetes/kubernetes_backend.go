@@ -0,0 +1,432 @@
+package api_kubernetes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/yaml"
+)
+
+const managedLabel = "runner.managed"
+const appLabel = "runner.app"
+
+// Backend launches every instance into its own namespace, which is used as the instance's Portainer_Id
+type Backend struct {
+	Clientsets map[string]Clientset //KubernetesUrl -> Clientset
+}
+
+// Creates a Backend with a REST Clientset for every cluster in the credentials
+func NewBackend() Backend {
+	clientsets := make(map[string]Clientset)
+	for kubernetes_url, credentials := range creds.KubernetesCreds {
+		clientset, err := NewRestClientset(credentials)
+		if err != nil {
+			panic(err)
+		}
+		clientsets[kubernetes_url] = clientset
+	}
+	return Backend{Clientsets: clientsets}
+}
+
+func (b Backend) getClientset(kubernetes_url string) (Clientset, error) {
+	clientset, ok := b.Clientsets[kubernetes_url]
+	if !ok {
+		return nil, fmt.Errorf("kubernetes cluster %s is not specified in credentials", kubernetes_url)
+	}
+	return clientset, nil
+}
+
+var invalidNameCharacters *regexp.Regexp = regexp.MustCompile("[^a-z0-9-]+")
+var labelValue *regexp.Regexp = regexp.MustCompile("^(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?$")
+
+func validLabelValue(value string) bool {
+	return len(value) <= 63 && labelValue.MatchString(value)
+}
+
+func sanitizeName(name string, max_length int) string { //Converts name into a valid DNS-1123 label
+	name = strings.Trim(invalidNameCharacters.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > max_length {
+		name = strings.Trim(name[:max_length], "-")
+	}
+	if name == "" {
+		name = "challenge"
+	}
+	return name
+}
+
+func serviceType(kubernetes_url string) string {
+	if credentials, ok := creds.KubernetesCreds[kubernetes_url]; ok && credentials.Service_Type != "" {
+		return credentials.Service_Type
+	}
+	return "NodePort"
+}
+
+func parsePortMapping(mapping string) (int, int, error) { //Returns the external and internal ports of "<external port>:<internal port>"
+	ports := strings.SplitN(strings.Split(mapping, "/")[0], ":", 2)
+	if len(ports) != 2 {
+		return 0, 0, fmt.Errorf("invalid port mapping %s", mapping)
+	}
+	external_port, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	internal_port, err := strconv.Atoi(ports[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return external_port, internal_port, nil
+}
+
+// Converts a challenge into compose services, so that both kinds of challenges can be launched the same way
+func challengeServices(ch ds.RunnerChallenge, ports []int, options backend.LaunchOptions) ([]yaml.ComposeService, error) {
+	if ch.Docker_Compose {
+		docker_compose, err := yaml.DockerComposeCopy(ch.Docker_Compose_File, ports, nil, options.Env) //Services are published as node ports, which do not have a host IP
+		if err != nil {
+			return nil, err
+		}
+		return yaml.DockerComposeServices(docker_compose)
+	}
+
+	service := yaml.ComposeService{Name: "challenge", Image: ch.Image_Name, Environment: options.EnvList(), Ports: []string{strconv.Itoa(ports[0]) + ":" + ch.Internal_Port}}
+	if ch.Docker_Cmds != "" {
+		service.Command = api_sql.DeserializeNL(ch.Docker_Cmds)
+	}
+	return []yaml.ComposeService{service}, nil
+}
+
+func (b Backend) Launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	clientset, err := b.getClientset(target.Url)
+	if err != nil {
+		return "", err
+	}
+
+	services, err := challengeServices(ch, ports, options)
+	if err != nil {
+		return "", err
+	}
+
+	namespace := "runner-" + sanitizeName(ch.Challenge_Name, 63-len("runner-")-len(discriminant)-1) + "-" + discriminant
+	labels := map[string]string{managedLabel: "true"}
+	annotations := make(map[string]string)
+	for label, value := range options.Labels {
+		if validLabelValue(value) {
+			labels[label] = value
+		} else { //E.g. challenge ids, which are longer than label values may be
+			annotations[label] = value
+		}
+	}
+	if err := clientset.CreateNamespace(Namespace{ApiVersion: "v1", Kind: "Namespace", Metadata: ObjectMeta{Name: namespace, Labels: labels, Annotations: annotations}}); err != nil {
+		return "", err
+	}
+
+	if options.Egress.Egress != ds.EgressFull {
+		if err := clientset.CreateNetworkPolicy(egressPolicy(namespace, options.Egress)); err != nil {
+			clientset.DeleteNamespace(namespace)
+			return "", err
+		}
+	}
+
+	if len(options.Files) > 0 {
+		if err := clientset.CreateSecret(filesSecret(namespace, options)); err != nil {
+			clientset.DeleteNamespace(namespace)
+			return "", err
+		}
+	}
+
+	for _, service := range services {
+		if err := launchService(clientset, target.Url, namespace, service, options); err != nil {
+			clientset.DeleteNamespace(namespace)
+			return "", err
+		}
+	}
+
+	return namespace, nil
+}
+
+// Returns a NetworkPolicy that only allows the pods of the namespace to reach each other, DNS and the namespaces in the allowlist of policy
+// Like every NetworkPolicy, it is only enforced if the network plugin of the cluster supports NetworkPolicies
+func egressPolicy(namespace string, policy ds.EgressPolicy) NetworkPolicy {
+	rules := []NetworkPolicyEgressRule{
+		{To: []NetworkPolicyPeer{{PodSelector: &LabelSelector{}}}},
+		{Ports: []NetworkPolicyPort{{Protocol: "UDP", Port: 53}, {Protocol: "TCP", Port: 53}}},
+	}
+	if policy.Egress == ds.EgressAllowlist {
+		for _, allowed_namespace := range policy.Allowlist {
+			rules = append(rules, NetworkPolicyEgressRule{To: []NetworkPolicyPeer{{NamespaceSelector: &LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": allowed_namespace}}}}})
+		}
+	}
+	return NetworkPolicy{ApiVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy", Metadata: ObjectMeta{Name: "runner-egress", Namespace: namespace}, Spec: NetworkPolicySpec{PolicyTypes: []string{"Egress"}, Egress: rules}}
+}
+
+const filesSecretName = "runner-files"
+
+// Returns a Secret holding the files of options, as Kubernetes cannot write files into containers directly
+func filesSecret(namespace string, options backend.LaunchOptions) Secret {
+	secret := Secret{ApiVersion: "v1", Kind: "Secret", Metadata: ObjectMeta{Name: filesSecretName, Namespace: namespace}, StringData: map[string]string{}}
+	for i, path := range options.FilePaths() {
+		secret.StringData["file-"+strconv.Itoa(i)] = options.Files[path]
+	}
+	return secret
+}
+
+// Creates a Deployment for service, a headless Service so that other services can reach it by name, and a Service that exposes its ports
+func launchService(clientset Clientset, kubernetes_url string, namespace string, service yaml.ComposeService, options backend.LaunchOptions) error {
+	name := sanitizeName(service.Name, 63-len("-external"))
+	labels := map[string]string{appLabel: name}
+
+	container := Container{Name: name, Image: service.Image, Args: service.Command}
+	container.Resources, container.SecurityContext = containerLimits(options.Limits)
+	for _, env := range service.Environment {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) == 1 {
+			pair = append(pair, "")
+		}
+		container.Env = append(container.Env, EnvVar{Name: pair[0], Value: pair[1]})
+	}
+
+	external_service := Service{ApiVersion: "v1", Kind: "Service", Metadata: ObjectMeta{Name: name + "-external", Namespace: namespace}, Spec: ServiceSpec{Type: serviceType(kubernetes_url), Selector: labels}}
+	for i, mapping := range service.Ports {
+		external_port, internal_port, err := parsePortMapping(mapping)
+		if err != nil {
+			return err
+		}
+		container.Ports = append(container.Ports, ContainerPort{ContainerPort: internal_port})
+
+		port := ServicePort{Name: "port-" + strconv.Itoa(i), TargetPort: internal_port}
+		if external_service.Spec.Type == "NodePort" {
+			port.Port, port.NodePort = internal_port, external_port
+		} else {
+			port.Port = external_port
+		}
+		external_service.Spec.Ports = append(external_service.Spec.Ports, port)
+	}
+
+	deployment := Deployment{ApiVersion: "apps/v1", Kind: "Deployment", Metadata: ObjectMeta{Name: name, Namespace: namespace}, Spec: DeploymentSpec{
+		Replicas: 1,
+		Selector: LabelSelector{MatchLabels: labels},
+		Template: PodTemplateSpec{Metadata: ObjectMeta{Labels: labels}, Spec: PodSpec{Containers: []Container{container}}},
+	}}
+	if len(options.Files) > 0 { //Mount every file from the Secret created by filesSecret
+		deployment.Spec.Template.Spec.Volumes = []Volume{{Name: filesSecretName, Secret: SecretVolumeSource{SecretName: filesSecretName}}}
+		for i, path := range options.FilePaths() {
+			deployment.Spec.Template.Spec.Containers[0].VolumeMounts = append(deployment.Spec.Template.Spec.Containers[0].VolumeMounts, VolumeMount{Name: filesSecretName, MountPath: path, SubPath: "file-" + strconv.Itoa(i), ReadOnly: true})
+		}
+	}
+	if err := clientset.CreateDeployment(deployment); err != nil {
+		return err
+	}
+
+	if err := clientset.CreateService(Service{ApiVersion: "v1", Kind: "Service", Metadata: ObjectMeta{Name: name, Namespace: namespace}, Spec: ServiceSpec{ClusterIP: "None", Selector: labels}}); err != nil {
+		return err
+	}
+	if len(external_service.Spec.Ports) > 0 {
+		return clientset.CreateService(external_service)
+	}
+	return nil
+}
+
+// Returns limits as the resources and security context of a container. Kubernetes has no per-container PID limit, so Pids_Limit is not applied
+func containerLimits(limits ds.ContainerLimits) (*ResourceRequirements, *SecurityContext) {
+	var resources *ResourceRequirements
+	if limits.Memory_Mb > 0 || limits.Cpu_Shares > 0 {
+		resources = &ResourceRequirements{Limits: map[string]string{}, Requests: map[string]string{}}
+		if limits.Memory_Mb > 0 {
+			resources.Limits["memory"] = strconv.Itoa(limits.Memory_Mb) + "Mi"
+		}
+		if limits.Cpu_Shares > 0 { //Docker's CPU shares are relative to 1024 per core, which is how Kubernetes converts CPU requests to shares
+			resources.Requests["cpu"] = strconv.Itoa(limits.Cpu_Shares*1000/1024) + "m"
+		}
+	}
+
+	var security_context *SecurityContext
+	if limits.No_New_Privileges || limits.Read_Only_Rootfs || len(limits.Cap_Drop) > 0 {
+		security_context = &SecurityContext{ReadOnlyRootFilesystem: limits.Read_Only_Rootfs}
+		if limits.No_New_Privileges {
+			allow_privilege_escalation := false
+			security_context.AllowPrivilegeEscalation = &allow_privilege_escalation
+		}
+		if len(limits.Cap_Drop) > 0 {
+			security_context.Capabilities = &Capabilities{Drop: limits.Cap_Drop}
+		}
+	}
+	return resources, security_context
+}
+
+// Pods always get their terminationGracePeriodSeconds to exit when their namespace is deleted, whether or not the stop is graceful
+func (b Backend) Stop(instance ds.Instance, ch ds.RunnerChallenge, graceful bool) error {
+	clientset, err := b.getClientset(instance.Portainer_Url)
+	if err != nil {
+		return err
+	}
+	return clientset.DeleteNamespace(instance.Portainer_Id)
+}
+
+func (b Backend) Inspect(instance ds.Instance, ch ds.RunnerChallenge) (backend.Status, error) {
+	clientset, err := b.getClientset(instance.Portainer_Url)
+	if err != nil {
+		return backend.Status{}, err
+	}
+
+	namespace, err := clientset.GetNamespace(instance.Portainer_Id)
+	if err != nil {
+		return backend.Status{}, err
+	}
+	if namespace.Status.Phase == "Terminating" {
+		return backend.Status{State: "exited"}, nil
+	}
+
+	deployments, err := clientset.ListDeployments(instance.Portainer_Id)
+	if err != nil {
+		return backend.Status{}, err
+	}
+	for _, deployment := range deployments {
+		if deployment.Status.ReadyReplicas < deployment.Spec.Replicas {
+			return backend.Status{State: "created"}, nil
+		}
+	}
+	return backend.Status{State: "running"}, nil
+}
+
+func (b Backend) List(target ds.Target) ([]backend.Resource, error) {
+	clientset, err := b.getClientset(target.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := clientset.ListNamespaces(managedLabel + "=true," + backend.RunnerIdLabel + "=" + ds.RunnerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []backend.Resource
+	for _, namespace := range namespaces {
+		instance_id, err := strconv.Atoi(namespace.Metadata.Labels[backend.InstanceIdLabel])
+		if err != nil { //Launched before namespaces were labelled with their instance
+			continue
+		}
+		resources = append(resources, backend.Resource{Id: namespace.Metadata.Name, Name: namespace.Metadata.Name, Instance_Id: instance_id})
+	}
+	return resources, nil
+}
+
+func (b Backend) Ping(target ds.Target) error {
+	clientset, err := b.getClientset(target.Url)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.ListNamespaces(managedLabel + "=true")
+	return err
+}
+
+// Returns the sum of the allocatable CPU and memory of every node in the cluster
+func (b Backend) Info(target ds.Target) (ds.HostResources, error) {
+	clientset, err := b.getClientset(target.Url)
+	if err != nil {
+		return ds.HostResources{}, err
+	}
+
+	nodes, err := clientset.ListNodes()
+	if err != nil {
+		return ds.HostResources{}, err
+	}
+
+	var resources ds.HostResources
+	for _, node := range nodes {
+		cpu, err := parseQuantity(node.Status.Allocatable["cpu"])
+		if err != nil {
+			return ds.HostResources{}, err
+		}
+		memory, err := parseQuantity(node.Status.Allocatable["memory"])
+		if err != nil {
+			return ds.HostResources{}, err
+		}
+		resources.Cpu_Millicores += int(cpu * 1000)
+		resources.Memory_Mb += int(memory / (1024 * 1024))
+	}
+	return resources, nil
+}
+
+func (b Backend) PublishedPorts(target ds.Target) ([]int, error) {
+	clientset, err := b.getClientset(target.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := clientset.ListServices("")
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []int{}
+	for _, service := range services {
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 {
+				ports = append(ports, port.NodePort)
+			}
+			if service.Spec.Type == "LoadBalancer" {
+				ports = append(ports, port.Port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+var quantitySuffixes map[string]float64 = map[string]float64{
+	"m":  1e-3,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// Parses a Kubernetes quantity (E.g. "3900m", "16Gi") into its value in base units (cores or bytes)
+func parseQuantity(quantity string) (float64, error) {
+	number := strings.TrimRight(quantity, "kKmMGTi")
+	multiplier := 1.0
+	if suffix := quantity[len(number):]; suffix != "" {
+		var ok bool
+		multiplier, ok = quantitySuffixes[suffix]
+		if !ok {
+			return 0, fmt.Errorf("invalid quantity %s", quantity)
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %s", quantity)
+	}
+	return value * multiplier, nil
+}
+
+func (b Backend) Logs(instance ds.Instance, ch ds.RunnerChallenge) (string, error) {
+	clientset, err := b.getClientset(instance.Portainer_Url)
+	if err != nil {
+		return "", err
+	}
+
+	pods, err := clientset.ListPods(instance.Portainer_Id)
+	if err != nil {
+		return "", err
+	}
+
+	logs := ""
+	for _, pod := range pods {
+		pod_logs, err := clientset.PodLogs(instance.Portainer_Id, pod.Metadata.Name)
+		if err != nil {
+			return "", err
+		}
+		logs += "==> " + pod.Metadata.Name + " <==\n" + pod_logs
+	}
+	return logs, nil
+}
@@ -0,0 +1,128 @@
+package api_kubernetes
+
+import (
+	"errors"
+	"testing"
+
+	"runner/internal/backend"
+	"runner/internal/ds"
+)
+
+var target = ds.Target{Url: "https://kubernetes.local"}
+
+func newFakeBackend() (Backend, *FakeClientset) {
+	clientset := NewFakeClientset()
+	return Backend{Clientsets: map[string]Clientset{target.Url: clientset}}, clientset
+}
+
+func launch(t *testing.T, b Backend, ch ds.RunnerChallenge, instance ds.Instance, options backend.LaunchOptions) ds.Instance {
+	t.Helper()
+	options.Instance_Id, options.Labels = instance.Instance_Id, backend.InstanceLabels(instance)
+	namespace, err := b.Launch(target, ch, []int{30080}, "1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Portainer_Url, instance.Portainer_Id = target.Url, namespace
+	return instance
+}
+
+func TestLaunchImage(t *testing.T) {
+	b, clientset := newFakeBackend()
+	ch := ds.RunnerChallenge{Challenge_Name: "Web Chall", Image_Name: "nginx", Internal_Port: "80", Port_Count: 1}
+	options := backend.LaunchOptions{Env: map[string]string{"FLAG": "flag{test}"}, Files: map[string]string{"/flag.txt": "flag{test}"}, Egress: ds.EgressPolicy{Egress: ds.EgressNone}}
+	instance := launch(t, b, ch, ds.Instance{Instance_Id: 7, Usr_Id: "alice", Challenge_Id: "chall"}, options)
+
+	if instance.Portainer_Id != "runner-web-chall-1" {
+		t.Fatalf("Expected namespace runner-web-chall-1, got %s", instance.Portainer_Id)
+	}
+	namespace := clientset.Namespaces[instance.Portainer_Id]
+	if namespace.Metadata.Labels[backend.InstanceIdLabel] != "7" || namespace.Metadata.Labels[backend.RunnerIdLabel] != ds.RunnerId {
+		t.Fatalf("Namespace is not labelled with its instance, got %v", namespace.Metadata.Labels)
+	}
+
+	deployments := clientset.Deployments[instance.Portainer_Id]
+	if len(deployments) != 1 {
+		t.Fatalf("Expected 1 deployment, got %d", len(deployments))
+	}
+	container := deployments[0].Spec.Template.Spec.Containers[0]
+	if container.Image != "nginx" || len(container.Env) != 1 || container.Env[0] != (EnvVar{Name: "FLAG", Value: "flag{test}"}) {
+		t.Fatalf("Unexpected container %+v", container)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/flag.txt" {
+		t.Fatalf("File is not mounted, got %+v", container.VolumeMounts)
+	}
+	if len(clientset.Secrets[instance.Portainer_Id]) != 1 || len(clientset.Policies[instance.Portainer_Id]) != 1 {
+		t.Fatal("Expected a secret for the files and a network policy for the egress")
+	}
+
+	var node_port int
+	for _, service := range clientset.Services[instance.Portainer_Id] {
+		if service.Spec.Type == "NodePort" {
+			node_port = service.Spec.Ports[0].NodePort
+		}
+	}
+	if node_port != 30080 {
+		t.Fatalf("Expected the published port to be node port 30080, got %d", node_port)
+	}
+}
+
+func TestLaunchCompose(t *testing.T) {
+	b, clientset := newFakeBackend()
+	ch := ds.RunnerChallenge{Challenge_Name: "stack", Port_Count: 1, Docker_Compose: true, Docker_Compose_File: "services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n  db:\n    image: postgres\n"}
+	instance := launch(t, b, ch, ds.Instance{Instance_Id: 8}, backend.LaunchOptions{Egress: ds.EgressPolicy{Egress: ds.EgressFull}})
+
+	if deployments := clientset.Deployments[instance.Portainer_Id]; len(deployments) != 2 {
+		t.Fatalf("Expected a deployment for every service, got %d", len(deployments))
+	}
+	if len(clientset.Policies[instance.Portainer_Id]) != 0 {
+		t.Fatal("No network policy should be created without an egress policy")
+	}
+}
+
+func TestLaunchInvalidCompose(t *testing.T) {
+	b, clientset := newFakeBackend()
+	ch := ds.RunnerChallenge{Challenge_Name: "stack", Port_Count: 1, Docker_Compose: true, Docker_Compose_File: "services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n    volumes:\n      - data:/data\n"}
+	if _, err := b.Launch(target, ch, []int{30080}, "1", backend.LaunchOptions{}); err == nil {
+		t.Fatal("Launching an unsupported docker compose file should fail")
+	}
+	if len(clientset.Namespaces) != 0 {
+		t.Fatal("No namespace should be left behind by a failed launch")
+	}
+}
+
+func TestInspectListStop(t *testing.T) {
+	b, clientset := newFakeBackend()
+	ch := ds.RunnerChallenge{Challenge_Name: "chall", Image_Name: "alpine", Internal_Port: "1337", Port_Count: 1}
+	instance := launch(t, b, ch, ds.Instance{Instance_Id: 9}, backend.LaunchOptions{})
+
+	status, err := b.Inspect(instance, ch)
+	if err != nil || status.State != "running" {
+		t.Fatalf("Expected running, got %v (%v)", status.State, err)
+	}
+	clientset.Deployments[instance.Portainer_Id][0].Status.ReadyReplicas = 0
+	if status, _ := b.Inspect(instance, ch); status.State != "created" {
+		t.Fatalf("Expected created while the deployment is not ready, got %v", status.State)
+	}
+
+	clientset.Namespaces["unmanaged"] = Namespace{Metadata: ObjectMeta{Name: "unmanaged"}}
+	resources, err := b.List(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || resources[0].Id != instance.Portainer_Id || resources[0].Instance_Id != 9 {
+		t.Fatalf("Expected only the namespace of instance 9, got %+v", resources)
+	}
+
+	if err := b.Stop(instance, ch, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := clientset.Namespaces[instance.Portainer_Id]; ok {
+		t.Fatal("Namespace should be deleted once the instance is stopped")
+	}
+	if _, err := b.Inspect(instance, ch); !errors.Is(err, backend.ErrNotFound) {
+		t.Fatalf("Inspecting a stopped instance should return not found, got %v", err)
+	}
+	if resources, _ := b.List(target); len(resources) != 0 {
+		t.Fatalf("Expected no resources, got %+v", resources)
+	}
+}
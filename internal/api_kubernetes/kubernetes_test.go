@@ -0,0 +1,163 @@
+package api_kubernetes
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"runner/internal/backend"
+	"runner/internal/ds"
+)
+
+type apiRequest struct {
+	Method         string
+	Path           string
+	Label_Selector string
+	Authorization  string
+	Content_Type   string
+	Body           map[string]interface{}
+}
+
+// Starts a TLS API server that answers every request with respond, and a restClientset that trusts its certificate
+func newRestClientset(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (Clientset, *httptest.Server, func() []apiRequest) {
+	t.Helper()
+	var lock sync.Mutex
+	var requests []apiRequest
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := apiRequest{Method: r.Method, Path: r.URL.Path, Label_Selector: r.URL.Query().Get("labelSelector"), Authorization: r.Header.Get("Authorization"), Content_Type: r.Header.Get("Content-Type")}
+		if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+			json.Unmarshal(body, &request.Body)
+		}
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	ds.ConfigFolderPath = t.TempDir()
+	ca_cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(ds.ConfigFolderPath+ds.PS+"ca.crt", ca_cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientset, err := NewRestClientset(ds.KubernetesCredentialsJson{Url: server.URL + "/", Token: "token", Ca_Cert: "ca.crt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientset, server, func() []apiRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]apiRequest{}, requests...)
+	}
+}
+
+func TestRestClientsetRequests(t *testing.T) {
+	clientset, _, requests := newRestClientset(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/log"):
+			w.Write([]byte("line 1\nline 2\n"))
+		case r.Method == "GET" && r.URL.Path == "/api/v1/namespaces":
+			w.Write([]byte(`{"items": [{"metadata": {"name": "runner-chall-1", "labels": {"runner.managed": "true"}}, "status": {"phase": "Active"}}]}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+
+	if err := clientset.CreateNamespace(Namespace{ApiVersion: "v1", Kind: "Namespace", Metadata: ObjectMeta{Name: "runner-chall-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	namespaces, err := clientset.ListNamespaces("runner.managed=true,runner.id=runner")
+	if err != nil || len(namespaces) != 1 || namespaces[0].Metadata.Name != "runner-chall-1" || namespaces[0].Status.Phase != "Active" {
+		t.Fatalf("Expected the namespace in the response, got %+v (%v)", namespaces, err)
+	}
+	if logs, err := clientset.PodLogs("runner-chall-1", "web"); err != nil || logs != "line 1\nline 2\n" {
+		t.Fatalf("Logs should be returned as plain text, got %q (%v)", logs, err)
+	}
+	if _, err := clientset.ListServices(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientset.DeleteNamespace("runner-chall-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []apiRequest{
+		{Method: "POST", Path: "/api/v1/namespaces", Content_Type: "application/json"},
+		{Method: "GET", Path: "/api/v1/namespaces", Label_Selector: "runner.managed=true,runner.id=runner"},
+		{Method: "GET", Path: "/api/v1/namespaces/runner-chall-1/pods/web/log"},
+		{Method: "GET", Path: "/api/v1/services"},
+		{Method: "DELETE", Path: "/api/v1/namespaces/runner-chall-1"},
+	}
+	got := requests()
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d requests, got %+v", len(expected), got)
+	}
+	for i, request := range got {
+		if request.Method != expected[i].Method || request.Path != expected[i].Path || request.Label_Selector != expected[i].Label_Selector || request.Content_Type != expected[i].Content_Type {
+			t.Errorf("Request %d: expected %+v, got %+v", i, expected[i], request)
+		}
+		if request.Authorization != "Bearer token" {
+			t.Errorf("Request %d should be authorized with the token, got %q", i, request.Authorization)
+		}
+	}
+	if metadata, _ := got[0].Body["metadata"].(map[string]interface{}); metadata["name"] != "runner-chall-1" || got[0].Body["kind"] != "Namespace" {
+		t.Fatalf("The namespace should be sent as JSON, got %v", got[0].Body)
+	}
+}
+
+func TestRestClientsetErrors(t *testing.T) {
+	responses := map[string]struct {
+		status_code int
+		body        string
+	}{
+		"/api/v1/namespaces/expired":     {http.StatusUnauthorized, "Unauthorized"},
+		"/api/v1/namespaces/missing":     {http.StatusNotFound, `namespaces "missing" not found`},
+		"/api/v1/namespaces/exists":      {http.StatusConflict, `namespaces "exists" already exists`},
+		"/api/v1/namespaces/allocated":   {http.StatusUnprocessableEntity, "provided port is already allocated"},
+		"/api/v1/namespaces/invalid":     {http.StatusUnprocessableEntity, "metadata.name: Invalid value"},
+		"/api/v1/namespaces/unavailable": {http.StatusServiceUnavailable, "etcdserver: leader changed"},
+	}
+	clientset, server, _ := newRestClientset(t, func(w http.ResponseWriter, r *http.Request) {
+		response := responses[r.URL.Path]
+		w.WriteHeader(response.status_code)
+		w.Write([]byte(response.body))
+	})
+
+	expected := map[string]error{"expired": backend.ErrAuthExpired, "missing": backend.ErrNotFound, "exists": backend.ErrNameConflict, "allocated": backend.ErrPortConflict, "unavailable": backend.ErrUnreachable}
+	for name, kind := range expected {
+		if _, err := clientset.GetNamespace(name); !errors.Is(err, kind) {
+			t.Errorf("Expected %v for %s, got %v", kind, name, err)
+		}
+	}
+	_, err := clientset.GetNamespace("invalid")
+	var backend_err *backend.Error
+	if !errors.As(err, &backend_err) || backend_err.Kind != nil || backend_err.Status_Code != http.StatusUnprocessableEntity || !strings.Contains(backend_err.Message, "Invalid value") {
+		t.Fatalf("Other errors should keep their status code and message, got %v", err)
+	}
+
+	server.Close()
+	if _, err := clientset.GetNamespace("missing"); !errors.Is(err, backend.ErrUnreachable) {
+		t.Fatalf("Expected %v once the server is down, got %v", backend.ErrUnreachable, err)
+	}
+}
+
+func TestRestClientsetUntrustedCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	clientset, err := NewRestClientset(ds.KubernetesCredentialsJson{Url: server.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.GetNamespace("runner-chall-1"); err == nil {
+		t.Fatal("Servers whose certificate is not signed by Ca_Cert (or a system CA) should not be trusted")
+	}
+}
@@ -0,0 +1,173 @@
+package api_kubernetes
+
+//Minimal subsets of the Kubernetes API objects used by the runner
+
+type ObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Namespace struct {
+	ApiVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   ObjectMeta      `json:"metadata"`
+	Status     NamespaceStatus `json:"status,omitempty"`
+}
+
+type NamespaceStatus struct {
+	Phase string `json:"phase,omitempty"` //Active or Terminating
+}
+
+type Deployment struct {
+	ApiVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   ObjectMeta       `json:"metadata"`
+	Spec       DeploymentSpec   `json:"spec"`
+	Status     DeploymentStatus `json:"status,omitempty"`
+}
+
+type DeploymentSpec struct {
+	Replicas int             `json:"replicas"`
+	Selector LabelSelector   `json:"selector"`
+	Template PodTemplateSpec `json:"template"`
+}
+
+type DeploymentStatus struct {
+	ReadyReplicas int `json:"readyReplicas,omitempty"`
+}
+
+type LabelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels"`
+}
+
+type PodTemplateSpec struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+}
+
+type PodSpec struct {
+	Containers []Container `json:"containers"`
+	Volumes    []Volume    `json:"volumes,omitempty"`
+}
+
+type Container struct {
+	Name            string                `json:"name"`
+	Image           string                `json:"image"`
+	Args            []string              `json:"args,omitempty"` //Equivalent to the Docker CMD
+	Env             []EnvVar              `json:"env,omitempty"`
+	Ports           []ContainerPort       `json:"ports,omitempty"`
+	VolumeMounts    []VolumeMount         `json:"volumeMounts,omitempty"`
+	Resources       *ResourceRequirements `json:"resources,omitempty"`
+	SecurityContext *SecurityContext      `json:"securityContext,omitempty"`
+}
+
+type ResourceRequirements struct {
+	Limits   map[string]string `json:"limits,omitempty"`
+	Requests map[string]string `json:"requests,omitempty"`
+}
+
+type SecurityContext struct {
+	AllowPrivilegeEscalation *bool         `json:"allowPrivilegeEscalation,omitempty"`
+	ReadOnlyRootFilesystem   bool          `json:"readOnlyRootFilesystem,omitempty"`
+	Capabilities             *Capabilities `json:"capabilities,omitempty"`
+}
+
+type Capabilities struct {
+	Drop []string `json:"drop,omitempty"`
+}
+
+type Volume struct {
+	Name   string             `json:"name"`
+	Secret SecretVolumeSource `json:"secret"`
+}
+
+type SecretVolumeSource struct {
+	SecretName string `json:"secretName"`
+}
+
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type Secret struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	StringData map[string]string `json:"stringData"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ContainerPort struct {
+	ContainerPort int `json:"containerPort"`
+}
+
+type Service struct {
+	ApiVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   ObjectMeta  `json:"metadata"`
+	Spec       ServiceSpec `json:"spec"`
+}
+
+type ServiceSpec struct {
+	Type      string            `json:"type,omitempty"` //NodePort, LoadBalancer or ClusterIP
+	ClusterIP string            `json:"clusterIP,omitempty"`
+	Selector  map[string]string `json:"selector"`
+	Ports     []ServicePort     `json:"ports,omitempty"`
+}
+
+type ServicePort struct {
+	Name       string `json:"name"`
+	Port       int    `json:"port"`
+	TargetPort int    `json:"targetPort"`
+	NodePort   int    `json:"nodePort,omitempty"`
+}
+
+type NetworkPolicy struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Spec       NetworkPolicySpec `json:"spec"`
+}
+
+type NetworkPolicySpec struct {
+	PodSelector LabelSelector             `json:"podSelector"` //Empty to select every pod in the namespace
+	PolicyTypes []string                  `json:"policyTypes"`
+	Egress      []NetworkPolicyEgressRule `json:"egress"`
+}
+
+type NetworkPolicyEgressRule struct {
+	To    []NetworkPolicyPeer `json:"to,omitempty"` //Empty to allow every destination
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+}
+
+type NetworkPolicyPeer struct {
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+type NetworkPolicyPort struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   NodeStatus `json:"status"`
+}
+
+type NodeStatus struct {
+	Allocatable map[string]string `json:"allocatable"` //E.g. {"cpu": "3900m", "memory": "16135236Ki"}
+}
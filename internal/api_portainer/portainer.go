@@ -3,15 +3,86 @@ package api_portainer
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
+	"runner/internal/backend"
 	"runner/internal/creds"
+	"runner/internal/ds"
 	"runner/internal/log"
 )
 
-func LaunchContainer(portainer_url string, container_name string, image_name string, cmds []string, internal_port string, _external_port int, discriminant string) string {
+//Sends a request to Portainer (retrying transient errors if that is safe, see backend.RetryRequest), returning the response body if the request was successful
+func portainerRequest(method string, portainer_url string, path string, requestBody []byte, contentType string) ([]byte, error) {
+	var body []byte
+	err := backend.RetryRequest(method, method+" "+portainer_url+path, func() error {
+		header, authorization := creds.GetPortainerAuthorization(portainer_url)
+		var err error
+		body, err = _portainerRequest(method, portainer_url, path, requestBody, contentType, header, authorization)
+		if errors.Is(err, backend.ErrAuthExpired) { //Portainer may have restarted or revoked the JWT, so log in again and retry once
+			if err := creds.ReauthenticatePortainer(portainer_url, authorization); err != nil {
+				return err
+			}
+			header, authorization = creds.GetPortainerAuthorization(portainer_url)
+			body, err = _portainerRequest(method, portainer_url, path, requestBody, contentType, header, authorization)
+		}
+		return err
+	})
+	return body, err
+}
+
+func _portainerRequest(method string, portainer_url string, path string, requestBody []byte, contentType string, header string, authorization string) ([]byte, error) {
+	client := http.Client{}
+	req, err := http.NewRequest(method, portainer_url+path, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(header, authorization)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, backend.Unreachable(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, backend.Unreachable(err)
+	}
+
+	if resp.StatusCode >= 300 {
+		return nil, backend.DockerError(resp.StatusCode, errorMessage(body))
+	}
+	return body, nil
+}
+
+func errorMessage(body []byte) string { //Portainer returns {"message": ..., "details": ...}, while Docker returns {"message": ...}
+	var raw struct {
+		Message string
+		Details string
+	}
+	if err := json.Unmarshal(body, &raw); err != nil || raw.Message == "" {
+		return string(body)
+	}
+	if raw.Details != "" {
+		return raw.Message + ": " + raw.Details
+	}
+	return raw.Message
+}
+
+func environmentPath(environment_id int) string {
+	return "/api/endpoints/" + strconv.Itoa(environment_id) + "/docker"
+}
+
+func LaunchContainer(portainer_url string, environment_id int, container_name string, image_name string, cmds []string, internal_port string, _external_port int, discriminant string, options backend.LaunchOptions) (string, error) {
 	external_port := strconv.Itoa(_external_port)
 
     // wtf is this
@@ -23,161 +94,384 @@ func LaunchContainer(portainer_url string, container_name string, image_name str
 		}
 	}
 
-	tmp := "{\"Cmd\":[" + cmd + "],\"Image\":\"" + image_name + "\",\"ExposedPorts\":{\"" + internal_port + "/tcp\":{}},\"HostConfig\":{\"PortBindings\":{\"" + internal_port + "/tcp\":[{\"HostPort\":\"" + external_port + "\"}]}}}"
-	log.Debug("launchContainer Body:", tmp)
-
-	requestBody := []byte(tmp)
-
-	client := http.Client{}
-	req, err := http.NewRequest("POST", portainer_url+"/api/endpoints/2/docker/containers/create?name="+container_name+"_"+discriminant, bytes.NewBuffer(requestBody))
+	env, err := json.Marshal(options.EnvList())
+	if err != nil {
+		return "", err
+	}
+	labels, err := json.Marshal(options.Labels)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	req.Header = http.Header{
-		"Authorization": []string{"Bearer " + creds.PortainerJWT[portainer_url]},
-		"Content-Type":  []string{"application/json"},
+	network := networkPrefix + container_name + "_" + discriminant //Every container gets its own network, so that instances cannot reach each other
+	if err := CreateNetwork(portainer_url, environment_id, network, options.DockerNetworkOptions(0)); err != nil {
+		return "", err
 	}
 
-	resp, err := client.Do(req)
+	host_config, err := json.Marshal(hostConfig{PortBindings: map[string][]portBinding{internal_port + "/tcp": {{HostIp: options.HostIp(0), HostPort: external_port}}}, NetworkMode: network, DockerHostLimits: options.DockerHostLimits()})
 	if err != nil {
-		panic(err)
+		deleteNetwork(portainer_url, environment_id, network)
+		return "", err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+
+	tmp := "{\"Cmd\":[" + cmd + "],\"Env\":" + string(env) + ",\"Labels\":" + string(labels) + ",\"Image\":\"" + image_name + "\",\"ExposedPorts\":{\"" + internal_port + "/tcp\":{}},\"HostConfig\":" + string(host_config) + "}"
+	log.Debug("launchContainer", container_name+"_"+discriminant) //Not the body, which holds the env of the instance (secrets and flags)
+
+	requestBody := []byte(tmp)
+
+	body, err := portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/containers/create?name="+url.QueryEscape(container_name+"_"+discriminant), requestBody, "application/json")
 	if err != nil {
-		panic(err)
+		deleteNetwork(portainer_url, environment_id, network)
+		return "", err
 	}
-	log.Debug("launchContainer Response:", string(body))
 
 	var raw map[string]interface{}
 	if err := json.Unmarshal(body, &raw); err != nil {
-		panic(err)
+		deleteNetwork(portainer_url, environment_id, network)
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+	id, ok := raw["Id"].(string)
+	if !ok {
+		deleteNetwork(portainer_url, environment_id, network)
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
 	}
-	id := raw["Id"].(string)
+	log.Debug("launchContainer Id:", id)
 
-	startContainer(portainer_url, id)
+	if err := prepareContainer(portainer_url, environment_id, id, options); err != nil {
+		if err := deleteContainerAndNetwork(portainer_url, environment_id, id, network); err != nil { //Do not leave the created container behind
+			log.Warn("Unable to delete container", id, "that failed to start", err)
+		}
+		return "", err
+	}
 
-	return id
+	return id, nil
 }
 
-func startContainer(portainer_url string, id string) {
-	requestBody := []byte("{}")
+//Writes the files of options to the container and starts it
+func prepareContainer(portainer_url string, environment_id int, id string, options backend.LaunchOptions) error {
+	if len(options.Files) > 0 {
+		if err := putContainerFiles(portainer_url, environment_id, id, options); err != nil {
+			return err
+		}
+	}
+	return startContainer(portainer_url, environment_id, id)
+}
 
-	client := http.Client{}
-	req, err := http.NewRequest("POST", portainer_url+"/api/endpoints/2/docker/containers/"+id+"/start", bytes.NewBuffer(requestBody))
+func putContainerFiles(portainer_url string, environment_id int, id string, options backend.LaunchOptions) error {
+	archive, err := options.FilesArchive()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	_, err = portainerRequest("PUT", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/archive?path=/", archive, "application/x-tar")
+	return err
+}
 
-	req.Header = http.Header{
-		"Authorization": []string{"Bearer " + creds.PortainerJWT[portainer_url]},
+func startContainer(portainer_url string, environment_id int, id string) error {
+	body, err := portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/start", []byte("{}"), "")
+	if err != nil {
+		return err
 	}
 
-	resp, err := client.Do(req)
+	log.Info("startContainer", string(body))
+	return nil
+}
+
+//Runs script in a container of ds.EgressFilterImage on the network of the host, see backend.EgressRulesScript
+func RunEgressFilter(portainer_url string, environment_id int, script string) error {
+	reqJson, err := json.Marshal(map[string]interface{}{"Image": ds.EgressFilterImage, "Cmd": backend.EgressFilterCmd(script), "HostConfig": map[string]interface{}{"NetworkMode": "host", "CapAdd": backend.EgressFilterCapabilities}})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	id, err := createContainer(portainer_url, environment_id, reqJson)
+	if errors.Is(err, backend.ErrImageMissing) {
+		if err := pullImage(portainer_url, environment_id, ds.EgressFilterImage); err != nil {
+			return err
+		}
+		id, err = createContainer(portainer_url, environment_id, reqJson)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer DeleteContainer(portainer_url, environment_id, id)
 
-	log.Info("startContainer", string(body))
+	if err := startContainer(portainer_url, environment_id, id); err != nil {
+		return err
+	}
+	body, err := portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/wait", nil, "")
+	if err != nil {
+		return err
+	}
+	var raw struct {
+		StatusCode int
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+	if raw.StatusCode != 0 {
+		logs, _ := ContainerLogs(portainer_url, environment_id, id)
+		return &backend.Error{Message: "egress filter exited with status " + strconv.Itoa(raw.StatusCode) + ": " + logs}
+	}
+	return nil
 }
 
-func DeleteContainer(portainer_url string, id string) {
-	client := http.Client{}
-	req, err := http.NewRequest("DELETE", portainer_url+"/api/endpoints/2/docker/containers/"+id+"?force=true", nil)
+//Creates an unnamed container, returning its id
+func createContainer(portainer_url string, environment_id int, reqJson []byte) (string, error) {
+	body, err := portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/containers/create", reqJson, "application/json")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	var raw struct {
+		Id string
+	}
+	if err := json.Unmarshal(body, &raw); err != nil || raw.Id == "" {
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+	return raw.Id, nil
+}
 
-	req.Header = http.Header{
-		"Authorization": []string{"Bearer " + creds.PortainerJWT[portainer_url]},
+func pullImage(portainer_url string, environment_id int, image string) error {
+	path := environmentPath(environment_id) + "/images/create?fromImage=" + url.QueryEscape(image)
+	if last_component := image[strings.LastIndex(image, "/")+1:]; !strings.ContainsAny(last_component, ":@") {
+		path += "&tag=latest" //Otherwise every tag of the image is pulled
 	}
+	_, err := portainerRequest("POST", portainer_url, path, nil, "")
+	return err
+}
 
-	resp, err := client.Do(req)
+//Stops the container, giving it timeout seconds to exit after SIGTERM before it is killed
+func StopContainer(portainer_url string, environment_id int, id string, timeout int) error {
+	_, err := portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/stop?t="+strconv.Itoa(timeout), nil, "")
+	var docker_err *backend.Error
+	if errors.As(err, &docker_err) && docker_err.Status_Code == http.StatusNotModified { //The container already stopped
+		return nil
+	}
+	return err
+}
+
+//Stops every container of the stack, so that they get to exit before the stack is deleted
+func StopStack(portainer_url string, environment_id int, id string, timeout int) error {
+	stack, err := InspectStack(portainer_url, id)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	containers, err := ListContainers(portainer_url, environment_id, map[string][]string{"label": {"com.docker.compose.project=" + stack.Name}})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	for _, container := range containers {
+		if err := StopContainer(portainer_url, environment_id, container.Id, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteContainer(portainer_url string, environment_id int, id string) error {
+	body, err := portainerRequest("DELETE", portainer_url, environmentPath(environment_id)+"/containers/"+id+"?force=true", nil, "")
+	if err != nil {
+		return err
 	}
 
 	log.Info("deleteContainer", string(body))
+	return nil
 }
 
-func LaunchStack(portainer_url string, stack_name string, docker_compose string, discriminant string) string {
-	json_docker_compose, err := json.Marshal(docker_compose) //Make sure docker_compose is JSON Encoded
+//Deletes the container, and the network of the instance if the container has one (containers launched before instances had networks do not)
+func DeleteContainerAndNetwork(portainer_url string, environment_id int, id string) error {
+	network, err := ContainerNetwork(portainer_url, environment_id, id)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return deleteContainerAndNetwork(portainer_url, environment_id, id, network)
+}
 
-    // bruh
-	tmp := "{\"name\":\"" + stack_name + "_" + discriminant + "\",\"stackFileContent\":" + string(json_docker_compose) + "}"
-    
-    // tmp := map[string]interface{}{
-    //     "name": stack_name + "_" + discriminant,
-    //     "stackFileContent": string(json_docker_compose),
-    // }
-    log.Debug(tmp)
-    // reqJson, err := json.Marshal(tmp)
-	log.Debug("launchStack Body:", tmp)
+func deleteContainerAndNetwork(portainer_url string, environment_id int, id string, network string) error {
+	if err := DeleteContainer(portainer_url, environment_id, id); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(network, networkPrefix) {
+		return nil
+	}
+	return DeleteNetwork(portainer_url, environment_id, network)
+}
 
-	requestBody := []byte(tmp)
+const networkPrefix = "runner_" //Networks of instances, as opposed to networks that containers share (E.g. bridge)
 
-	client := http.Client{}
-	// req, err := http.NewRequest("POST", portainer_url+"/api/stacks?type=2&method=string&endpointId=2", bytes.NewBuffer(reqJson))
-	req, err := http.NewRequest("POST", portainer_url+"/api/stacks/create/standalone/string?endpointId=2", bytes.NewBuffer(requestBody))
+func CreateNetwork(portainer_url string, environment_id int, name string, options map[string]string) error {
+	reqJson, err := json.Marshal(map[string]interface{}{"Name": name, "Driver": "bridge", "Options": options, "CheckDuplicate": true})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	_, err = portainerRequest("POST", portainer_url, environmentPath(environment_id)+"/networks/create", reqJson, "application/json")
+	return err
+}
+
+func DeleteNetwork(portainer_url string, environment_id int, name string) error {
+	_, err := portainerRequest("DELETE", portainer_url, environmentPath(environment_id)+"/networks/"+url.PathEscape(name), nil, "")
+	return err
+}
 
-	req.Header = http.Header{
-		"Authorization": []string{"Bearer " + creds.PortainerJWT[portainer_url]},
-		"Content-Type":  []string{"application/json"},
+func deleteNetwork(portainer_url string, environment_id int, name string) { //Cleans up after a failed launch
+	if err := DeleteNetwork(portainer_url, environment_id, name); err != nil {
+		log.Warn("Unable to delete network", name, "of a container that failed to launch", err)
 	}
+}
 
-	resp, err := client.Do(req)
+//Returns the network that the container was created on
+func ContainerNetwork(portainer_url string, environment_id int, id string) (string, error) {
+	body, err := portainerRequest("GET", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/json", nil, "")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+
+	var raw struct {
+		HostConfig struct {
+			NetworkMode string
+		}
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return "", err
+	}
+	return raw.HostConfig.NetworkMode, nil
+}
+
+func LaunchStack(portainer_url string, environment_id int, stack_name string, docker_compose string, discriminant string) (string, error) {
+	reqJson, err := json.Marshal(map[string]interface{}{
+		"name":             stack_name + "_" + discriminant,
+		"stackFileContent": docker_compose,
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Debug("launchStack", stack_name+"_"+discriminant) //Not the body, which holds the env of the instance (secrets and flags)
+
+	body, err := portainerRequest("POST", portainer_url, "/api/stacks/create/standalone/string?endpointId="+strconv.Itoa(environment_id), reqJson, "application/json")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	log.Debug("launchStack Response:", string(body))
 
 	var raw map[string]interface{}
 	if err := json.Unmarshal(body, &raw); err != nil {
-		panic(err)
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
 	}
-	id := int(raw["Id"].(float64)) //Cannot directly cast to string
+	id, ok := raw["Id"].(float64) //Cannot directly cast to string
+	if !ok {
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+	log.Debug("launchStack Id:", id)
 
-	return strconv.Itoa(id)
+	return strconv.Itoa(int(id)), nil
 }
 
-func DeleteStack(portainer_url string, id string) {
-	client := http.Client{}
-	req, err := http.NewRequest("DELETE", portainer_url+"/api/stacks/"+id+"?endpointId=2", nil)
+func DeleteStack(portainer_url string, environment_id int, id string) error {
+	body, err := portainerRequest("DELETE", portainer_url, "/api/stacks/"+id+"?endpointId="+strconv.Itoa(environment_id), nil, "")
 	if err != nil {
-        print(portainer_url+"/api/stacks/"+id+"?endpointId=2")
-		panic(err)
+		return err
 	}
 
-	req.Header = http.Header{
-		"Authorization": []string{"Bearer " + creds.PortainerJWT[portainer_url]},
+	log.Info("deleteStack", string(body))
+	return nil
+}
+
+func InspectContainer(portainer_url string, environment_id int, id string) (string, error) {
+	body, err := portainerRequest("GET", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/json", nil, "")
+	if err != nil {
+		return "", err
 	}
 
-	resp, err := client.Do(req)
+	var raw struct {
+		State struct {
+			Status string
+		}
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return "", err
+	}
+	return raw.State.Status, nil
+}
+
+func InspectStack(portainer_url string, id string) (PortainerStack, error) {
+	body, err := portainerRequest("GET", portainer_url, "/api/stacks/"+id, nil, "")
 	if err != nil {
-		panic(err)
+		return PortainerStack{}, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+
+	var stack PortainerStack
+	if err := json.Unmarshal(body, &stack); err != nil {
+		return PortainerStack{}, err
+	}
+	return stack, nil
+}
+
+func ListContainers(portainer_url string, environment_id int, filters map[string][]string) ([]DockerContainer, error) {
+	path := environmentPath(environment_id) + "/containers/json?all=1"
+	if len(filters) > 0 {
+		json_filters, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		path += "&filters=" + url.QueryEscape(string(json_filters))
+	}
+
+	body, err := portainerRequest("GET", portainer_url, path, nil, "")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	log.Info("deleteStack", string(body))
+	var containers []DockerContainer
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func ListStacks(portainer_url string, environment_id int) ([]PortainerStack, error) {
+	body, err := portainerRequest("GET", portainer_url, "/api/stacks", nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var stacks []PortainerStack
+	if err := json.Unmarshal(body, &stacks); err != nil {
+		return nil, err
+	}
+
+	var environment_stacks []PortainerStack
+	for _, stack := range stacks {
+		if stack.EndpointId == environment_id {
+			environment_stacks = append(environment_stacks, stack)
+		}
+	}
+	return environment_stacks, nil
+}
+
+//Checks that Portainer is up and that it can reach the Docker daemon of the environment
+func Ping(portainer_url string, environment_id int) error {
+	if _, err := portainerRequest("GET", portainer_url, "/api/status", nil, ""); err != nil {
+		return err
+	}
+	_, err := portainerRequest("GET", portainer_url, environmentPath(environment_id)+"/_ping", nil, "")
+	return err
+}
+
+//Returns the total CPU and memory of the Docker host of the environment
+func HostInfo(portainer_url string, environment_id int) (ds.HostResources, error) {
+	body, err := portainerRequest("GET", portainer_url, environmentPath(environment_id)+"/info", nil, "")
+	if err != nil {
+		return ds.HostResources{}, err
+	}
+
+	var info DockerInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return ds.HostResources{}, err
+	}
+	return info.ToHostResources(), nil
+}
+
+func ContainerLogs(portainer_url string, environment_id int, id string) (string, error) {
+	body, err := portainerRequest("GET", portainer_url, environmentPath(environment_id)+"/containers/"+id+"/logs?stdout=1&stderr=1&tail=200", nil, "")
+	if err != nil {
+		return "", err
+	}
+	return backend.DemuxLogs(body), nil
 }
@@ -0,0 +1,181 @@
+package api_portainer
+
+import (
+	"strconv"
+	"strings"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/ds"
+	"runner/internal/yaml"
+)
+
+// Backend launches instances as Portainer containers and stacks
+type Backend struct{}
+
+func (Backend) Launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	run := func(script string) error { return RunEgressFilter(target.Url, target.Environment_Id, script) }
+	if err := backend.AddEgressRules(options.Instance_Id, options.Egress, run); err != nil {
+		return "", err
+	}
+	id, err := launch(target, ch, ports, discriminant, options)
+	if err != nil {
+		backend.RemoveEgressRules(options.Instance_Id, options.Egress, run)
+	}
+	return id, err
+}
+
+func launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	if ch.Docker_Compose {
+		new_docker_compose, err := yaml.DockerComposeCopy(ch.Docker_Compose_File, ports, options.HostIps, options.Env)
+		if err == nil {
+			new_docker_compose, err = yaml.DockerComposeAddFiles(new_docker_compose, options.Files)
+		}
+		if err == nil {
+			new_docker_compose, err = yaml.DockerComposeAddLimits(new_docker_compose, options.Limits)
+		}
+		if err == nil {
+			new_docker_compose, err = yaml.DockerComposeAddLabels(new_docker_compose, options.Labels)
+		}
+		if err == nil {
+			new_docker_compose, err = yaml.DockerComposeSetEgress(new_docker_compose, egressDriverOpts(options)) //Every stack already gets its own default network
+		}
+		if err != nil {
+			return "", err
+		}
+		return LaunchStack(target.Url, target.Environment_Id, ch.Challenge_Name, new_docker_compose, discriminant)
+	}
+	return LaunchContainer(target.Url, target.Environment_Id, ch.Challenge_Name, ch.Image_Name, api_sql.DeserializeNL(ch.Docker_Cmds), ch.Internal_Port, ports[0], discriminant, options)
+}
+
+//Returns the driver options of the networks of a stack, nil if the instance has full egress
+func egressDriverOpts(options backend.LaunchOptions) func(i int) map[string]string {
+	if options.Egress.Egress == ds.EgressFull {
+		return nil
+	}
+	return options.DockerNetworkOptions
+}
+
+func (Backend) Stop(instance ds.Instance, ch ds.RunnerChallenge, graceful bool) error {
+	var err error
+	if graceful && ch.Docker_Compose {
+		err = StopStack(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id, ds.StopTimeoutSeconds)
+	} else if graceful {
+		err = StopContainer(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id, ds.StopTimeoutSeconds)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ch.Docker_Compose {
+		err = DeleteStack(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id)
+	} else {
+		err = DeleteContainerAndNetwork(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id)
+	}
+	if err != nil {
+		return err
+	}
+	backend.RemoveEgressRules(instance.Instance_Id, ch.GetEgressPolicy(), func(script string) error {
+		return RunEgressFilter(instance.Portainer_Url, instance.Portainer_Environment_Id, script)
+	})
+	return nil
+}
+
+func (Backend) Inspect(instance ds.Instance, ch ds.RunnerChallenge) (backend.Status, error) {
+	if ch.Docker_Compose {
+		stack, err := InspectStack(instance.Portainer_Url, instance.Portainer_Id)
+		if err != nil {
+			return backend.Status{}, err
+		}
+		if stack.Status == 1 {
+			return backend.Status{State: "running"}, nil
+		}
+		return backend.Status{State: "exited"}, nil
+	}
+
+	state, err := InspectContainer(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id)
+	if err != nil {
+		return backend.Status{}, err
+	}
+	return backend.Status{State: state}, nil
+}
+
+func (Backend) List(target ds.Target) ([]backend.Resource, error) {
+	containers, err := ListContainers(target.Url, target.Environment_Id, map[string][]string{"label": backend.RunnerLabelFilters()})
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []backend.Resource
+	stack_instances := make(map[string]int) //Stack name -> Instance_Id, Portainer does not label stacks, so they are found via their containers
+	for _, container := range containers {
+		instance_id, _ := strconv.Atoi(container.Labels[backend.InstanceIdLabel])
+		if project := container.Labels["com.docker.compose.project"]; project != "" {
+			stack_instances[project] = instance_id
+			continue
+		}
+		resources = append(resources, backend.Resource{Id: container.Id, Name: containerName(container), Instance_Id: instance_id})
+	}
+
+	if len(stack_instances) > 0 {
+		stacks, err := ListStacks(target.Url, target.Environment_Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range stacks {
+			if instance_id, ok := stack_instances[stack.Name]; ok {
+				resources = append(resources, backend.Resource{Id: strconv.Itoa(stack.Id), Name: stack.Name, Stack: true, Instance_Id: instance_id})
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+func (Backend) Ping(target ds.Target) error {
+	return Ping(target.Url, target.Environment_Id)
+}
+
+func (Backend) Info(target ds.Target) (ds.HostResources, error) {
+	return HostInfo(target.Url, target.Environment_Id)
+}
+
+func (Backend) PublishedPorts(target ds.Target) ([]int, error) {
+	containers, err := ListContainers(target.Url, target.Environment_Id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return publishedPorts(containers), nil
+}
+
+func (Backend) Logs(instance ds.Instance, ch ds.RunnerChallenge) (string, error) {
+	if !ch.Docker_Compose {
+		return ContainerLogs(instance.Portainer_Url, instance.Portainer_Environment_Id, instance.Portainer_Id)
+	}
+
+	stack, err := InspectStack(instance.Portainer_Url, instance.Portainer_Id)
+	if err != nil {
+		return "", err
+	}
+	containers, err := ListContainers(instance.Portainer_Url, instance.Portainer_Environment_Id, map[string][]string{"label": {"com.docker.compose.project=" + stack.Name}})
+	if err != nil {
+		return "", err
+	}
+
+	logs := ""
+	for _, container := range containers {
+		container_logs, err := ContainerLogs(instance.Portainer_Url, instance.Portainer_Environment_Id, container.Id)
+		if err != nil {
+			return "", err
+		}
+		logs += "==> " + containerName(container) + " <==\n" + container_logs
+	}
+	return logs, nil
+}
+
+func containerName(container DockerContainer) string {
+	if len(container.Names) == 0 {
+		return container.Id
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
@@ -0,0 +1,59 @@
+package api_portainer
+
+import (
+	"runner/internal/backend"
+	"runner/internal/ds"
+)
+
+type PortainerStack struct {
+	Id         int
+	Name       string
+	EndpointId int
+	Status     int //1: Active, 2: Inactive
+}
+
+type hostConfig struct {
+	PortBindings map[string][]portBinding
+	NetworkMode  string
+	backend.DockerHostLimits
+}
+
+type portBinding struct {
+	HostIp   string `json:",omitempty"`
+	HostPort string
+}
+
+type DockerContainer struct {
+	Id     string
+	Names  []string
+	State  string
+	Labels map[string]string
+	Ports  []DockerPort
+}
+
+type DockerPort struct {
+	PrivatePort int
+	PublicPort  int //0 if the port is not published
+	Type        string
+}
+
+func publishedPorts(containers []DockerContainer) []int {
+	ports := []int{}
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if port.PublicPort != 0 {
+				ports = append(ports, port.PublicPort)
+			}
+		}
+	}
+	return ports
+}
+
+type DockerInfo struct {
+	NCPU     int
+	MemTotal int64 //Bytes
+}
+
+func (info DockerInfo) ToHostResources() ds.HostResources {
+	return ds.HostResources{Cpu_Millicores: info.NCPU * 1000, Memory_Mb: int(info.MemTotal / (1024 * 1024))}
+}
@@ -1,6 +1,8 @@
 package api_sql
 
 import (
+	"errors"
+
 	"runner/internal/ds"
 )
 
@@ -18,21 +20,54 @@ func GetInstances() []ds.Instance {
 	return instances
 }
 
-func GetInstanceCount() int64 {
+func GetRunnerInstances() []ds.Instance { //Instances added by this runner, other runners may share the database
+	instances := []ds.Instance{}
+	DB.Where("runner_id = ?", ds.RunnerId).Find(&instances)
+	return instances
+}
+
+func GetInstanceCount() int64 { //Failed instances do not count towards the max number of instances
 	var count int64
-	DB.Model(&ds.Instance{}).Count(&count)
+	DB.Model(&ds.Instance{}).Where("state <> ?", ds.InstanceStateFailed).Count(&count)
 	return count
 }
 
 func GetActiveUserInstance(userid string) ds.Instance {
 	var instance ds.Instance
-	DB.Where("usr_id = ?", userid).First(&instance)
+	DB.Where("usr_id = ? AND state <> ?", userid, ds.InstanceStateFailed).First(&instance)
 	return instance
 }
 
-//instance needs Instance_Id, Usr_Id, Challenge_Id, Instance_Timeout, Ports_Used
-func AddInstance(Instance ds.Instance) {
-	DB.Create(&Instance)
+func GetFailedUserInstances(userid string) []ds.Instance {
+	instances := []ds.Instance{}
+	DB.Where("usr_id = ? AND state = ?", userid, ds.InstanceStateFailed).Order("instance_id DESC").Find(&instances)
+	return instances
+}
+
+func GetChallengeInstances(challid string) []ds.Instance {
+	instances := []ds.Instance{}
+	DB.Where("challenge_id = ?", challid).Order("instance_id").Find(&instances)
+	return instances
+}
+
+func GetPortainerInstances(portainer_url string) []ds.Instance { //Instances on every environment of the server
+	instances := []ds.Instance{}
+	DB.Where("portainer_url = ?", portainer_url).Order("instance_id").Find(&instances)
+	return instances
+}
+
+//instance needs Usr_Id, Challenge_Id, Instance_Timeout, Ports_Used. Returns instance with the Instance_Id generated by the database,
+//or an error if it could not be written (E.g. a duplicate Instance_Id if the sequence of the column is behind)
+func AddInstance(Instance ds.Instance) (ds.Instance, error) {
+	if Instance.State == "" {
+		Instance.State = ds.InstanceStatePending
+	}
+	Instance.Instance_Id = 0 //gorm treats an Instance_Id of 0 as unset, letting the database generate it
+	Instance.Runner_Id = ds.RunnerId
+	if err := DB.Create(&Instance).Error; err != nil {
+		return ds.Instance{}, err
+	}
+	return Instance, nil
 }
 
 func UpdateInstance(instance ds.Instance) {
@@ -41,14 +76,45 @@ func UpdateInstance(instance ds.Instance) {
 	}
 }
 
-func DeleteInstance(Instance_Id int) {
-	DB.Delete(&ds.Instance{}, Instance_Id)
+func DeleteInstance(Instance_Id int) bool { //Returns false if the instance was already deleted
+	return DB.Delete(&ds.Instance{}, Instance_Id).RowsAffected > 0
 }
 
 func SetInstancePortainerId(Instance_Id int, Portainer_Id string) {
 	DB.Model(&ds.Instance{}).Where("instance_id = ?", Instance_Id).Update("portainer_id", Portainer_Id)
 }
 
+//Replaces the ports of an instance that is still starting, failing if the instance has been killed in the meantime
+func SetStartingInstancePorts(Instance_Id int, Ports_Used string) error {
+	result := DB.Model(&ds.Instance{}).Where("instance_id = ? AND state = ?", Instance_Id, ds.InstanceStateStarting).Update("ports_used", Ports_Used)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStateChanged
+	}
+	return nil
+}
+
 func UpdateInstanceTime(Instance_Id int, New_Instance_Timeout int64) {
 	DB.Model(&ds.Instance{}).Where("instance_id = ?", Instance_Id).Update("instance_timeout", New_Instance_Timeout)
 }
+
+var ErrInvalidStateTransition = errors.New("invalid instance state transition")
+var ErrStateChanged = errors.New("instance is no longer in the expected state")
+
+//Moves the instance from state from to state to, failing if another request has already moved it out of state from
+func SetInstanceState(Instance_Id int, from string, to string, Failure_Reason string) error {
+	if !ds.ValidInstanceStateTransition(from, to) {
+		return ErrInvalidStateTransition
+	}
+
+	result := DB.Model(&ds.Instance{}).Where("instance_id = ? AND state = ?", Instance_Id, from).Updates(map[string]interface{}{"state": to, "failure_reason": Failure_Reason})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStateChanged
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package api_sql
 
 import (
+	"database/sql"
 	"time"
 
 	"gorm.io/gorm"
@@ -22,41 +23,94 @@ func createTableIfNotExists(x interface{}) {
 func initalizeDB() {
 	createTableIfNotExists(ds.Instance{})
 	createTableIfNotExists(ds.RunnerChallenge{})
+	syncInstanceIdSequence()
+	claimInstances()
 }
 
-func validatePortainerUrl(url string) bool {
-	_, ok := creds.PortainerCreds[url]
-	return ok
+//Instances added before instances recorded their runner were added when a single runner used the database, so they belong to this runner
+func claimInstances() {
+	if err := DB.Model(&ds.Instance{}).Where("runner_id IS NULL OR runner_id = ?", "").Update("runner_id", ds.RunnerId).Error; err != nil {
+		panic(err)
+	}
 }
 
+//Instance_Ids used to be picked by the runner, which does not advance the sequence of the column in PostgreSQL, so make sure that the sequence continues after the largest Instance_Id.
+//The sequence is only ever moved forward, and the table is locked against inserts (and other runners syncing) meanwhile, so that no Instance_Id handed out by the sequence is handed out again
+func syncInstanceIdSequence() {
+	if DB.Dialector.Name() != "postgres" {
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE instances IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var sequence sql.NullString
+		if err := tx.Raw("SELECT pg_get_serial_sequence('instances', 'instance_id')").Scan(&sequence).Error; err != nil {
+			return err
+		}
+		if !sequence.Valid { //The column is not generated by a sequence
+			return nil
+		}
+		//pg_get_serial_sequence returns a quoted name. The next value of the sequence is last_value, or last_value + 1 once it has been handed out
+		return tx.Exec("SELECT setval(?::regclass, GREATEST((SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM "+sequence.String+"), COALESCE((SELECT MAX(instance_id) FROM instances), 0) + 1), false)", sequence.String).Error
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func validatePortainerTarget(target ds.Target) bool {
+	for _, portainer_target := range creds.PortainerTargets {
+		if portainer_target == target {
+			return true
+		}
+	}
+	return false
+}
+
+//Takes over the instances of this runner after it restarts. Instances of other runners sharing the database are left to them, as they may still be launching
 func syncInstances() {
-	instances := []ds.Instance{}
-	DB.Find(&instances) //Fully trust DB
+	instances := GetRunnerInstances() //Fully trust DB
 
 	for _, instance := range instances {
-		if !validatePortainerUrl(instance.Portainer_Url) {
-			panic("Instance " + instance.ToString() + "'s Portainer_Url is not specified in credentials")
+		if ds.Backend == "PORTAINER" && instance.Portainer_Environment_Id == 0 { //Instances created before environments were configurable always used environment 2
+			instance.Portainer_Environment_Id = 2
+			DB.Model(&ds.Instance{}).Where("instance_id = ?", instance.Instance_Id).Update("portainer_environment_id", instance.Portainer_Environment_Id)
 		}
-
-		if (instance.Instance_Id + 1) > ds.NextInstanceId {
-			ds.NextInstanceId = instance.Instance_Id + 1
+		if !validatePortainerTarget(instance.GetTarget()) {
+			panic("Instance " + instance.ToString() + "'s Portainer_Url and Portainer_Environment_Id are not specified in credentials")
 		}
-		ds.InstanceQueue.Put(instance.Instance_Timeout, instance.Instance_Id)
 
-		deserialized_ports := DeserializeI(instance.Ports_Used)
-		for _, port := range deserialized_ports {
-			ds.UsedPorts[port] = true
+		ds.State.QueueInstance(instance.Instance_Timeout, instance.Instance_Id)
+
+		switch instance.State {
+		case "": //Instances created before instances had states were only written once running
+			instance.State = ds.InstanceStateRunning
+			DB.Model(&ds.Instance{}).Where("instance_id = ?", instance.Instance_Id).Update("state", instance.State)
+		case ds.InstanceStatePending, ds.InstanceStateStarting: //The runner stopped while the instance was launching, so the launch will never complete
+			SetInstanceState(instance.Instance_Id, instance.State, ds.InstanceStateFailed, "The runner restarted while the instance was launching")
+			continue
+		case ds.InstanceStateStopping: //The runner stopped while the instance was being deleted (or it could not be stopped), so let the Kill Worker try again once it expires
+		case ds.InstanceStateFailed: //Resources of failed instances have already been released
+			continue
 		}
 
-		creds.IncrementPortainerQueue(instance.Portainer_Url)
+		ds.State.Ports.Reserve(instance.GetTarget(), DeserializeI(instance.Ports_Used))
+
+		ds.State.Targets.IncrementInstanceCount(instance.GetTarget())
+		ds.State.Targets.ReserveResources(instance.Instance_Id, instance.GetTarget(), GetRunnerChallenge(instance.Challenge_Id).GetResources())
 	}
 }
 
 func SyncWithDB() {
+	SyncWithDialector(creds.GetSqlDataSource())
+}
+
+func SyncWithDialector(dialector gorm.Dialector) {
 	log.Info("Starting DB Sync...")
 
 	var err error
-	DB, err = gorm.Open(creds.GetSqlDataSource(), &gorm.Config{})
+	DB, err = gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		panic(err)
 	}
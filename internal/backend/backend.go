@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"runner/internal/ds"
+)
+
+// Status of an instance as reported by the backend
+type Status struct {
+	State string //E.g. "running", "exited"
+}
+
+// A container or stack that the runner launched on a backend target
+type Resource struct {
+	Id          string
+	Name        string
+	Stack       bool //True if the resource was launched for a docker compose challenge
+	Instance_Id int  //From the InstanceIdLabel of the resource
+}
+
+// Every container, stack and namespace launched by the runner is labelled with these, see InstanceLabels
+const (
+	RunnerIdLabel    = "runner.id" //ds.RunnerId of the runner that launched the resource, so that runners sharing a target leave each other's resources alone
+	InstanceIdLabel  = "runner.instance_id"
+	UserIdLabel      = "runner.user_id"
+	ChallengeIdLabel = "runner.challenge_id"
+	ExpiryLabel      = "runner.expiry" //Unix timestamp of the expiry of the instance when it was launched, extending the instance does not update it
+)
+
+// Returns the labels of the resources of instance
+func InstanceLabels(instance ds.Instance) map[string]string {
+	return map[string]string{
+		RunnerIdLabel:    ds.RunnerId,
+		InstanceIdLabel:  strconv.Itoa(instance.Instance_Id),
+		UserIdLabel:      instance.Usr_Id,
+		ChallengeIdLabel: instance.Challenge_Id,
+		ExpiryLabel:      strconv.FormatInt(instance.Instance_Timeout/1e9, 10),
+	}
+}
+
+// Returns the label filters matching every resource launched by this runner
+func RunnerLabelFilters() []string {
+	return []string{RunnerIdLabel + "=" + ds.RunnerId, InstanceIdLabel}
+}
+
+// Backend is an orchestrator that instances can be launched on (E.g. Portainer, Docker)
+type Backend interface {
+	Launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options LaunchOptions) (string, error) //Returns the Portainer_Id of the launched instance
+	Stop(instance ds.Instance, ch ds.RunnerChallenge, graceful bool) error                                                   //If graceful, containers get ds.StopTimeoutSeconds to exit after SIGTERM before they are killed
+	Inspect(instance ds.Instance, ch ds.RunnerChallenge) (Status, error)
+	List(target ds.Target) ([]Resource, error) //Returns every resource on target launched by this runner, see RunnerLabelFilters
+	Logs(instance ds.Instance, ch ds.RunnerChallenge) (string, error)
+	Ping(target ds.Target) error //Returns an error if instances cannot currently be launched on target
+	Info(target ds.Target) (ds.HostResources, error)
+	PublishedPorts(target ds.Target) ([]int, error) //Returns every host port published on target, including by containers that the runner did not launch
+}
+
+var Active Backend //Set on startup based on config
+
+// Docker multiplexes stdout and stderr in the logs of containers without a TTY, with an 8 byte header before every frame
+// Source: https://docs.docker.com/engine/api/v1.41/#operation/ContainerAttach
+func DemuxLogs(raw []byte) string {
+	logs := []byte{}
+	for len(raw) >= 8 && raw[0] <= 2 && raw[1] == 0 && raw[2] == 0 && raw[3] == 0 {
+		size := int(binary.BigEndian.Uint32(raw[4:8]))
+		if 8+size > len(raw) {
+			size = len(raw) - 8
+		}
+		logs = append(logs, raw[8:8+size]...)
+		raw = raw[8+size:]
+	}
+	logs = append(logs, raw...) //Containers with a TTY are not multiplexed
+	return string(logs)
+}
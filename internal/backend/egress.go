@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+// Docker has no egress policy for networks, so the DOCKER and PORTAINER backends enforce it with iptables rules on the host.
+// Every network of an instance gets a bridge named EgressBridge, so that the rules can match the bridges of the instance with a
+// single interface wildcard, and the rules are installed before the networks are created, so that no container runs unfiltered.
+// The rules are run by a short lived container of ds.EgressFilterImage on the network of the host, see EgressFilterCmd.
+
+const egressComment = "runner-egress:" //Followed by the bridge prefix of the instance, the rules of an instance are removed by this comment
+
+// Capabilities of the egress filter container, which needs to change the iptables rules of the host
+var EgressFilterCapabilities = []string{"NET_ADMIN", "NET_RAW"}
+
+// Returns the prefix of the bridge names of the instance, unique across runners sharing a host (bridge names are at most 15 characters)
+func EgressBridgePrefix(instance_id int) string {
+	sum := sha256.Sum256([]byte(ds.RunnerId + "/" + strconv.Itoa(instance_id)))
+	return "rn" + hex.EncodeToString(sum[:])[:10]
+}
+
+// Returns the name of the bridge of the i-th network of the instance
+func EgressBridge(instance_id int, i int) string {
+	return EgressBridgePrefix(instance_id) + strconv.Itoa(i)
+}
+
+// Returns the command of the egress filter container that runs script
+func EgressFilterCmd(script string) []string {
+	return []string{"sh", "-c", script}
+}
+
+// Returns the script that installs the egress rules of the instance. Connections from the bridges of the instance may only be opened to
+// the bridges of the instance (and for the allowlist policy, to the addresses in the allowlist), never to other instances or the host itself.
+// The same rules are installed for IPv4 and IPv6, so that instances cannot get around them if the Docker daemon enables IPv6 on their networks
+func EgressRulesScript(instance_id int, policy ds.EgressPolicy) string {
+	bridges := EgressBridgePrefix(instance_id) + "+"
+
+	script := "set -e\n"
+	//ip6tables only has a DOCKER-USER chain if Docker manages the IPv6 rules, otherwise forwarded IPv6 traffic is filtered in FORWARD
+	script += "if ip6tables -w -S DOCKER-USER >/dev/null 2>&1; then forward6=DOCKER-USER; else forward6=FORWARD; fi\n"
+	for _, family := range []struct {
+		iptables string
+		forward  string
+		ipv6     bool
+	}{{"iptables", "DOCKER-USER", false}, {"ip6tables", "$forward6", true}} {
+		rule := func(chain string, rule string) string {
+			return family.iptables + " -w -I " + chain + " " + rule + " -m comment --comment " + egressComment + EgressBridgePrefix(instance_id) + "\n"
+		}
+		//Rules are inserted at the top of the chain, so the ones inserted last match first
+		script += rule(family.forward, "-i "+bridges+" ! -o "+bridges+" -m conntrack ! --ctstate RELATED,ESTABLISHED -j DROP")
+		if policy.Egress == ds.EgressAllowlist {
+			for _, destination := range policy.Allowlist {
+				if strings.Contains(destination, ":") == family.ipv6 {
+					script += rule(family.forward, "-i "+bridges+" -d "+destination+" -j ACCEPT")
+				}
+			}
+			//Docker drops traffic between its networks before it accepts replies, so replies from allowlisted containers are accepted here
+			script += rule(family.forward, "-o "+bridges+" -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT")
+		}
+		script += rule("INPUT", "-i "+bridges+" -m conntrack ! --ctstate RELATED,ESTABLISHED -j DROP")
+	}
+	return script
+}
+
+// Returns the script that removes every egress rule of the instance, whatever the policy it was launched with
+func EgressCleanupScript(instance_id int) string {
+	comment := "--comment " + egressComment + EgressBridgePrefix(instance_id) + " "
+	return "for chain in DOCKER-USER INPUT; do\n" +
+		"\tiptables -w -S $chain | grep -F -- '" + comment + "' | sed 's/^-A/-D/' | while read -r rule; do iptables -w $rule; done\n" +
+		"done\n" +
+		"for chain in DOCKER-USER FORWARD INPUT; do\n" +
+		"\tip6tables -w -S $chain 2>/dev/null | grep -F -- '" + comment + "' | sed 's/^-A/-D/' | while read -r rule; do ip6tables -w $rule; done\n" +
+		"done\n"
+}
+
+// Installs the egress rules of the instance with run (which runs a script in the egress filter container), unless it has full egress
+func AddEgressRules(instance_id int, policy ds.EgressPolicy, run func(script string) error) error {
+	if policy.Egress == ds.EgressFull {
+		return nil
+	}
+	return run(EgressRulesScript(instance_id, policy))
+}
+
+// Removes the egress rules of the instance with run, unless it has full egress. Failures are only logged, leftover rules match
+// the bridges of this instance only, which are never created again
+func RemoveEgressRules(instance_id int, policy ds.EgressPolicy, run func(script string) error) {
+	if policy.Egress == ds.EgressFull {
+		return
+	}
+	if err := run(EgressCleanupScript(instance_id)); err != nil {
+		log.Warn("Unable to remove the egress rules of instance", instance_id, err)
+	}
+}
@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"runner/internal/ds"
+)
+
+func TestEgressRulesScript(t *testing.T) {
+	if bridge := EgressBridge(1234567, 999); len(bridge) > 15 {
+		t.Fatalf("Bridge names are at most 15 characters, got %s", bridge)
+	}
+	if EgressBridgePrefix(1) == EgressBridgePrefix(2) {
+		t.Fatal("Instances should have different bridges")
+	}
+
+	script := EgressRulesScript(1, ds.EgressPolicy{Egress: ds.EgressAllowlist, Allowlist: []string{"10.0.0.0/8"}})
+	drop := strings.Index(script, "-j DROP")
+	accept := strings.Index(script, "-d 10.0.0.0/8 -j ACCEPT")
+	if drop == -1 || accept < drop { //Rules are inserted at the top of the chain, so the allowlist is inserted after the drop to match before it
+		t.Fatalf("The allowlist should match before the drop, got\n%s", script)
+	}
+	if !strings.Contains(script, "-I INPUT -i "+EgressBridgePrefix(1)+"+ ") {
+		t.Fatalf("Connections to the host should be dropped, got\n%s", script)
+	}
+	if !strings.Contains(script, "ip6tables -w -I $forward6 -i "+EgressBridgePrefix(1)+"+ ! -o "+EgressBridgePrefix(1)+"+ ") || !strings.Contains(script, "ip6tables -w -I INPUT -i "+EgressBridgePrefix(1)+"+ ") {
+		t.Fatalf("IPv6 connections should be dropped as well, got\n%s", script)
+	}
+
+	script = EgressRulesScript(1, ds.EgressPolicy{Egress: ds.EgressAllowlist, Allowlist: []string{"192.0.2.1", "2001:db8::/32"}})
+	if !strings.Contains(script, "iptables -w -I DOCKER-USER -i "+EgressBridgePrefix(1)+"+ -d 192.0.2.1 -j ACCEPT") || !strings.Contains(script, "ip6tables -w -I $forward6 -i "+EgressBridgePrefix(1)+"+ -d 2001:db8::/32 -j ACCEPT") {
+		t.Fatalf("Allowlist entries should be accepted by the rules of their address family, got\n%s", script)
+	}
+	if strings.Contains(script, "ip6tables -w -I $forward6 -i "+EgressBridgePrefix(1)+"+ -d 192.0.2.1") || strings.Contains(script, "iptables -w -I DOCKER-USER -i "+EgressBridgePrefix(1)+"+ -d 2001:db8::/32") {
+		t.Fatalf("Allowlist entries should not be added to the rules of the other address family, got\n%s", script)
+	}
+	if cleanup := EgressCleanupScript(1); !strings.Contains(cleanup, "iptables -w $rule") || !strings.Contains(cleanup, "ip6tables -w $rule") {
+		t.Fatalf("Both the IPv4 and IPv6 rules should be removed, got\n%s", cleanup)
+	}
+	if strings.Contains(EgressRulesScript(1, ds.EgressPolicy{Egress: ds.EgressNone, Allowlist: []string{"10.0.0.0/8"}}), "ACCEPT") {
+		t.Fatal("The allowlist should only apply to the allowlist policy")
+	}
+}
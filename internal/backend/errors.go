@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+//Kinds of errors that backends may return, use errors.Is to check for them
+var (
+	ErrAuthExpired  = errors.New("authentication expired")
+	ErrImageMissing = errors.New("image missing")
+	ErrPortConflict = errors.New("port conflict")
+	ErrNameConflict = errors.New("name conflict")
+	ErrNotFound     = errors.New("not found")
+	ErrUnreachable  = errors.New("server unreachable")
+)
+
+//Error is an error response from a backend
+type Error struct {
+	Kind        error //One of the error kinds above, or nil if the error is not recognized
+	Status_Code int   //HTTP status code of the response, or 0 if there was no response
+	Message     string
+	Not_Sent    bool //True if the request never reached the server (E.g. the connection was refused), so it is safe to send it again
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	if e.Status_Code != 0 {
+		message = strconv.Itoa(e.Status_Code) + " " + message
+	}
+	if e.Kind != nil {
+		return e.Kind.Error() + ": " + message
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func Unreachable(err error) error {
+	var op_err *net.OpError
+	return &Error{Kind: ErrUnreachable, Message: err.Error(), Not_Sent: errors.As(err, &op_err) && op_err.Op == "dial"}
+}
+
+//Classifies an error response from the Docker Engine API (which Portainer proxies) or Portainer itself
+func DockerError(status_code int, body string) error {
+	message := strings.TrimSpace(body)
+	lower := strings.ToLower(message)
+
+	var kind error
+	switch {
+	case status_code == http.StatusUnauthorized:
+		kind = ErrAuthExpired
+	case strings.Contains(lower, "port is already allocated") || strings.Contains(lower, "address already in use"):
+		kind = ErrPortConflict
+	case strings.Contains(lower, "no such image") || strings.Contains(lower, "pull access denied") || strings.Contains(lower, "manifest unknown") || strings.Contains(lower, "repository does not exist"):
+		kind = ErrImageMissing
+	case status_code == http.StatusConflict || strings.Contains(lower, "already in use") || strings.Contains(lower, "already exists"):
+		kind = ErrNameConflict
+	case status_code == http.StatusNotFound:
+		kind = ErrNotFound
+	case status_code == http.StatusBadGateway || status_code == http.StatusServiceUnavailable || status_code == http.StatusGatewayTimeout:
+		kind = ErrUnreachable
+	}
+
+	return &Error{Kind: kind, Status_Code: status_code, Message: message}
+}
+
+//Transient errors are worth retrying
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrUnreachable)
+}
+
+//Calls f until it succeeds, it returns a non-transient error, or ds.BackendMaxRetryAttempts attempts have been made, with exponential backoff between attempts
+func Retry(description string, f func() error) error {
+	return retry(description, f, IsTransient)
+}
+
+//Methods that have the same effect when a request is sent more than once, see RetryRequest
+var idempotentMethods = map[string]bool{"GET": true, "HEAD": true, "PUT": true, "DELETE": true, "OPTIONS": true}
+
+//Like Retry, but for an HTTP request with method, which is only sent again if that is safe: either the method is idempotent or the request never reached the server
+//Otherwise, E.g. a timed out POST that creates a container may have created it, and sending it again would fail with a name conflict or create a duplicate
+func RetryRequest(method string, description string, f func() error) error {
+	return retry(description, f, func(err error) bool {
+		var backend_err *Error
+		return IsTransient(err) && (idempotentMethods[method] || errors.As(err, &backend_err) && backend_err.Not_Sent)
+	})
+}
+
+func retry(description string, f func() error, retryable func(error) bool) error {
+	wait := time.Duration(ds.BackendRetryWaitMilliseconds) * time.Millisecond
+	var err error
+	for i := 1; i <= ds.BackendMaxRetryAttempts; i++ {
+		err = f()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if i == ds.BackendMaxRetryAttempts { //No need to Sleep anymore since the last attempt was an error
+			break
+		}
+		log.Warn(description, "failed | Attempt No.", i, "| Retrying in", wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return err
+}
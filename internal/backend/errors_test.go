@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"runner/internal/ds"
+)
+
+func TestRetryRequest(t *testing.T) {
+	ds.BackendRetryWaitMilliseconds = 1
+	dial_err := Unreachable(&url.Error{Op: "Post", URL: "http://docker.local", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}})
+	timeout_err := Unreachable(&url.Error{Op: "Post", URL: "http://docker.local", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}})
+	gateway_err := DockerError(502, "Bad Gateway")
+
+	for _, test := range []struct {
+		method   string
+		err      error
+		attempts int
+	}{
+		{"GET", timeout_err, ds.BackendMaxRetryAttempts},
+		{"DELETE", gateway_err, ds.BackendMaxRetryAttempts},
+		{"POST", dial_err, ds.BackendMaxRetryAttempts},
+		{"POST", timeout_err, 1}, //The container may have been created
+		{"POST", gateway_err, 1},
+		{"POST", DockerError(404, "No such image"), 1},
+	} {
+		attempts := 0
+		err := RetryRequest(test.method, "test", func() error {
+			attempts++
+			return test.err
+		})
+		if err != test.err || attempts != test.attempts {
+			t.Errorf("%s failing with %v: expected %d attempts, got %d (%v)", test.method, test.err, test.attempts, attempts, err)
+		}
+	}
+}
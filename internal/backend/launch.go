@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"sort"
+	"strings"
+
+	"runner/internal/ds"
+)
+
+// Per-instance data that is passed into every container of an instance
+type LaunchOptions struct {
+	Instance_Id int
+	Env         map[string]string //Name -> Value, overrides the environment of the challenge
+	Files       map[string]string //Absolute path -> Content, written to every container before it starts
+	Limits      ds.ContainerLimits
+	Egress      ds.EgressPolicy
+	Labels      map[string]string //Added to every container (every service for docker compose challenges), see InstanceIdLabel
+	HostIps     []string          //The port at index i is published on HostIps[i], "" (or a missing entry) to publish it on every interface
+}
+
+// Returns the host IP that the port at index i is published on
+func (options LaunchOptions) HostIp(i int) string {
+	if i < len(options.HostIps) {
+		return options.HostIps[i]
+	}
+	return ""
+}
+
+// Returns Env as a sorted list of NAME=VALUE, as expected by Docker
+func (options LaunchOptions) EnvList() []string {
+	env := []string{}
+	for name, value := range options.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Returns the paths of Files in a stable order
+func (options LaunchOptions) FilePaths() []string {
+	paths := []string{}
+	for path := range options.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Returns Files as a tar archive that can be extracted at / in a container (E.g. via PUT /containers/{id}/archive?path=/)
+func (options LaunchOptions) FilesArchive() ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, path := range options.FilePaths() {
+		content := options.Files[path]
+		header := &tar.Header{Name: strings.TrimPrefix(path, "/"), Mode: 0444, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := writer.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Fields of a Docker HostConfig, shared by the backends that use the Docker Engine API
+type DockerHostLimits struct {
+	Memory         int64    `json:",omitempty"` //Bytes
+	CpuShares      int      `json:",omitempty"`
+	PidsLimit      int64    `json:",omitempty"`
+	CapDrop        []string `json:",omitempty"`
+	SecurityOpt    []string `json:",omitempty"`
+	ReadonlyRootfs bool     `json:",omitempty"`
+}
+
+// Returns Limits as the fields of a Docker HostConfig
+func (options LaunchOptions) DockerHostLimits() DockerHostLimits {
+	limits := DockerHostLimits{Memory: int64(options.Limits.Memory_Mb) * 1024 * 1024, CpuShares: options.Limits.Cpu_Shares, PidsLimit: int64(options.Limits.Pids_Limit), CapDrop: options.Limits.Cap_Drop, ReadonlyRootfs: options.Limits.Read_Only_Rootfs}
+	if options.Limits.No_New_Privileges {
+		limits.SecurityOpt = []string{"no-new-privileges:true"}
+	}
+	return limits
+}
+
+// Returns the driver options of the i-th Docker network of the instance. Unless it has full egress, the bridge of the network
+// is named so that the egress rules of the instance apply to it (see EgressRulesScript), and instances without egress do not
+// get IP masquerading either, so that they cannot reach anything outside of the host even if the rules are removed
+func (options LaunchOptions) DockerNetworkOptions(i int) map[string]string {
+	if options.Egress.Egress == ds.EgressFull {
+		return nil
+	}
+	network_options := map[string]string{"com.docker.network.bridge.name": EgressBridge(options.Instance_Id, i)}
+	if options.Egress.Egress == ds.EgressNone {
+		network_options["com.docker.network.bridge.enable_ip_masquerade"] = "false"
+	}
+	return network_options
+}
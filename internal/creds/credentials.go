@@ -14,17 +14,22 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"runner/internal/backend"
 	"runner/internal/ds"
 	"runner/internal/log"
 )
 
 var PostgreSQLCreds ds.ThirdPartyCredentialsJson
 
-var PortainerUrls []string
+var PortainerTargets []ds.Target //Docker hosts and Kubernetes clusters are also stored here when using the DOCKER and KUBERNETES backends
 var PortainerCreds map[string]ds.ThirdPartyCredentialsJson  = make(map[string]ds.ThirdPartyCredentialsJson) //PortainerUrl -> PortainerCredentials
-var PortainerJWT map[string]string = make(map[string]string)                                                //PortainerUrl -> PortainerJWT
+
+var DockerCreds map[string]ds.DockerCredentialsJson = make(map[string]ds.DockerCredentialsJson) //DockerUrl -> DockerCredentials
+var KubernetesCreds map[string]ds.KubernetesCredentialsJson = make(map[string]ds.KubernetesCredentialsJson) //KubernetesUrl -> KubernetesCredentials
 
 var APIAuthorization string
+var FlagSecret string //Key of the HMAC that per-user flags are derived from
+var EnvSecret string  //Key that secret environment variables of challenges are encrypted with, see EncryptSecret
 
 func LoadCredentials() {
 	log.Info("Loading Credentials...")
@@ -39,22 +44,97 @@ func LoadCredentials() {
 	PostgreSQLCreds = result.Postgresql_Credentials
 	testSqlConnection()
 
-	if len(result.Portainer_Credentials) == 0 {
+	switch ds.Backend {
+	case "DOCKER":
+		loadDockerCredentials(result.Docker_Credentials)
+	case "KUBERNETES":
+		loadKubernetesCredentials(result.Kubernetes_Credentials)
+	default:
+		loadPortainerCredentials(result.Portainer_Credentials)
+	}
+
+	APIAuthorization = result.Api_Authorization
+	FlagSecret = result.Flag_Secret
+	EnvSecret = result.Env_Secret
+
+	log.Info("Credentials Loaded!")
+}
+
+func loadPortainerCredentials(portainer_credentials []ds.ThirdPartyCredentialsJson) {
+	if len(portainer_credentials) == 0 {
 		panic("Please specify at least 1 set of Portainer credentials")
 	}
-	for _, credentials := range result.Portainer_Credentials {
-		PortainerUrls = append(PortainerUrls, credentials.Url)
+	for _, credentials := range portainer_credentials {
 		PortainerCreds[credentials.Url] = credentials
-		PortainerJWT[credentials.Url] = GetPortainerJWT(credentials)
-		AddPortainerQueue(0, credentials.Url)
+		if credentials.Api_Key == "" { //API access tokens are used as is, instead of logging in
+			jwt, err := GetPortainerJWT(credentials)
+			if err != nil {
+				panic("Unable to log in to Portainer " + credentials.Url + ": " + err.Error())
+			}
+			SetPortainerJWT(credentials.Url, jwt)
+		}
+		if len(credentials.Environment_Ids) == 0 { //No environments specified, ask Portainer instead
+			var err error
+			credentials.Environment_Ids, err = GetPortainerEnvironmentIds(credentials.Url)
+			if err != nil {
+				panic("Unable to discover Portainer " + credentials.Url + " environments: " + err.Error())
+			}
+			if len(credentials.Environment_Ids) == 0 {
+				panic("Portainer " + credentials.Url + " does not have any Docker environments")
+			}
+			log.Info("Discovered Portainer Environments", credentials.Url, credentials.Environment_Ids)
+		}
+		PortainerCreds[credentials.Url] = credentials
+
+		for _, environment_id := range credentials.Environment_Ids {
+			target := ds.Target{Url: credentials.Url, Environment_Id: environment_id}
+			PortainerTargets = append(PortainerTargets, target)
+			setPortRange(target, credentials.Port_Range_Start, credentials.Port_Range_End)
+		}
 	}
+}
 
-	APIAuthorization = result.Api_Authorization
+func loadDockerCredentials(docker_credentials []ds.DockerCredentialsJson) {
+	if len(docker_credentials) == 0 {
+		panic("Please specify at least 1 set of Docker credentials")
+	}
+	for _, credentials := range docker_credentials {
+		DockerCreds[credentials.Url] = credentials
 
-	log.Info("Credentials Loaded!")
+		target := ds.Target{Url: credentials.Url}
+		PortainerTargets = append(PortainerTargets, target)
+		setPortRange(target, credentials.Port_Range_Start, credentials.Port_Range_End)
+	}
+}
+
+func loadKubernetesCredentials(kubernetes_credentials []ds.KubernetesCredentialsJson) {
+	if len(kubernetes_credentials) == 0 {
+		panic("Please specify at least 1 set of Kubernetes credentials")
+	}
+	for _, credentials := range kubernetes_credentials {
+		KubernetesCreds[credentials.Url] = credentials
+
+		target := ds.Target{Url: credentials.Url}
+		PortainerTargets = append(PortainerTargets, target)
+		setPortRange(target, credentials.Port_Range_Start, credentials.Port_Range_End)
+	}
+}
+
+func setPortRange(target ds.Target, start int, end int) { //0 means the range from the config
+	effective_start, effective_end := start, end
+	if effective_start == 0 {
+		effective_start = ds.PortRangeStart
+	}
+	if effective_end == 0 {
+		effective_end = ds.PortRangeEnd
+	}
+	if !ds.ValidPortRange(effective_start, effective_end) {
+		panic("Please specify a valid Port_Range_Start and Port_Range_End for " + target.Url)
+	}
+	ds.State.Ports.SetRange(target, start, end)
 }
 
-func GetPortainerJWT(credentials ds.ThirdPartyCredentialsJson) string {
+func GetPortainerJWT(credentials ds.ThirdPartyCredentialsJson) (string, error) {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //TODO: Remove
 
 	requestBody, err := json.Marshal(map[string]string{
@@ -62,30 +142,87 @@ func GetPortainerJWT(credentials ds.ThirdPartyCredentialsJson) string {
 		"Password": credentials.Password,
 	})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	resp, err := http.Post(credentials.Url+"/api/auth", "application/json", bytes.NewBuffer(requestBody))
+	var body []byte
+	err = backend.Retry("Portainer authentication "+credentials.Url, func() error {
+		var err error
+		body, err = portainerResponse(http.Post(credentials.Url+"/api/auth", "application/json", bytes.NewBuffer(requestBody)))
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return "", &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+
+	jwt, ok := raw["jwt"].(string)
+	if !ok || jwt == "" {
+		return "", &backend.Error{Kind: backend.ErrAuthExpired, Message: "Invalid Portainer credentials"}
+	}
+
+	return jwt, nil
+}
+
+//Portainer environment types that are backed by a Docker daemon (1: Docker, 2: Agent on Docker, 4: Edge Agent on Docker)
+var dockerEnvironmentTypes map[int]bool = map[int]bool{1: true, 2: true, 4: true}
+
+func GetPortainerEnvironmentIds(portainer_url string) ([]int, error) {
+	var body []byte
+	err := backend.Retry("Portainer environment discovery "+portainer_url, func() error {
+		req, err := http.NewRequest("GET", portainer_url+"/api/endpoints", nil)
+		if err != nil {
+			return err
+		}
+
+		header, authorization := GetPortainerAuthorization(portainer_url)
+		req.Header.Set(header, authorization)
+
+		client := http.Client{}
+		body, err = portainerResponse(client.Do(req))
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	var raw map[string]string
+	var raw []struct {
+		Id   int
+		Type int
+	}
 	if err := json.Unmarshal(body, &raw); err != nil {
-		panic(err)
+		return nil, &backend.Error{Message: "Invalid response from Portainer: " + string(body)}
+	}
+
+	var environment_ids []int
+	for _, environment := range raw {
+		if dockerEnvironmentTypes[environment.Type] {
+			environment_ids = append(environment_ids, environment.Id)
+		}
+	}
+	return environment_ids, nil
+}
+
+//Reads the body of a response from Portainer, turning failed requests into backend errors
+func portainerResponse(resp *http.Response, err error) ([]byte, error) {
+	if err != nil {
+		return nil, backend.Unreachable(err)
 	}
 
-	if raw["jwt"] == "" {
-		panic("Invalid Portainer credentials")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, backend.Unreachable(err)
 	}
 
-	return raw["jwt"]
+	if resp.StatusCode >= 300 {
+		return nil, backend.DockerError(resp.StatusCode, string(body))
+	}
+	return body, nil
 }
 
 func testSqlConnection() {
@@ -111,6 +248,16 @@ func GetSqlDataSource() gorm.Dialector {
 	return postgres.Open("host="+PostgreSQLCreds.Url+" user="+PostgreSQLCreds.Username+" password="+PostgreSQLCreds.Password+" dbname=runner_db")
 }
 
+func GetPublicHost(url string) string { //Returns the host that users should connect to for instances launched on url
+	if credentials, ok := DockerCreds[url]; ok && credentials.Public_Host != "" {
+		return credentials.Public_Host
+	}
+	if credentials, ok := KubernetesCreds[url]; ok && credentials.Public_Host != "" {
+		return credentials.Public_Host
+	}
+	return ExtractHost(url)
+}
+
 func ExtractHost(s string) string {
 	u, err := url.Parse(s)
 	if err != nil {
@@ -0,0 +1,34 @@
+package creds
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"runner/internal/ds"
+)
+
+var ErrInvalidFlagTemplate = errors.New("flag_template must contain %s exactly once")
+
+//Flag templates without %s would give every user the same flag, and the HMAC would only replace the first of several
+func ValidFlagTemplate(template string) bool {
+	return strings.Count(template, "%s") == 1
+}
+
+//Returns the flag of userid for ch, which is ch.Flag_Template with %s replaced by the HMAC of the user and the challenge, so that flags never have to be stored
+func GenerateFlag(ch ds.RunnerChallenge, userid string) (string, error) {
+	if !ValidFlagTemplate(ch.Flag_Template) {
+		return "", ErrInvalidFlagTemplate
+	}
+	mac := hmac.New(sha256.New, []byte(FlagSecret))
+	mac.Write([]byte(ch.Challenge_Id + "\x00" + userid)) //Challenge ids are hex, so they never contain the separator
+	return strings.Replace(ch.Flag_Template, "%s", hex.EncodeToString(mac.Sum(nil))[:32], 1), nil
+}
+
+//Returns true if flag is the flag of userid for ch
+func VerifyFlag(ch ds.RunnerChallenge, userid string, flag string) bool {
+	expected, err := GenerateFlag(ch, userid)
+	return err == nil && hmac.Equal([]byte(flag), []byte(expected))
+}
@@ -0,0 +1,44 @@
+package creds
+
+import (
+	"runner/internal/backend"
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+//Returns the header name and value used to authenticate requests to portainer_url
+func GetPortainerAuthorization(portainer_url string) (string, string) {
+	if api_key := PortainerCreds[portainer_url].Api_Key; api_key != "" {
+		return "X-API-Key", api_key
+	}
+	return "Authorization", "Bearer " + ds.State.Logins.JWT(portainer_url)
+}
+
+func SetPortainerJWT(portainer_url string, jwt string) {
+	ds.State.Logins.SetJWT(portainer_url, jwt)
+}
+
+//Logs in to portainer_url again after a request authenticated with rejected_authorization was rejected
+//Concurrent callers wait for a single login, and callers whose authorization was already replaced do not log in again
+func ReauthenticatePortainer(portainer_url string, rejected_authorization string) error {
+	credentials := PortainerCreds[portainer_url]
+	if credentials.Api_Key != "" { //API access tokens do not expire, so logging in again would not help
+		return &backend.Error{Kind: backend.ErrAuthExpired, Message: "Portainer " + portainer_url + " rejected the API key"}
+	}
+
+	lock := ds.State.Logins.LoginLock(portainer_url)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, authorization := GetPortainerAuthorization(portainer_url); authorization != rejected_authorization { //Another request already logged in again
+		return nil
+	}
+
+	log.Info("Portainer", portainer_url, "rejected the JWT, logging in again")
+	jwt, err := GetPortainerJWT(credentials)
+	if err != nil {
+		return err
+	}
+	SetPortainerJWT(portainer_url, jwt)
+	return nil
+}
@@ -1,77 +1,146 @@
 package creds
 
 import (
+	"errors"
 	"math/rand"
 
-	"github.com/emirpasic/gods/maps/treemap"
-
 	"runner/internal/ds"
-	"runner/internal/log"
 )
 
-var PortainerInstanceCounts map[string]int = make(map[string]int) //PortainerUrl -> InstanceCount (No. of instances running on that Portainer)
-var PortainerQueue *treemap.Map = treemap.NewWithIntComparator() //InstanceCount -> {PortainerUrls}
+var ErrNoHealthyTargets = errors.New("every server is unhealthy")
+var ErrNoCapacity = errors.New("every server is at capacity")
 
-func getPortainerQueueSet(instanceCount int) map[string]bool {
-	val, ok := PortainerQueue.Get(instanceCount)
-	var set map[string]bool
-	if ok {
-		set = val.(map[string]bool)
-	} else {
-		set = make(map[string]bool)
+//Returns the Max_Instances and Weight of target from its credentials
+func getTargetLimits(target ds.Target) (int, int) {
+	max_instances, weight := 0, 0
+	if credentials, ok := PortainerCreds[target.Url]; ok {
+		max_instances, weight = credentials.Max_Instances, credentials.Weight
+	} else if credentials, ok := DockerCreds[target.Url]; ok {
+		max_instances, weight = credentials.Max_Instances, credentials.Weight
+	} else if credentials, ok := KubernetesCreds[target.Url]; ok {
+		max_instances, weight = credentials.Max_Instances, credentials.Weight
+	}
+	if weight <= 0 {
+		weight = 1
 	}
-	return set
+	return max_instances, weight
 }
 
-func AddPortainerQueue(instanceCount int, url string) {
-	set := getPortainerQueueSet(instanceCount)
-	set[url] = true
-	PortainerQueue.Put(instanceCount, set)
-	_debug("ADD")
+func hasCapacity(load ds.TargetLoad) bool {
+	max_instances, _ := getTargetLimits(load.Target)
+	return max_instances <= 0 || load.Instance_Count < max_instances
 }
 
-func RemovePortainerQueue(instanceCount int, url string) {
-	set := getPortainerQueueSet(instanceCount)
-	delete(set, url)
-	if len(set) == 0 {
-		PortainerQueue.Remove(instanceCount)
-	} else {
-		PortainerQueue.Put(instanceCount, set)
+//Fraction of the target's capacity in use, where targets without Max_Instances may hold up to Max_Instance_Count instances
+func getLoad(load ds.TargetLoad) float64 {
+	max_instances, _ := getTargetLimits(load.Target)
+	if max_instances <= 0 {
+		max_instances = int(ds.MaxInstanceCount)
 	}
-	_debug("REMOVE")
+	return float64(load.Instance_Count) / float64(max_instances)
 }
 
-func IncrementPortainerQueue(url string) {
-	if ds.PortainerBalanceStrategy == "DISTRIBUTE" {
-		RemovePortainerQueue(PortainerInstanceCounts[url], url)
-		PortainerInstanceCounts[url] += 1
-		AddPortainerQueue(PortainerInstanceCounts[url], url)
+//Returns the target with the fewest instances, the first target specified on ties
+func getFewestInstances(candidates []ds.TargetLoad) ds.TargetLoad {
+	best := candidates[0]
+	for _, load := range candidates[1:] {
+		if load.Instance_Count < best.Instance_Count {
+			best = load
+		}
 	}
+	return best
 }
 
-func DecrementPortainerQueue(url string) {
-	if ds.PortainerBalanceStrategy == "DISTRIBUTE" {
-		RemovePortainerQueue(PortainerInstanceCounts[url], url)
-		PortainerInstanceCounts[url] -= 1
-		AddPortainerQueue(PortainerInstanceCounts[url], url)
-	}
+//Returns whether the backend reported the total resources of the target, see CheckTargetHealth
+func resourcesKnown(load ds.TargetLoad) bool {
+	return load.Host_Resources.Cpu_Millicores > 0 && load.Host_Resources.Memory_Mb > 0
 }
 
-func _debug(mode string){
-	json, _ := PortainerQueue.ToJSON()
-	log.Debug(mode, "PortainerQueue", string(json))
+//Returns the smaller of the fractions of CPU and memory that would be left on the target after launching ch, or false if ch does not fit on the target
+//Only the footprints declared by the challenges of the instances on the target are counted, not their actual usage
+func getFreeFractionAfter(load ds.TargetLoad, ch ds.RunnerChallenge) (float64, bool) {
+	total, reserved, resources := load.Host_Resources, load.Reserved_Resources, ch.GetResources()
+	free_cpu := total.Cpu_Millicores - reserved.Cpu_Millicores - resources.Cpu_Millicores
+	free_memory := total.Memory_Mb - reserved.Memory_Mb - resources.Memory_Mb
+	if free_cpu < 0 || free_memory < 0 { //Launching ch would overcommit the target
+		return 0, false
+	}
+
+	free_cpu_fraction := float64(free_cpu) / float64(total.Cpu_Millicores)
+	free_memory_fraction := float64(free_memory) / float64(total.Memory_Mb)
+	if free_cpu_fraction < free_memory_fraction {
+		return free_cpu_fraction, true
+	}
+	return free_memory_fraction, true
 }
 
-func GetBestPortainer() string {
-	if ds.PortainerBalanceStrategy == "RANDOM" {
-		return PortainerUrls[rand.Intn(len(PortainerUrls))]
-	} else if ds.PortainerBalanceStrategy == "DISTRIBUTE" {
-		_, val := PortainerQueue.Min()
-		set := val.(map[string]bool)
+//Returns the target to launch an instance of ch on, from the state of every target in ds.State.Targets
+func GetBestPortainer(ch ds.RunnerChallenge) (ds.Target, error) {
+	var candidates []ds.TargetLoad //Healthy targets with capacity left, in the order that the targets were specified in
+	healthy := false
+	for _, load := range ds.State.Targets.Loads(PortainerTargets) {
+		if !load.Healthy {
+			continue
+		}
+		healthy = true
+		if hasCapacity(load) {
+			candidates = append(candidates, load)
+		}
+	}
+	if !healthy {
+		return ds.Target{}, ErrNoHealthyTargets
+	}
+	if len(candidates) == 0 {
+		return ds.Target{}, ErrNoCapacity
+	}
 
-		for url := range set { //Get arbitrary url from set
-			return url
+	switch ds.PortainerBalanceStrategy {
+	case "RANDOM":
+		return candidates[rand.Intn(len(candidates))].Target, nil
+	case "DISTRIBUTE":
+		return getFewestInstances(candidates).Target, nil
+	case "WEIGHTED":
+		total_weight := 0
+		for _, load := range candidates {
+			_, weight := getTargetLimits(load.Target)
+			total_weight += weight
+		}
+		r := rand.Intn(total_weight)
+		for _, load := range candidates {
+			_, weight := getTargetLimits(load.Target)
+			if r < weight {
+				return load.Target, nil
+			}
+			r -= weight
+		}
+	case "RESERVED_RESOURCES":
+		var best ds.Target
+		best_free_fraction, known := -1.0, false
+		for _, load := range candidates {
+			if !resourcesKnown(load) { //Its resources cannot be checked, so that it is never overcommitted
+				continue
+			}
+			known = true
+			free_fraction, ok := getFreeFractionAfter(load, ch)
+			if ok && free_fraction > best_free_fraction { //Spread instances out, keeping as much headroom as possible on every target
+				best, best_free_fraction = load.Target, free_fraction
+			}
 		}
+		if !known { //E.g. before the first health check, or if the backend does not report resources
+			return getFewestInstances(candidates).Target, nil
+		}
+		if best_free_fraction < 0 { //ch does not fit anywhere without overcommitting
+			return ds.Target{}, ErrNoCapacity
+		}
+		return best, nil
+	case "LEAST_LOADED":
+		best := candidates[0]
+		for _, load := range candidates[1:] {
+			if getLoad(load) < getLoad(best) {
+				best = load
+			}
+		}
+		return best.Target, nil
 	}
 	panic("Unknown Portainer Balance Strategy " + ds.PortainerBalanceStrategy)
-}
\ No newline at end of file
+}
@@ -0,0 +1,55 @@
+package creds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+func envCipher() (cipher.AEAD, error) {
+	if EnvSecret == "" {
+		return nil, errors.New("Env_Secret is not set in the credentials")
+	}
+	key := sha256.Sum256([]byte(EnvSecret)) //AES-256, so that Env_Secret may be any string
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Encrypts a secret environment variable of a challenge with EnvSecret, so that it is never stored in plaintext
+func EncryptSecret(plaintext string) (string, error) {
+	gcm, err := envCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil //The nonce is prepended to the ciphertext
+}
+
+//Decrypts a value returned by EncryptSecret. Fails if EnvSecret has changed since it was encrypted
+func DecryptSecret(ciphertext string) (string, error) {
+	gcm, err := envCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("secret is too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret, Env_Secret may have changed")
+	}
+	return string(plaintext), nil
+}
@@ -2,7 +2,9 @@ package ds
 
 import (
 	"encoding/json"
+	"net"
 	"os"
+	"regexp"
 
 	"runner/internal/log"
 )
@@ -16,6 +18,21 @@ func validatePortainerBalanceStrategy(strategy string) bool {
 	return false
 }
 
+func validateBackend(backend string) bool {
+	for _, validBackend := range Backends {
+		if backend == validBackend {
+			return true
+		}
+	}
+	return false
+}
+
+var validRunnerId *regexp.Regexp = regexp.MustCompile("^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$") //Valid Kubernetes label value
+
+func ValidPortRange(start int, end int) bool {
+	return start >= 1 && end <= 65535 && start <= end
+}
+
 func LoadConfig() {
 	log.Info("Loading Config...")
 	json_data, err := os.ReadFile(ConfigFolderPath+PS+ConfigFileName)
@@ -32,15 +49,110 @@ func LoadConfig() {
 	DefaultSecondsPerInstance = result.Default_Seconds_Per_Instance
 	DefaultNanosecondsPerInstance = DefaultSecondsPerInstance * 1e9
 	MaxSecondsLeftBeforeExtendAllowed = result.Max_Seconds_Left_Before_Extend_Allowed
-	UsedPorts[RunnerPort] = true //Runner
+	RunnerId = result.Runner_Id
+	if RunnerId == "" {
+		panic("Please specify a Runner_Id, which must be unique among the runners sharing a server or database, as the reconciler removes resources of its Runner_Id that it has no instance for")
+	}
+	if !validRunnerId.MatchString(RunnerId) {
+		panic("Please specify a valid Runner_Id")
+	}
+	if result.Max_Concurrent_Launches > 0 {
+		MaxConcurrentLaunches = result.Max_Concurrent_Launches
+	}
+	ReservedPorts[RunnerPort] = true //Runner
 	for _, port := range result.Reserved_Ports {
-		UsedPorts[port] = true
+		ReservedPorts[port] = true
+	}
+	if result.Port_Range_Start != 0 {
+		PortRangeStart = result.Port_Range_Start
+	}
+	if result.Port_Range_End != 0 {
+		PortRangeEnd = result.Port_Range_End
+	}
+	if !ValidPortRange(PortRangeStart, PortRangeEnd) {
+		panic("Please specify a valid Port_Range_Start and Port_Range_End")
 	}
 	Database_Max_Retry_Attempts = result.Database_Max_Retry_Attempts
 	Database_Error_Wait_Seconds = result.Database_Error_Wait_Seconds
+	if result.Backend_Max_Retry_Attempts > 0 {
+		BackendMaxRetryAttempts = result.Backend_Max_Retry_Attempts
+	}
+	if result.Backend_Retry_Wait_Milliseconds > 0 {
+		BackendRetryWaitMilliseconds = result.Backend_Retry_Wait_Milliseconds
+	}
+	if result.Health_Check_Seconds_Per_Check > 0 {
+		HealthCheckSecondsPerCheck = result.Health_Check_Seconds_Per_Check
+	}
+	if result.Health_Check_Max_Failures > 0 {
+		HealthCheckMaxFailures = result.Health_Check_Max_Failures
+	}
+	if result.Reconcile_Seconds_Per_Check > 0 {
+		ReconcileSecondsPerCheck = result.Reconcile_Seconds_Per_Check
+	}
+	if result.Orphan_Grace_Seconds > 0 {
+		OrphanGraceSeconds = result.Orphan_Grace_Seconds
+	}
+	if result.Stop_Timeout_Seconds > 0 {
+		StopTimeoutSeconds = result.Stop_Timeout_Seconds
+	}
+	if result.Port_Conflict_Max_Retries > 0 {
+		PortConflictMaxRetries = result.Port_Conflict_Max_Retries
+	}
+	HttpProxyPort = result.Http_Proxy_Port
+	HttpProxyDomain = result.Http_Proxy_Domain
+	if HttpProxyPort != 0 && HttpProxyDomain == "" {
+		panic("Please specify a Http_Proxy_Domain for the HTTP proxy")
+	}
+	if result.Http_Proxy_Scheme != "" {
+		HttpProxyScheme = result.Http_Proxy_Scheme
+	}
+	TcpProxyPort = result.Tcp_Proxy_Port
+	TcpProxyPublicPort = result.Tcp_Proxy_Public_Port
+	if TcpProxyPublicPort == 0 {
+		TcpProxyPublicPort = TcpProxyPort
+	}
+	TcpProxyDomain = result.Tcp_Proxy_Domain
+	TcpProxyCert = result.Tcp_Proxy_Cert
+	TcpProxyKey = result.Tcp_Proxy_Key
+	if TcpProxyPort != 0 && (TcpProxyDomain == "" || TcpProxyCert == "" || TcpProxyKey == "") {
+		panic("Please specify a Tcp_Proxy_Domain, Tcp_Proxy_Cert and Tcp_Proxy_Key for the TCP proxy")
+	}
+	PublishedHostIp = result.Published_Host_Ip
+	if ip := net.ParseIP(PublishedHostIp); PublishedHostIp != "" && (ip == nil || ip.IsUnspecified()) { //0.0.0.0 would publish them on every interface
+		panic("Please specify a valid Published_Host_Ip")
+	}
+	DefaultContainerLimits = ContainerLimits{Memory_Mb: result.Default_Memory_Limit_Mb, Cpu_Shares: result.Default_Cpu_Shares, Pids_Limit: result.Default_Pids_Limit, Cap_Drop: result.Default_Cap_Drop, No_New_Privileges: result.Default_No_New_Privileges, Read_Only_Rootfs: result.Default_Read_Only_Rootfs}
+	if result.Default_Egress != "" {
+		DefaultEgressPolicy.Egress = result.Default_Egress
+	}
+	if !ValidEgress(DefaultEgressPolicy.Egress) {
+		panic("Please specify a valid Default_Egress")
+	}
+	DefaultEgressPolicy.Allowlist = result.Default_Egress_Allowlist
 	if !validatePortainerBalanceStrategy(result.Portainer_Balance_Strategy){
 		panic("Please specify a valid Portainer Balance Strategy")
 	}
 	PortainerBalanceStrategy = result.Portainer_Balance_Strategy
+	if result.Backend == "" { //Portainer was the only backend before backends were configurable
+		result.Backend = "PORTAINER"
+	}
+	if !validateBackend(result.Backend) {
+		panic("Please specify a valid Backend")
+	}
+	Backend = result.Backend
+	if (HttpProxyPort != 0 || TcpProxyPort != 0) && Backend != "KUBERNETES" && PublishedHostIp == "" { //Ports behind the proxies could otherwise be reached directly, without the access token
+		panic("Please specify a Published_Host_Ip for the ports behind the HTTP or TCP proxy")
+	}
+	EgressFilterImage = result.Egress_Filter_Image
+	if Backend != "KUBERNETES" { //Kubernetes enforces egress with network policies between namespaces
+		if DefaultEgressPolicy.Egress != EgressFull && EgressFilterImage == "" {
+			panic("Please specify an Egress_Filter_Image to restrict the egress of instances")
+		}
+		for _, destination := range DefaultEgressPolicy.Allowlist {
+			if !ValidEgressDestination(destination) {
+				panic("Please specify IP addresses or CIDRs in Default_Egress_Allowlist")
+			}
+		}
+	}
 	log.Info("Config Loaded!")
 }
\ No newline at end of file
@@ -0,0 +1,96 @@
+package ds
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+)
+
+// Loads config/config.json with a Runner_Id and the changes made by modify, returning the panic of LoadConfig if the config was rejected
+func loadConfig(t *testing.T, modify func(config map[string]interface{})) (rejected interface{}) {
+	t.Helper()
+	json_data, err := os.ReadFile("../../config/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(json_data, &config); err != nil {
+		t.Fatal(err)
+	}
+	config["Runner_Id"] = "test"
+	modify(config)
+	json_data, err = json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ConfigFolderPath = t.TempDir()
+	if err := os.WriteFile(ConfigFolderPath+PS+ConfigFileName, json_data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		rejected = recover()
+	}()
+	LoadConfig()
+	return nil
+}
+
+func TestDefaultConfigPublishesProxiedPortsPrivately(t *testing.T) {
+	for _, proxy := range []string{"Http_Proxy_Port", "Tcp_Proxy_Port"} {
+		if rejected := loadConfig(t, func(config map[string]interface{}) { config[proxy] = 8443 }); rejected != nil {
+			t.Fatalf("The default config with %s set should be valid, got %v", proxy, rejected)
+		}
+		ip := net.ParseIP(PublishedHostIp)
+		if ip == nil || ip.IsUnspecified() || !(ip.IsLoopback() || ip.IsPrivate()) {
+			t.Fatalf("Proxied ports should be published on a private IP by default, got %q", PublishedHostIp)
+		}
+	}
+}
+
+func TestDefaultConfigHardensContainers(t *testing.T) {
+	if rejected := loadConfig(t, func(config map[string]interface{}) {}); rejected != nil {
+		t.Fatalf("The default config should be valid, got %v", rejected)
+	}
+	if limits := DefaultContainerLimits; limits.Memory_Mb <= 0 || limits.Pids_Limit <= 0 || !limits.No_New_Privileges {
+		t.Fatalf("Containers should have memory and PID limits and no-new-privileges by default, got %+v", limits)
+	}
+}
+
+func TestProxyRequiresPublishedHostIp(t *testing.T) {
+	for _, published_host_ip := range []string{"", "0.0.0.0", "::"} {
+		rejected := loadConfig(t, func(config map[string]interface{}) {
+			config["Http_Proxy_Port"] = 8080
+			config["Published_Host_Ip"] = published_host_ip
+		})
+		if rejected == nil {
+			t.Errorf("Published_Host_Ip %q should be rejected while the HTTP proxy is enabled", published_host_ip)
+		}
+	}
+
+	rejected := loadConfig(t, func(config map[string]interface{}) {
+		config["Published_Host_Ip"] = ""
+	})
+	if rejected != nil {
+		t.Fatalf("Published_Host_Ip may be empty while both proxies are disabled, got %v", rejected)
+	}
+
+	rejected = loadConfig(t, func(config map[string]interface{}) {
+		config["Backend"] = "KUBERNETES"
+		config["Tcp_Proxy_Port"] = 8443
+		config["Published_Host_Ip"] = ""
+	})
+	if rejected != nil {
+		t.Fatalf("Kubernetes publishes ports as node ports, so Published_Host_Ip is not needed, got %v", rejected)
+	}
+}
+
+func TestRunnerIdRequired(t *testing.T) {
+	rejected := loadConfig(t, func(config map[string]interface{}) { delete(config, "Runner_Id") })
+	if rejected == nil {
+		t.Fatal("A config without a Runner_Id should be rejected, as runners with the same Runner_Id remove each other's resources")
+	}
+	if rejected := loadConfig(t, func(config map[string]interface{}) { config["Runner_Id"] = "runner-1" }); rejected != nil || RunnerId != "runner-1" {
+		t.Fatalf("Runner_Id should be used, got %q and %v", RunnerId, rejected)
+	}
+}
@@ -0,0 +1,41 @@
+package ds
+
+import "sync"
+
+// Logins keeps the JWT of every Portainer server that is logged in to with a username and password
+type Logins struct {
+	lock       sync.RWMutex
+	jwts       map[string]string      //PortainerUrl -> PortainerJWT
+	loginLocks map[string]*sync.Mutex //PortainerUrl -> Lock held while logging in to that Portainer, see LoginLock
+}
+
+func NewLogins() *Logins {
+	return &Logins{jwts: make(map[string]string), loginLocks: make(map[string]*sync.Mutex)}
+}
+
+func (l *Logins) JWT(portainer_url string) string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.jwts[portainer_url]
+}
+
+func (l *Logins) SetJWT(portainer_url string, jwt string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.jwts[portainer_url] = jwt
+}
+
+//Returns the lock that is held while logging in to portainer_url, so that concurrent requests wait for a single login
+func (l *Logins) LoginLock(portainer_url string) *sync.Mutex {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lock, ok := l.loginLocks[portainer_url]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.loginLocks[portainer_url] = lock
+	}
+	return lock
+}
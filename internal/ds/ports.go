@@ -0,0 +1,139 @@
+package ds
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+var ErrPortsExhausted = errors.New("no ports left")
+
+var ReservedPorts map[int]bool = make(map[int]bool) //From Config, never allocated on any host
+var PortRangeStart int = 1024 //From Config
+var PortRangeEnd int = 65535 //From Config, inclusive
+
+// PortAllocator hands out host ports to instances, separately for every target
+type PortAllocator struct {
+	lock      sync.Mutex
+	used      map[Target]map[int]bool //Target -> Ports used by instances on that target
+	published map[Target]map[int]bool //Target -> Ports published on that target, as last reported by the backend (including containers not launched by the runner)
+	ranges    map[Target][2]int       //Target -> [Start, End] of the ports that may be allocated on that target, if it differs from [PortRangeStart, PortRangeEnd]
+}
+
+func NewPortAllocator() *PortAllocator {
+	return &PortAllocator{used: make(map[Target]map[int]bool), published: make(map[Target]map[int]bool), ranges: make(map[Target][2]int)}
+}
+
+//Sets the range of ports that may be allocated on target, where 0 means PortRangeStart (for start) or PortRangeEnd (for end)
+func (a *PortAllocator) SetRange(target Target, start int, end int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.ranges[target] = [2]int{start, end}
+}
+
+func (a *PortAllocator) getRange(target Target) (int, int) {
+	start, end := PortRangeStart, PortRangeEnd
+	if r, ok := a.ranges[target]; ok {
+		if r[0] != 0 {
+			start = r[0]
+		}
+		if r[1] != 0 {
+			end = r[1]
+		}
+	}
+	return start, end
+}
+
+func (a *PortAllocator) isFree(target Target, port int) bool {
+	return !ReservedPorts[port] && !a.used[target][port] && !a.published[target][port]
+}
+
+//Replaces the ports published on target, so that ports taken by anything else on the host are not allocated
+func (a *PortAllocator) SetPublished(target Target, ports []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	published := make(map[int]bool)
+	for _, port := range ports {
+		published[port] = true
+	}
+	a.published[target] = published
+}
+
+func (a *PortAllocator) use(target Target, port int) {
+	if a.used[target] == nil {
+		a.used[target] = make(map[int]bool)
+	}
+	a.used[target][port] = true
+}
+
+//Allocates count random unused ports on target, or none at all if there are not enough ports left
+func (a *PortAllocator) Allocate(target Target, count int) ([]int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	start, end := a.getRange(target)
+	size := end - start + 1
+
+	ports := []int{}
+	for len(ports) < count {
+		port, ok := a.findFreePort(target, start, size)
+		if !ok {
+			for _, port := range ports { //Do not hold on to the ports of an instance that cannot be launched
+				delete(a.used[target], port)
+			}
+			return nil, ErrPortsExhausted
+		}
+		a.use(target, port)
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func (a *PortAllocator) findFreePort(target Target, start int, size int) (int, bool) {
+	if size <= 0 {
+		return 0, false
+	}
+	for i := 0; i < 32; i++ { //Random ports are almost always free, unless the range is nearly exhausted
+		port := start + rand.Intn(size)
+		if a.isFree(target, port) {
+			return port, true
+		}
+	}
+	offset := rand.Intn(size)
+	for i := 0; i < size; i++ { //Scan the whole range, starting from a random port
+		port := start + (offset+i)%size
+		if a.isFree(target, port) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+//Marks ports as used on target, e.g. for instances that were launched before the runner restarted
+func (a *PortAllocator) Reserve(target Target, ports []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, port := range ports {
+		a.use(target, port)
+	}
+}
+
+func (a *PortAllocator) Release(target Target, ports []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, port := range ports {
+		delete(a.used[target], port)
+	}
+}
+
+//Returns the number of ports in use on target
+func (a *PortAllocator) Count(target Target) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return len(a.used[target])
+}
@@ -0,0 +1,127 @@
+package ds
+
+import (
+	"sync"
+
+	"github.com/emirpasic/gods/maps/treebidimap"
+	"github.com/emirpasic/gods/utils"
+)
+
+// Runner owns the state shared by the API handlers and the workers, every method may be called concurrently.
+// Ports, Targets and Logins guard themselves, as none of them changes together with the expiry queue (and they are never locked while
+// another is, so they cannot deadlock). Invariants that span them, E.g. one instance per user, are kept by LockAdmission and the
+// instance states in the database instead, see TestConcurrentInstances in internal/harness
+type Runner struct {
+	lock             sync.Mutex
+	instanceQueue    *treebidimap.Map //Unix (Nano) Timestamp of Instance Timeout -> InstanceId
+	unsafeChallenges map[string]bool  //Challenges may become unsafe to launch when they are marked for removal via /removeChallenge
+	admissionLock    sync.Mutex       //Held while deciding whether an instance may be added, see LockAdmission
+
+	Ports   *PortAllocator //Host ports of the instances on every target
+	Targets *TargetState   //Instance counts, health and resources of every target
+	Logins  *Logins        //JWTs of the Portainer servers
+}
+
+var State *Runner = NewRunner()
+
+func NewRunner() *Runner {
+	return &Runner{instanceQueue: treebidimap.NewWith(utils.Int64Comparator, utils.IntComparator), unsafeChallenges: make(map[string]bool), Ports: NewPortAllocator(), Targets: NewTargetState(), Logins: NewLogins()}
+}
+
+//Queues the instance to be killed at timestamp, replacing its previous timestamp. Returns the timestamp actually used, which is later than timestamp if another instance already expires at timestamp
+func (r *Runner) QueueInstance(timestamp int64, instance_id int) int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.queueInstance(timestamp, instance_id)
+}
+
+//Like QueueInstance, but only if the instance is still queued. Returns false if it is not, E.g. because it is being killed
+func (r *Runner) RequeueInstance(timestamp int64, instance_id int) (int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.instanceQueue.GetKey(instance_id); !ok {
+		return 0, false
+	}
+	return r.queueInstance(timestamp, instance_id), true
+}
+
+func (r *Runner) queueInstance(timestamp int64, instance_id int) int64 {
+	if previous, ok := r.instanceQueue.GetKey(instance_id); ok {
+		r.instanceQueue.Remove(previous)
+	}
+	for { //Timestamps are keys, so another instance at timestamp would be replaced
+		if _, ok := r.instanceQueue.Get(timestamp); !ok {
+			break
+		}
+		timestamp++
+	}
+	r.instanceQueue.Put(timestamp, instance_id)
+	return timestamp
+}
+
+func (r *Runner) DequeueInstance(instance_id int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if timestamp, ok := r.instanceQueue.GetKey(instance_id); ok {
+		r.instanceQueue.Remove(timestamp)
+	}
+}
+
+//Removes and returns the instance that expires first, if it expires at or before timestamp
+func (r *Runner) PopExpiredInstance(timestamp int64) (int, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.instanceQueue.Empty() {
+		return 0, false
+	}
+	it := r.instanceQueue.Iterator()
+	it.Next()
+	if it.Key().(int64) > timestamp {
+		return 0, false
+	}
+	r.instanceQueue.Remove(it.Key())
+	return it.Value().(int), true
+}
+
+//Returns the timestamp that the instance is queued to be killed at
+func (r *Runner) InstanceTimeout(instance_id int) (int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	timestamp, ok := r.instanceQueue.GetKey(instance_id)
+	if !ok {
+		return 0, false
+	}
+	return timestamp.(int64), true
+}
+
+func (r *Runner) SetChallengeUnsafe(challid string, unsafe bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if unsafe {
+		r.unsafeChallenges[challid] = true
+	} else {
+		delete(r.unsafeChallenges, challid)
+	}
+}
+
+func (r *Runner) IsChallengeUnsafe(challid string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.unsafeChallenges[challid]
+}
+
+//Serializes /addInstance requests from checking whether the user may add an instance until the instance is written, so that concurrent requests cannot exceed the limits
+func (r *Runner) LockAdmission() {
+	r.admissionLock.Lock()
+}
+
+func (r *Runner) UnlockAdmission() {
+	r.admissionLock.Unlock()
+}
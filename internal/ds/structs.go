@@ -1,7 +1,11 @@
 package ds
 
 import (
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 )
 
 type ConfigJson struct {
@@ -11,36 +15,110 @@ type ConfigJson struct {
 	Default_Seconds_Per_Instance           int64
 	Max_Seconds_Left_Before_Extend_Allowed int64
 	Reserved_Ports                         []int
+	Port_Range_Start                       int
+	Port_Range_End                         int
 	Database_Max_Retry_Attempts            int
 	Database_Error_Wait_Seconds            int
 	Portainer_Balance_Strategy             string
+	Backend                                string
+	Max_Concurrent_Launches                int
+	Backend_Max_Retry_Attempts             int
+	Backend_Retry_Wait_Milliseconds        int
+	Health_Check_Seconds_Per_Check         int
+	Health_Check_Max_Failures              int
+	Port_Conflict_Max_Retries              int
+	Http_Proxy_Port                        int
+	Http_Proxy_Domain                      string
+	Http_Proxy_Scheme                      string
+	Tcp_Proxy_Port                         int
+	Tcp_Proxy_Public_Port                  int
+	Tcp_Proxy_Domain                       string
+	Tcp_Proxy_Cert                         string
+	Tcp_Proxy_Key                          string
+	Published_Host_Ip                      string
+	Default_Memory_Limit_Mb                int
+	Default_Cpu_Shares                     int
+	Default_Pids_Limit                     int
+	Default_Cap_Drop                       []string
+	Default_No_New_Privileges              bool
+	Default_Read_Only_Rootfs               bool
+	Default_Egress                         string
+	Default_Egress_Allowlist               []string
+	Egress_Filter_Image                    string
+	Reconcile_Seconds_Per_Check            int
+	Orphan_Grace_Seconds                   int
+	Stop_Timeout_Seconds                   int
+	Runner_Id                              string
 }
 
 type ThirdPartyCredentialsJson struct {
-	Url      string
-	Username string
-	Password string
+	Url              string
+	Username         string
+	Password         string
+	Api_Key          string //Portainer only, used instead of Username and Password if set
+	Environment_Ids  []int  //Portainer only, auto-discovered if empty
+	Max_Instances    int    //Portainer only, max no. of instances on each environment, 0 for no limit
+	Weight           int    //Portainer only, relative share of instances for the WEIGHTED strategy, defaults to 1
+	Port_Range_Start int    //Portainer only, range of ports allocated on each environment, defaults to Port_Range_Start/End in config
+	Port_Range_End   int
+}
+
+type DockerCredentialsJson struct {
+	Url              string //E.g. unix:///var/run/docker.sock or tcp://100.100.100.100:2376
+	Public_Host      string //Host given to users to connect to their instances, defaults to the host in Url
+	Ca_Cert          string //For tcp:// only, TLS is used if specified. Paths are relative to the config folder
+	Cert             string
+	Key              string
+	Max_Instances    int //Max no. of instances on this host, 0 for no limit
+	Weight           int //Relative share of instances for the WEIGHTED strategy, defaults to 1
+	Port_Range_Start int //Range of ports allocated on this host, defaults to Port_Range_Start/End in config
+	Port_Range_End   int
+}
+
+type KubernetesCredentialsJson struct {
+	Url              string //Kubernetes API server, E.g. https://100.100.100.100:6443 (or https://kubernetes.default.svc to use the runner's service account)
+	Token            string //Bearer token of a service account that can manage namespaces, deployments and services
+	Ca_Cert          string //Path is relative to the config folder
+	Public_Host      string //Host given to users to connect to their instances, defaults to the host in Url
+	Service_Type     string //NodePort (default) or LoadBalancer
+	Max_Instances    int    //Max no. of instances on this cluster, 0 for no limit
+	Weight           int    //Relative share of instances for the WEIGHTED strategy, defaults to 1
+	Port_Range_Start int    //Range of ports allocated on this cluster (E.g. the NodePort range), defaults to Port_Range_Start/End in config
+	Port_Range_End   int
 }
 
 type CredentialsJson struct {
 	Postgresql_Credentials ThirdPartyCredentialsJson
 	Portainer_Credentials  []ThirdPartyCredentialsJson
+	Docker_Credentials     []DockerCredentialsJson
+	Kubernetes_Credentials []KubernetesCredentialsJson
 	Api_Authorization      string
+	Flag_Secret            string
+	Env_Secret             string
 }
 
 type PortsInfo struct {
-	Host       string
-	Ports_Used []int
-	Port_Types []string
+	Instance_Id  int
+	State        string
+	Host         string
+	Ports_Used   []int
+	Port_Types   []string
+	Connections  []string //How to connect to each port in Ports_Used, E.g. a URL for http ports behind the HTTP proxy
+	Access_Token string   //Required by the proxies, already included in Connections
 }
 
 type UserStatus struct {
 	Running_Instance bool
+	Instance_Id      int
+	State            string
+	Failure_Reason   string
 	Challenge_Id     string
 	Time_Left        int
 	Host             string
 	Ports_Used       []int
 	Port_Types       []string
+	Connections      []string
+	Access_Token     string
 }
 
 type RunnerStatus struct {
@@ -48,16 +126,57 @@ type RunnerStatus struct {
 	Max_Instance_Count     int64
 	Instances              []Instance
 	Challenges             []RunnerChallenge
+	Targets                []TargetHealth
+	Reconcile_Actions      []ReconcileAction //Most recent last
+}
+
+//Something that the reconciler did to bring a target in line with the database
+type ReconcileAction struct {
+	Timestamp   int64  //Unix timestamp in seconds
+	Target      string
+	Action      string //removed_orphan or relaunched_instance
+	Resource_Id string
+	Instance_Id int
+	Error       string //Set if the action failed
+}
+
+type TargetHealth struct {
+	Url                  string
+	Environment_Id       int
+	Healthy              bool
+	Consecutive_Failures int
+	Last_Error           string
+	Last_Checked         int64         //Unix timestamp in seconds, 0 if never checked
+	Host_Resources       HostResources //Total resources of the host, as last reported by the backend
+	Reserved_Resources   HostResources //Sum of the resources of the challenges of instances on the host
+}
+
+type HostResources struct {
+	Cpu_Millicores int
+	Memory_Mb      int
 }
 
 type Instance struct {
-	Instance_Id      int    `gorm:"primarykey"`
-	Usr_Id           string
-	Challenge_Id     string
-	Portainer_Url    string
-	Portainer_Id     string
-	Instance_Timeout int64  `gorm:"index"` //Unix (Nano) Timestamp of Instance Timeout
-	Ports_Used       string
+	Instance_Id              int    `gorm:"primarykey;autoIncrement"` //Generated by the database
+	Usr_Id                   string
+	Challenge_Id             string
+	Portainer_Url            string
+	Portainer_Environment_Id int
+	Portainer_Id             string
+	Instance_Timeout         int64  `gorm:"index"` //Unix (Nano) Timestamp of Instance Timeout
+	Ports_Used               string
+	State                    string `gorm:"index"` //See InstanceStateTransitions
+	Failure_Reason           string //Set when State is failed
+	Proxy_Token              string //Random subdomain of the instance's ports behind the proxy
+	Access_Token             string //Secret that the proxies require before forwarding traffic to the instance
+	Runner_Id                string `gorm:"index"` //RunnerId of the runner that added the instance, which is the only runner that takes it over when it restarts
+}
+
+//A (Portainer server, Portainer environment) pair that instances can be scheduled on
+//For the DOCKER and KUBERNETES backends, Url is the Docker host or Kubernetes cluster and Environment_Id is always 0
+type Target struct {
+	Url            string
+	Environment_Id int
 }
 
 type RunnerChallenge struct {
@@ -74,6 +193,106 @@ type RunnerChallenge struct {
 
 	//For DockerCompose = true:
 	Docker_Compose_File string
+
+	//Expected footprint of an instance (of all services for DockerCompose = true), used by the RESERVED_RESOURCES strategy. 0 if unknown
+	Cpu_Millicores int
+	Memory_Mb      int
+
+	//Per-user flags, see creds.GenerateFlag. Disabled if Flag_Template is ""
+	Flag_Template string //E.g. CTF{%s}, where %s is replaced by the HMAC of the user and challenge
+	Flag_Env      string //Environment variable that the flag is passed in
+	Flag_File     string //Absolute path of a file that the flag is written to
+
+	Env ChallengeEnv //Environment variables passed into every container (every service for DockerCompose = true)
+
+	//Overrides of DefaultContainerLimits for every container of an instance, see GetContainerLimits
+	Memory_Limit_Mb   int    //0 for the default, -1 for no limit
+	Cpu_Shares        int    //0 for the default, -1 for no limit
+	Pids_Limit        int    //0 for the default, -1 for no limit
+	Cap_Drop          string //Comma-separated, "" for the default, NONE to not drop any capabilities
+	No_New_Privileges *bool  //nil for the default
+	Read_Only_Rootfs  *bool  //nil for the default
+
+	Egress           string //none, allowlist or full, "" for DefaultEgressPolicy
+	Egress_Allowlist string //Comma-separated, "" for the allowlist of DefaultEgressPolicy
+}
+
+//Limits and hardening applied to every container of an instance
+type ContainerLimits struct {
+	Memory_Mb         int //0 for no limit
+	Cpu_Shares        int //Relative CPU weight, 0 for the Docker default (1024)
+	Pids_Limit        int //0 for no limit
+	Cap_Drop          []string
+	No_New_Privileges bool
+	Read_Only_Rootfs  bool
+}
+
+//Secret values are encrypted with creds.EncryptSecret before they are stored, and are never returned by the API
+type EnvVar struct {
+	Value  string
+	Secret bool
+}
+
+type ChallengeEnv map[string]EnvVar //Name -> EnvVar, stored as JSON
+
+//What every instance may connect to, besides the containers of the instance
+type EgressPolicy struct {
+	Egress    string   //See Egress*
+	Allowlist []string //IP addresses and CIDRs (namespaces for the KUBERNETES backend) that instances may reach if Egress is allowlist
+}
+
+//Returns DefaultEgressPolicy with the overrides of ch applied
+func (ch RunnerChallenge) GetEgressPolicy() EgressPolicy {
+	policy := DefaultEgressPolicy
+	if ch.Egress != "" {
+		policy.Egress = ch.Egress
+	}
+	if ch.Egress_Allowlist != "" {
+		policy.Allowlist = strings.Split(ch.Egress_Allowlist, ",")
+	}
+	return policy
+}
+
+//Returns the resources that every instance of ch reserves on its target
+func (ch RunnerChallenge) GetResources() HostResources {
+	return HostResources{Cpu_Millicores: ch.Cpu_Millicores, Memory_Mb: ch.Memory_Mb}
+}
+
+//Returns DefaultContainerLimits with the overrides of ch applied
+func (ch RunnerChallenge) GetContainerLimits() ContainerLimits {
+	limits := DefaultContainerLimits
+	limits.Memory_Mb = overrideLimit(limits.Memory_Mb, ch.Memory_Limit_Mb)
+	limits.Cpu_Shares = overrideLimit(limits.Cpu_Shares, ch.Cpu_Shares)
+	limits.Pids_Limit = overrideLimit(limits.Pids_Limit, ch.Pids_Limit)
+	if ch.Cap_Drop == "NONE" {
+		limits.Cap_Drop = nil
+	} else if ch.Cap_Drop != "" {
+		limits.Cap_Drop = strings.Split(ch.Cap_Drop, ",")
+	}
+	if ch.No_New_Privileges != nil {
+		limits.No_New_Privileges = *ch.No_New_Privileges
+	}
+	if ch.Read_Only_Rootfs != nil {
+		limits.Read_Only_Rootfs = *ch.Read_Only_Rootfs
+	}
+	return limits
+}
+
+func overrideLimit(limit int, override int) int {
+	if override < 0 {
+		return 0
+	} else if override > 0 {
+		return override
+	}
+	return limit
+}
+
+func (instance Instance) GetTarget() Target {
+	return Target{Url: instance.Portainer_Url, Environment_Id: instance.Portainer_Environment_Id}
+}
+
+func (target Target) ToString() string {
+	return target.Url + " (Environment " + strconv.Itoa(target.Environment_Id) + ")"
 }
 
 func (instance Instance) ToString() string {
@@ -82,4 +301,59 @@ func (instance Instance) ToString() string {
         panic(err)
     }
 	return string(instanceJson)
-}
\ No newline at end of file
+}
+
+//Accepts both {"NAME": "value"} and {"NAME": {"value": "value", "secret": true}}
+func (env *ChallengeEnv) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*env = make(ChallengeEnv)
+	for name, raw_value := range raw {
+		var value EnvVar
+		if err := json.Unmarshal(raw_value, &value.Value); err != nil {
+			if err := json.Unmarshal(raw_value, &value); err != nil {
+				return err
+			}
+		}
+		(*env)[name] = value
+	}
+	return nil
+}
+
+func (env ChallengeEnv) MarshalJSON() ([]byte, error) { //Redacts secret values
+	redacted := make(map[string]EnvVar)
+	for name, value := range env {
+		if value.Secret {
+			value.Value = "<redacted>"
+		}
+		redacted[name] = value
+	}
+	return json.Marshal(redacted)
+}
+
+func (env ChallengeEnv) Value() (driver.Value, error) {
+	if env == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(map[string]EnvVar(env)) //Without redacting secret values
+	return string(data), err
+}
+
+func (env *ChallengeEnv) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*env = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), (*map[string]EnvVar)(env))
+	case []byte:
+		return json.Unmarshal(data, (*map[string]EnvVar)(env))
+	}
+	return errors.New("unsupported type for ChallengeEnv")
+}
+
+func (ChallengeEnv) GormDataType() string {
+	return "text"
+}
@@ -0,0 +1,168 @@
+package ds
+
+import (
+	"sync"
+	"time"
+
+	"runner/internal/log"
+)
+
+type reservation struct {
+	target    Target
+	resources HostResources
+}
+
+// TargetState keeps the instance counts, health and resources of every target, which creds.GetBestPortainer schedules instances by
+type TargetState struct {
+	lock              sync.Mutex
+	instanceCounts    map[Target]int           //Target -> No. of instances on that target, also used to enforce Max_Instances
+	health            map[Target]*TargetHealth //Target -> Health, targets that were never checked are healthy
+	hostResources     map[Target]HostResources //Target -> Total resources, as last reported by the backend
+	reservedResources map[Target]HostResources //Target -> Resources reserved by instances on the target
+	reservations      map[int]reservation      //InstanceId -> Reservation, so that the reservation can be released even if the challenge was removed
+}
+
+// The state of a target at the time TargetState.Loads was called
+type TargetLoad struct {
+	Target             Target
+	Instance_Count     int
+	Healthy            bool
+	Host_Resources     HostResources
+	Reserved_Resources HostResources
+}
+
+func NewTargetState() *TargetState {
+	return &TargetState{instanceCounts: make(map[Target]int), health: make(map[Target]*TargetHealth), hostResources: make(map[Target]HostResources), reservedResources: make(map[Target]HostResources), reservations: make(map[int]reservation)}
+}
+
+func (s *TargetState) IncrementInstanceCount(target Target) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.instanceCounts[target] += 1
+}
+
+func (s *TargetState) DecrementInstanceCount(target Target) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.instanceCounts[target] -= 1
+}
+
+func (s *TargetState) InstanceCount(target Target) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.instanceCounts[target]
+}
+
+func (s *TargetState) IsHealthy(target Target) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.isHealthy(target)
+}
+
+func (s *TargetState) isHealthy(target Target) bool {
+	health, ok := s.health[target]
+	return !ok || health.Healthy
+}
+
+//Records the result of a health check, marking target unhealthy after HealthCheckMaxFailures consecutive failures and healthy again after a success
+func (s *TargetState) RecordHealthCheck(target Target, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	health, ok := s.health[target]
+	if !ok {
+		health = &TargetHealth{Url: target.Url, Environment_Id: target.Environment_Id, Healthy: true}
+		s.health[target] = health
+	}
+	health.Last_Checked = time.Now().Unix()
+
+	if err == nil {
+		if !health.Healthy {
+			log.Info("Target", target.ToString(), "is healthy again")
+		}
+		health.Healthy = true
+		health.Consecutive_Failures = 0
+		health.Last_Error = ""
+		return
+	}
+
+	health.Consecutive_Failures++
+	health.Last_Error = err.Error()
+	log.Warn("Health check of target", target.ToString(), "failed | Consecutive failures:", health.Consecutive_Failures, err)
+	if health.Healthy && health.Consecutive_Failures >= HealthCheckMaxFailures {
+		log.Warn("Target", target.ToString(), "is unhealthy, no longer launching instances on it")
+		health.Healthy = false
+	}
+}
+
+//Returns the health of targets, in the same order
+func (s *TargetState) Health(targets []Target) []TargetHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healths := []TargetHealth{}
+	for _, target := range targets {
+		health := TargetHealth{Url: target.Url, Environment_Id: target.Environment_Id, Healthy: true}
+		if h, ok := s.health[target]; ok {
+			health = *h
+		}
+		health.Host_Resources, health.Reserved_Resources = s.hostResources[target], s.reservedResources[target]
+		healths = append(healths, health)
+	}
+	return healths
+}
+
+func (s *TargetState) SetHostResources(target Target, resources HostResources) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hostResources[target] = resources
+}
+
+//Reserves resources on target for the instance, until ReleaseResources is called
+func (s *TargetState) ReserveResources(instance_id int, target Target, resources HostResources) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.releaseResources(instance_id) //In case the instance was already reserved for
+	s.reservations[instance_id] = reservation{target: target, resources: resources}
+	reserved := s.reservedResources[target]
+	reserved.Cpu_Millicores += resources.Cpu_Millicores
+	reserved.Memory_Mb += resources.Memory_Mb
+	s.reservedResources[target] = reserved
+}
+
+func (s *TargetState) ReleaseResources(instance_id int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.releaseResources(instance_id)
+}
+
+func (s *TargetState) releaseResources(instance_id int) {
+	r, ok := s.reservations[instance_id]
+	if !ok {
+		return
+	}
+	delete(s.reservations, instance_id)
+	reserved := s.reservedResources[r.target]
+	reserved.Cpu_Millicores -= r.resources.Cpu_Millicores
+	reserved.Memory_Mb -= r.resources.Memory_Mb
+	s.reservedResources[r.target] = reserved
+}
+
+//Returns the state of targets (in the same order) at a single point in time, so that they can be compared with each other
+func (s *TargetState) Loads(targets []Target) []TargetLoad {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	loads := []TargetLoad{}
+	for _, target := range targets {
+		loads = append(loads, TargetLoad{Target: target, Instance_Count: s.instanceCounts[target], Healthy: s.isHealthy(target), Host_Resources: s.hostResources[target], Reserved_Resources: s.reservedResources[target]})
+	}
+	return loads
+}
@@ -3,31 +3,101 @@ package ds
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"math/rand"
-
-	"github.com/emirpasic/gods/maps/treebidimap"
-	"github.com/emirpasic/gods/utils"
+	"net"
 )
 
 var RunnerPort int //From Config
 
-var InstanceQueue *treebidimap.Map = treebidimap.NewWith(utils.Int64Comparator, utils.IntComparator) //Unix (Nano) Timestamp of Instance Timeout -> InstanceId
-var UsedPorts map[int]bool = make(map[int]bool)
-
 var MaxInstanceCount int64 //From Config
 var PortainerJWTSecondsPerRefresh int //From Config
-var NextInstanceId int = 0
 var DefaultSecondsPerInstance int64 //From Config
 var DefaultNanosecondsPerInstance int64 //Indirectly From Config
 var MaxSecondsLeftBeforeExtendAllowed int64 //From Config
+var MaxConcurrentLaunches int = 4 //From Config
+var RunnerId string //From Config (required), resources are labelled with it so that runners sharing a server only manage their own resources
+
+const (
+	InstanceStatePending  = "pending"  //Row is written, but the instance has not been sent to the backend yet
+	InstanceStateStarting = "starting" //Instance is being launched by the backend
+	InstanceStateRunning  = "running"
+	InstanceStateStopping = "stopping" //Instance is being deleted, the row is deleted once the backend is done
+	InstanceStateFailed   = "failed"   //Launch failed, see Failure_Reason. The row is kept until the instance expires or the user launches another instance
+)
+
+var InstanceStateTransitions map[string][]string = map[string][]string{ //State -> {States that it may transition to}
+	InstanceStatePending:  {InstanceStateStarting, InstanceStateStopping, InstanceStateFailed},
+	InstanceStateStarting: {InstanceStateRunning, InstanceStateStopping, InstanceStateFailed},
+	InstanceStateRunning:  {InstanceStateStopping, InstanceStatePending}, //Instances whose resources vanished from the backend are relaunched by the reconciler
+	InstanceStateStopping: {},
+	InstanceStateFailed:   {InstanceStateStopping},
+}
+
+func ValidInstanceStateTransition(from string, to string) bool {
+	for _, state := range InstanceStateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
 
-var ChallengeUnsafeToLaunch map[string]bool = make(map[string]bool) //Challenges may become unsafe to launch when they are marked for removal via /removeChallenge
 
 var Database_Max_Retry_Attempts int //From Config
 var Database_Error_Wait_Seconds int //From Config
 
+var BackendMaxRetryAttempts int = 3 //From Config
+var BackendRetryWaitMilliseconds int = 500 //From Config, doubled after every attempt
+
+var PortConflictMaxRetries int = 3 //From Config, no. of times a launch is retried on new ports if its ports are already taken on the host
+
+var HttpProxyPort int //From Config, 0 if the HTTP proxy is disabled
+var HttpProxyDomain string //From Config, instances are reachable at <token>.<HttpProxyDomain>
+var HttpProxyScheme string = "http" //From Config, scheme of the URLs given to users, E.g. https if the proxy is behind a TLS terminator
+
+var TcpProxyPort int //From Config, 0 if the TCP proxy is disabled
+var TcpProxyPublicPort int //From Config, port given to users, defaults to TcpProxyPort
+var TcpProxyDomain string //From Config, instances are reachable with an SNI hostname of <token>.<TcpProxyDomain>
+var TcpProxyCert string //From Config, paths are relative to the config folder
+var TcpProxyKey string //From Config
+
+var PublishedHostIp string //From Config, host IP that ports behind the HTTP or TCP proxy are published on (and that the proxy connects to), "" to publish them on every interface (only allowed while both proxies are disabled)
+
+var DefaultContainerLimits ContainerLimits //From Config, may be overridden by every challenge
+
+const (
+	EgressNone      = "none"      //Instances cannot reach anything outside of the instance
+	EgressAllowlist = "allowlist" //Instances can only reach the destinations in the allowlist
+	EgressFull      = "full"      //Instances can reach the internet
+)
+
+var DefaultEgressPolicy EgressPolicy = EgressPolicy{Egress: EgressFull} //From Config, may be overridden by every challenge
+
+func ValidEgress(egress string) bool {
+	return egress == EgressNone || egress == EgressAllowlist || egress == EgressFull
+}
+
+//Returns whether destination may be in an egress allowlist of the DOCKER and PORTAINER backends, which filter by IP address or CIDR
+func ValidEgressDestination(destination string) bool {
+	if _, _, err := net.ParseCIDR(destination); err == nil {
+		return true
+	}
+	return net.ParseIP(destination) != nil
+}
+
+var EgressFilterImage string //From Config, image with sh and iptables that installs the egress rules of instances on Docker hosts, see backend.EgressRulesScript
+
+var ReconcileSecondsPerCheck int = 60 //From Config
+var StopTimeoutSeconds int = 10 //From Config, time that containers get to exit when an instance is stopped gracefully, before they are killed
+var OrphanGraceSeconds int = 300 //From Config, resources without an instance are only removed once they have been seen for this long, so that launches in progress are left alone
+
+var HealthCheckSecondsPerCheck int = 30 //From Config
+var HealthCheckMaxFailures int = 3 //From Config, consecutive failed checks before a target is excluded from scheduling
+
 var PortainerBalanceStrategy string //From Config
-var PortainerBalanceStrategies []string = []string{"RANDOM", "DISTRIBUTE"}
+var PortainerBalanceStrategies []string = []string{"RANDOM", "DISTRIBUTE", "WEIGHTED", "LEAST_LOADED", "RESERVED_RESOURCES"}
+
+var Backend string //From Config
+var Backends []string = []string{"PORTAINER", "DOCKER", "KUBERNETES"}
 
 func GenerateChallengeId(challenge_name string) string {
 	h := sha256.New()
@@ -40,13 +110,3 @@ var CredentialsFileName string = "credentials.json"
 var ConfigFileName string = "config.json"
 
 var ConfigFolderPath string //From args
-
-func GetRandomPort() int { //Returns an (unused) random port from [1024, 65536)
-	for {
-		port := rand.Intn(65536-1024) + 1024
-		if !UsedPorts[port] {
-			UsedPorts[port] = true
-			return port
-		}
-	}
-}
\ No newline at end of file
@@ -0,0 +1,180 @@
+package harness
+
+import (
+	"strconv"
+	"sync"
+
+	"runner/internal/backend"
+	"runner/internal/ds"
+)
+
+// FakeBackend is an in-memory Backend, where every launched instance is running immediately
+type FakeBackend struct {
+	lock        sync.Mutex
+	next_id     int
+	Resources   map[ds.Target]map[string]backend.Resource //Target -> Portainer_Id -> Resource
+	Launches    int                                       //No. of successful calls to Launch
+	Stops       int                                       //No. of successful calls to Stop
+	Graceful    int                                       //No. of successful calls to Stop that stopped gracefully
+	StopBlock   map[string]chan struct{}                  //Portainer_Id -> Channel that Stop waits on (before locking) if set
+	LaunchErr   error                                     //If set, Launch fails with this error
+	LaunchPanic interface{}                               //If set, Launch panics with this value
+	StopErr     error                                     //If set, Stop fails with this error
+	PingErr     map[ds.Target]error                       //If set for a target, Ping fails with this error
+	Hosts       map[ds.Target]ds.HostResources            //Resources reported by Info, defaults to DefaultHostResources
+	Foreign     map[ds.Target][]int                       //Ports published on a target by something other than the runner, Launch fails with a port conflict if it uses any of them
+	Options     map[string]backend.LaunchOptions          //Portainer_Id -> Options that the instance was launched with
+	ports       map[ds.Target]map[string][]int            //Target -> Portainer_Id -> Ports published by the instance
+}
+
+var DefaultHostResources = ds.HostResources{Cpu_Millicores: 4000, Memory_Mb: 8192}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{Resources: make(map[ds.Target]map[string]backend.Resource), PingErr: make(map[ds.Target]error), Hosts: make(map[ds.Target]ds.HostResources), Foreign: make(map[ds.Target][]int), Options: make(map[string]backend.LaunchOptions), StopBlock: make(map[string]chan struct{}), ports: make(map[ds.Target]map[string][]int)}
+}
+
+func (f *FakeBackend) Launch(target ds.Target, ch ds.RunnerChallenge, ports []int, discriminant string, options backend.LaunchOptions) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.LaunchPanic != nil {
+		panic(f.LaunchPanic)
+	}
+	if f.LaunchErr != nil {
+		return "", f.LaunchErr
+	}
+	for _, port := range ports {
+		for _, foreign_port := range f.Foreign[target] {
+			if port == foreign_port {
+				return "", &backend.Error{Kind: backend.ErrPortConflict, Message: "Bind for 0.0.0.0:" + strconv.Itoa(port) + " failed: port is already allocated"}
+			}
+		}
+	}
+
+	f.next_id++
+	id := "fake-" + strconv.Itoa(f.next_id)
+	if f.Resources[target] == nil {
+		f.Resources[target] = make(map[string]backend.Resource)
+	}
+	f.Resources[target][id] = backend.Resource{Id: id, Name: ch.Challenge_Name + "_" + discriminant, Stack: ch.Docker_Compose, Instance_Id: options.Instance_Id}
+	if f.ports[target] == nil {
+		f.ports[target] = make(map[string][]int)
+	}
+	f.ports[target][id] = ports
+	f.Options[id] = options
+	f.Launches++
+	return id, nil
+}
+
+func (f *FakeBackend) Stop(instance ds.Instance, ch ds.RunnerChallenge, graceful bool) error {
+	f.lock.Lock()
+	block := f.StopBlock[instance.Portainer_Id]
+	f.lock.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.StopErr != nil {
+		return f.StopErr
+	}
+
+	resources := f.Resources[instance.GetTarget()]
+	if _, ok := resources[instance.Portainer_Id]; !ok {
+		return &backend.Error{Kind: backend.ErrNotFound, Message: "no such instance " + instance.Portainer_Id}
+	}
+	delete(resources, instance.Portainer_Id)
+	delete(f.ports[instance.GetTarget()], instance.Portainer_Id)
+	f.Stops++
+	if graceful {
+		f.Graceful++
+	}
+	return nil
+}
+
+func (f *FakeBackend) Inspect(instance ds.Instance, ch ds.RunnerChallenge) (backend.Status, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Resources[instance.GetTarget()][instance.Portainer_Id]; !ok {
+		return backend.Status{}, &backend.Error{Kind: backend.ErrNotFound, Message: "no such instance " + instance.Portainer_Id}
+	}
+	return backend.Status{State: "running"}, nil
+}
+
+func (f *FakeBackend) List(target ds.Target) ([]backend.Resource, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var resources []backend.Resource
+	for _, resource := range f.Resources[target] {
+		if f.Options[resource.Id].Labels[backend.RunnerIdLabel] == ds.RunnerId { //Like the real backends, only lists resources labelled with this runner. Resources added directly to Resources are not labelled, like containers the runner did not launch
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// Adds a resource labelled as if runner_id launched it, e.g. a runner that stopped in the middle of a launch or another runner sharing the target
+func (f *FakeBackend) AddResource(target ds.Target, resource backend.Resource, runner_id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.Resources[target] == nil {
+		f.Resources[target] = make(map[string]backend.Resource)
+	}
+	f.Resources[target][resource.Id] = resource
+	f.Options[resource.Id] = backend.LaunchOptions{Labels: map[string]string{backend.RunnerIdLabel: runner_id, backend.InstanceIdLabel: strconv.Itoa(resource.Instance_Id)}}
+}
+
+func (f *FakeBackend) Logs(instance ds.Instance, ch ds.RunnerChallenge) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Resources[instance.GetTarget()][instance.Portainer_Id]; !ok {
+		return "", &backend.Error{Kind: backend.ErrNotFound, Message: "no such instance " + instance.Portainer_Id}
+	}
+	return "", nil
+}
+
+func (f *FakeBackend) Ping(target ds.Target) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.PingErr[target]
+}
+
+func (f *FakeBackend) Info(target ds.Target) (ds.HostResources, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if resources, ok := f.Hosts[target]; ok {
+		return resources, nil
+	}
+	return DefaultHostResources, nil
+}
+
+func (f *FakeBackend) PublishedPorts(target ds.Target) ([]int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ports := append([]int{}, f.Foreign[target]...)
+	for _, instance_ports := range f.ports[target] {
+		ports = append(ports, instance_ports...)
+	}
+	return ports, nil
+}
+
+// Returns the total number of instances currently running across all targets
+func (f *FakeBackend) Count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	count := 0
+	for _, resources := range f.Resources {
+		count += len(resources)
+	}
+	return count
+}
@@ -0,0 +1,442 @@
+package harness
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"runner/internal/ds"
+)
+
+// FakePortainer mimics the subset of the Portainer API used by api_portainer
+type FakePortainer struct {
+	Server          *httptest.Server
+	Credentials     ds.ThirdPartyCredentialsJson
+	JWT             string
+	Api_Key         string //If set, requests may authenticate with this X-API-Key instead of the JWT
+	Logins          int    //Number of successful /api/auth requests
+	lock            sync.Mutex
+	next_stack_id   int
+	next_container  int
+	Containers      map[string]FakeContainer //ContainerId -> Container
+	Stacks          map[int]FakeStack        //StackId -> Stack
+	Networks        map[string]FakeNetwork   //Name -> Network
+	Environment_Ids []int
+	Egress_Scripts  []string //Scripts run by containers on the network of the host, see backend.EgressRulesScript
+	Egress_Status   int      //Exit code of the containers on the network of the host
+	Stopped         []string //Ids of the containers stopped via POST /containers/{id}/stop, including those of stacks
+}
+
+type FakeContainer struct {
+	Id             string
+	Name           string
+	Environment_Id int
+	Body           map[string]interface{} //Request body of the container create call
+	Running        bool
+	Files          map[string]string //Absolute path -> Content, of files written via PUT /containers/{id}/archive
+}
+
+type FakeNetwork struct {
+	Name           string
+	Environment_Id int
+	Options        map[string]string
+	Containers     []string //Ids of the containers connected via POST /networks/{name}/connect
+}
+
+type FakeStack struct {
+	Id                 int
+	Name               string
+	EndpointId         int
+	Status             int
+	Stack_File_Content string
+}
+
+func NewFakePortainer() *FakePortainer {
+	f := &FakePortainer{
+		Credentials:     ds.ThirdPartyCredentialsJson{Username: "admin", Password: "password"},
+		JWT:             "fake-jwt",
+		Containers:      make(map[string]FakeContainer),
+		Stacks:          make(map[int]FakeStack),
+		Networks:        make(map[string]FakeNetwork),
+		Environment_Ids: []int{2},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	f.Credentials.Url = f.Server.URL
+	return f
+}
+
+// Invalidates every JWT issued so far, as if Portainer restarted
+func (f *FakePortainer) RevokeJWT() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.JWT += "-renewed"
+}
+
+func (f *FakePortainer) Close() {
+	f.Server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *FakePortainer) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if r.Method == "POST" && r.URL.Path == "/api/auth" {
+		var raw map[string]string
+		if err := json.Unmarshal(body, &raw); err != nil || raw["Username"] != f.Credentials.Username || raw["Password"] != f.Credentials.Password {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Invalid credentials"})
+			return
+		}
+		f.Logins++
+		writeJSON(w, http.StatusOK, map[string]string{"jwt": f.JWT})
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/api/status" {
+		writeJSON(w, http.StatusOK, map[string]string{"Version": "2.0.0"})
+		return
+	}
+
+	api_key_valid := f.Api_Key != "" && r.Header.Get("X-API-Key") == f.Api_Key
+	if !api_key_valid && r.Header.Get("Authorization") != "Bearer "+f.JWT {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Unauthorized"})
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/endpoints":
+		var environments []map[string]int
+		for _, environment_id := range f.Environment_Ids {
+			environments = append(environments, map[string]int{"Id": environment_id, "Type": 1})
+		}
+		writeJSON(w, http.StatusOK, environments)
+	case r.Method == "GET" && len(path) == 5 && path[1] == "endpoints" && path[3] == "docker" && path[4] == "_ping":
+		w.Write([]byte("OK"))
+	case r.Method == "GET" && len(path) == 5 && path[1] == "endpoints" && path[3] == "docker" && path[4] == "info":
+		writeJSON(w, http.StatusOK, map[string]int64{"NCPU": 4, "MemTotal": 8 << 30})
+	case len(path) >= 5 && path[1] == "endpoints" && path[3] == "docker" && path[4] == "containers":
+		environment_id, _ := strconv.Atoi(path[2])
+		f.handleContainers(w, r, environment_id, path[5:], body)
+	case len(path) >= 5 && path[1] == "endpoints" && path[3] == "docker" && path[4] == "networks":
+		environment_id, _ := strconv.Atoi(path[2])
+		f.handleNetworks(w, r, environment_id, path[5:], body)
+	case r.Method == "POST" && r.URL.Path == "/api/stacks/create/standalone/string":
+		var raw struct {
+			Name             string
+			StackFileContent string
+		}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request payload"})
+			return
+		}
+		environment_id, _ := strconv.Atoi(r.URL.Query().Get("endpointId"))
+		f.next_stack_id++
+		stack := FakeStack{Id: f.next_stack_id, Name: raw.Name, EndpointId: environment_id, Status: 1, Stack_File_Content: raw.StackFileContent}
+		f.Stacks[stack.Id] = stack
+		writeJSON(w, http.StatusOK, stack)
+	case r.Method == "GET" && r.URL.Path == "/api/stacks":
+		stacks := []FakeStack{}
+		for _, stack := range f.Stacks {
+			stacks = append(stacks, stack)
+		}
+		writeJSON(w, http.StatusOK, stacks)
+	case len(path) == 3 && path[1] == "stacks":
+		id, _ := strconv.Atoi(path[2])
+		stack, ok := f.Stacks[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Unable to find a stack with the specified identifier inside the database"})
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.Stacks, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, stack)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+	}
+}
+
+func (f *FakePortainer) handleContainers(w http.ResponseWriter, r *http.Request, environment_id int, path []string, body []byte) {
+	switch {
+	case r.Method == "POST" && len(path) == 1 && path[0] == "create":
+		var raw map[string]interface{}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		host_config, _ := raw["HostConfig"].(map[string]interface{})
+		if network_mode, _ := host_config["NetworkMode"].(string); network_mode != "" && network_mode != "default" && network_mode != "bridge" && network_mode != "host" {
+			if _, ok := f.Networks[network_mode]; !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"message": "network " + network_mode + " not found"})
+				return
+			}
+		}
+		name := r.URL.Query().Get("name")
+		for _, container := range f.Containers {
+			if name != "" && container.Name == name {
+				writeJSON(w, http.StatusConflict, map[string]string{"message": "Conflict. The container name \"/" + name + "\" is already in use"})
+				return
+			}
+		}
+		f.next_container++
+		container := FakeContainer{Id: "container" + strconv.Itoa(f.next_container), Name: name, Environment_Id: environment_id, Body: raw}
+		f.Containers[container.Id] = container
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"Id": container.Id, "Warnings": []string{}})
+	case r.Method == "GET" && len(path) == 1 && path[0] == "json":
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		containers := []map[string]interface{}{}
+		for _, container := range f.Containers {
+			if container.Environment_Id == environment_id && hasLabels(container, filters["label"]) {
+				ports := []map[string]interface{}{}
+				if container.Running {
+					for _, port := range containerPorts(container) {
+						ports = append(ports, map[string]interface{}{"PublicPort": port, "Type": "tcp"})
+					}
+				}
+				containers = append(containers, map[string]interface{}{"Id": container.Id, "Names": []string{"/" + container.Name}, "State": containerState(container), "Ports": ports, "Labels": container.Body["Labels"]})
+			}
+		}
+		for _, container := range f.stackContainers(environment_id) {
+			if hasLabels(container, filters["label"]) {
+				containers = append(containers, map[string]interface{}{"Id": container.Id, "Names": []string{"/" + container.Name}, "State": containerState(container), "Ports": []map[string]interface{}{}, "Labels": container.Body["Labels"]})
+			}
+		}
+		writeJSON(w, http.StatusOK, containers)
+	case r.Method == "POST" && len(path) == 2 && path[1] == "stop" && strings.HasPrefix(path[0], "stack"): //Containers of stacks only exist while listing them
+		for _, container := range f.stackContainers(environment_id) {
+			if container.Id == path[0] {
+				f.Stopped = append(f.Stopped, container.Id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + path[0]})
+	case len(path) >= 1:
+		container, ok := f.Containers[path[0]]
+		if !ok || container.Environment_Id != environment_id {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + path[0]})
+			return
+		}
+		switch {
+		case r.Method == "POST" && len(path) == 2 && path[1] == "start":
+			for _, port := range containerPorts(container) {
+				for _, other := range f.Containers {
+					if other.Running && other.Environment_Id == environment_id && containsPort(containerPorts(other), port) {
+						writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "driver failed programming external connectivity on endpoint " + container.Name + ": Bind for 0.0.0.0:" + strconv.Itoa(port) + " failed: port is already allocated"})
+						return
+					}
+				}
+			}
+			container.Running = true
+			f.Containers[container.Id] = container
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && len(path) == 2 && path[1] == "wait":
+			host_config, _ := container.Body["HostConfig"].(map[string]interface{})
+			cmd, _ := container.Body["Cmd"].([]interface{})
+			if host_config["NetworkMode"] == "host" && len(cmd) == 3 {
+				f.Egress_Scripts = append(f.Egress_Scripts, cmd[2].(string))
+			}
+			container.Running = false
+			f.Containers[container.Id] = container
+			writeJSON(w, http.StatusOK, map[string]int{"StatusCode": f.Egress_Status})
+		case r.Method == "POST" && len(path) == 2 && path[1] == "stop":
+			if !container.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			container.Running = false
+			f.Containers[container.Id] = container
+			f.Stopped = append(f.Stopped, container.Id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT" && len(path) == 2 && path[1] == "archive":
+			reader := tar.NewReader(bytes.NewReader(body))
+			if container.Files == nil {
+				container.Files = make(map[string]string)
+			}
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+					return
+				}
+				content, _ := ioutil.ReadAll(reader)
+				container.Files[strings.TrimSuffix(r.URL.Query().Get("path"), "/")+"/"+header.Name] = string(content)
+			}
+			f.Containers[container.Id] = container
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "DELETE" && len(path) == 1:
+			delete(f.Containers, container.Id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "GET" && len(path) == 2 && path[1] == "json":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Id": container.Id, "State": map[string]string{"Status": containerState(container)}, "HostConfig": container.Body["HostConfig"]})
+		case r.Method == "GET" && len(path) == 2 && path[1] == "logs":
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+	}
+}
+
+func (f *FakePortainer) handleNetworks(w http.ResponseWriter, r *http.Request, environment_id int, path []string, body []byte) {
+	switch {
+	case r.Method == "POST" && len(path) == 1 && path[0] == "create":
+		var raw struct {
+			Name    string
+			Options map[string]string
+		}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if _, ok := f.Networks[raw.Name]; ok {
+			writeJSON(w, http.StatusConflict, map[string]string{"message": "network with name " + raw.Name + " already exists"})
+			return
+		}
+		f.Networks[raw.Name] = FakeNetwork{Name: raw.Name, Environment_Id: environment_id, Options: raw.Options}
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": raw.Name})
+	case len(path) >= 1:
+		network, ok := f.Networks[path[0]]
+		if !ok || network.Environment_Id != environment_id {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "network " + path[0] + " not found"})
+			return
+		}
+		switch {
+		case r.Method == "POST" && len(path) == 2 && path[1] == "connect":
+			var raw struct {
+				Container string
+			}
+			json.Unmarshal(body, &raw)
+			if _, ok := f.Containers[raw.Container]; !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + raw.Container})
+				return
+			}
+			network.Containers = append(network.Containers, raw.Container)
+			f.Networks[network.Name] = network
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "DELETE" && len(path) == 1:
+			for _, container := range f.Containers {
+				host_config, _ := container.Body["HostConfig"].(map[string]interface{})
+				if host_config["NetworkMode"] == network.Name {
+					writeJSON(w, http.StatusForbidden, map[string]string{"message": "error while removing network: network " + network.Name + " has active endpoints"})
+					return
+				}
+			}
+			delete(f.Networks, network.Name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+	}
+}
+
+// Returns a container for every service of every stack in the environment, labelled like the containers that docker compose creates
+func (f *FakePortainer) stackContainers(environment_id int) []FakeContainer {
+	containers := []FakeContainer{}
+	for _, stack := range f.Stacks {
+		if stack.EndpointId != environment_id {
+			continue
+		}
+		var compose struct {
+			Services map[string]struct {
+				Labels []string `yaml:"labels"`
+			} `yaml:"services"`
+		}
+		if err := yaml.Unmarshal([]byte(stack.Stack_File_Content), &compose); err != nil {
+			continue
+		}
+		for name, service := range compose.Services {
+			labels := map[string]interface{}{"com.docker.compose.project": stack.Name, "com.docker.compose.service": name}
+			for _, label := range service.Labels {
+				pair := strings.SplitN(label, "=", 2)
+				if len(pair) == 2 {
+					labels[pair[0]] = pair[1]
+				}
+			}
+			containers = append(containers, FakeContainer{Id: "stack" + strconv.Itoa(stack.Id) + "_" + name, Name: stack.Name + "-" + name + "-1", Environment_Id: environment_id, Body: map[string]interface{}{"Labels": labels}, Running: true})
+		}
+	}
+	return containers
+}
+
+// Returns true if the container has every label in filters, each either "key" or "key=value"
+func hasLabels(container FakeContainer, filters []string) bool {
+	labels, _ := container.Body["Labels"].(map[string]interface{})
+	for _, filter := range filters {
+		pair := strings.SplitN(filter, "=", 2)
+		value, ok := labels[pair[0]]
+		if !ok || (len(pair) == 2 && value != pair[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containerState(container FakeContainer) string {
+	if container.Running {
+		return "running"
+	}
+	return "created"
+}
+
+// Returns the number of containers and stacks currently on the fake Portainer
+func (f *FakePortainer) Count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.Containers) + len(f.Stacks)
+}
+
+// Returns the host ports in the PortBindings of the container create body
+func containerPorts(container FakeContainer) []int {
+	ports := []int{}
+	host_config, _ := container.Body["HostConfig"].(map[string]interface{})
+	port_bindings, _ := host_config["PortBindings"].(map[string]interface{})
+	for _, bindings := range port_bindings {
+		list, _ := bindings.([]interface{})
+		for _, binding := range list {
+			binding, _ := binding.(map[string]interface{})
+			host_port, _ := binding["HostPort"].(string)
+			if port, err := strconv.Atoi(host_port); err == nil {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
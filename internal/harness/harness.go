@@ -0,0 +1,279 @@
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"runner/internal/api_portainer"
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/proxy"
+	"runner/internal/workers"
+)
+
+const APIAuthorization = "harness"
+
+// Harness runs the runner's HTTP API against an empty database and a fake (or real) backend
+//
+// The runner keeps its state in package level variables, so only one Harness may be running at any time
+type Harness struct {
+	Server    *httptest.Server
+	HttpProxy *httptest.Server //Serves the HTTP proxy, which only routes instances if ds.HttpProxyPort is set
+	Backend   backend.Backend
+}
+
+var inMemoryDatabases int32
+
+var background sync.WaitGroup //Work left running by requests, see workers.Background
+
+func init() {
+	workers.Background = &background //Only set once, as goroutines of a previous test may still read it
+}
+
+// Returns a dialector for a new, empty in-memory SQLite database, so that tests do not need a database server
+func InMemory() gorm.Dialector {
+	return sqlite.Open("file:runner" + strconv.Itoa(int(atomic.AddInt32(&inMemoryDatabases, 1))) + "?mode=memory&cache=shared")
+}
+
+// Returns a Postgres dialector for the DSN in RUNNER_TEST_POSTGRES_DSN, or nil if it is not set
+// Any other dialector (E.g. InMemory) may also be passed to Start
+func PostgresFromEnv() gorm.Dialector {
+	dsn := os.Getenv("RUNNER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return nil
+	}
+	return postgres.Open(dsn)
+}
+
+func resetState() {
+	ds.State = ds.NewRunner() //Also resets the ports, instance counts, health, resources and logins of every target
+	ds.ReservedPorts = make(map[int]bool)
+
+	ds.MaxInstanceCount = 100
+	ds.DefaultSecondsPerInstance = 300
+	ds.DefaultNanosecondsPerInstance = ds.DefaultSecondsPerInstance * 1e9
+	ds.MaxSecondsLeftBeforeExtendAllowed = ds.DefaultSecondsPerInstance //Allow extending immediately
+	ds.PortainerBalanceStrategy = "DISTRIBUTE"
+	ds.HttpProxyPort = 0
+	ds.HttpProxyDomain = ""
+	ds.HttpProxyScheme = "http"
+	ds.TcpProxyPort = 0
+	ds.PublishedHostIp = ""
+	ds.DefaultContainerLimits = ds.ContainerLimits{}
+	ds.DefaultEgressPolicy = ds.EgressPolicy{Egress: ds.EgressFull}
+	ds.EgressFilterImage = ""
+	ds.RunnerId = "runner"
+	ds.OrphanGraceSeconds = 0 //Orphans are removed the second time that the reconciler sees them
+	proxy.ClearRoutes()
+
+	creds.PortainerTargets = nil
+	creds.PortainerCreds = make(map[string]ds.ThirdPartyCredentialsJson)
+	creds.APIAuthorization = APIAuthorization
+	creds.FlagSecret = ""
+	creds.EnvSecret = ""
+}
+
+// Starts the runner with b launching instances on targets
+func Start(dialector gorm.Dialector, b backend.Backend, targets ...ds.Target) *Harness {
+	gin.SetMode(gin.TestMode)
+	resetState()
+	ds.Backend = "FAKE"
+
+	for _, target := range targets {
+		creds.PortainerTargets = append(creds.PortainerTargets, target)
+	}
+
+	return start(dialector, b)
+}
+
+// Starts the runner with the PORTAINER backend launching instances on portainer
+func StartWithPortainer(dialector gorm.Dialector, portainer *FakePortainer) *Harness {
+	gin.SetMode(gin.TestMode)
+	resetState()
+	ds.Backend = "PORTAINER"
+
+	credentials := portainer.Credentials
+	creds.PortainerCreds[credentials.Url] = credentials
+	if credentials.Api_Key == "" {
+		jwt, err := creds.GetPortainerJWT(credentials)
+		if err != nil {
+			panic(err)
+		}
+		creds.SetPortainerJWT(credentials.Url, jwt)
+	}
+	environment_ids, err := creds.GetPortainerEnvironmentIds(credentials.Url)
+	if err != nil {
+		panic(err)
+	}
+	credentials.Environment_Ids = environment_ids
+	creds.PortainerCreds[credentials.Url] = credentials
+	for _, environment_id := range credentials.Environment_Ids {
+		target := ds.Target{Url: credentials.Url, Environment_Id: environment_id}
+		creds.PortainerTargets = append(creds.PortainerTargets, target)
+	}
+
+	return start(dialector, api_portainer.Backend{})
+}
+
+func start(dialector gorm.Dialector, b backend.Backend) *Harness {
+	if dialector.Name() == "sqlite" {
+		setup := createInstancesTable(dialector)
+		api_sql.SyncWithDialector(dialector)
+		if db, err := setup.DB(); err == nil {
+			db.Close() //The database stays alive, as api_sql.DB keeps a connection to it
+		}
+	} else {
+		api_sql.SyncWithDialector(dialector)
+	}
+	if dialector.Name() == "sqlite" { //SQLite only allows one writer at a time, so concurrent requests would fail with "database is locked"
+		db, err := api_sql.DB.DB()
+		if err != nil {
+			panic(err)
+		}
+		db.SetMaxOpenConns(1)
+	}
+	backend.Active = b
+	workers.StartLaunchWorkers()
+	workers.CheckTargetHealth()
+	workers.ClearReconcileState()
+
+	return &Harness{Server: httptest.NewServer(workers.NewRouter()), HttpProxy: httptest.NewServer(proxy.HttpHandler()), Backend: b}
+}
+
+// Creates the instances table of a new SQLite database with an AUTOINCREMENT Instance_Id, which the SQLite dialect does not do for primary keys.
+// Without it, SQLite hands out the Instance_Id of the last deleted instance again, unlike the sequence Postgres uses.
+// SyncWithDialector adds the other columns. The returned connection keeps the in-memory database alive until then
+func createInstancesTable(dialector gorm.Dialector) *gorm.DB {
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS instances (instance_id integer PRIMARY KEY AUTOINCREMENT)").Error; err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// Stops the HTTP server and deletes everything the harness created in the database
+func (h *Harness) Close() {
+	h.Server.Close()
+	h.HttpProxy.Close()
+	background.Wait() //So that nothing from this test touches the state of the next one
+	api_sql.DB.Where("1 = 1").Delete(&ds.Instance{})
+	api_sql.DB.Where("1 = 1").Delete(&ds.RunnerChallenge{})
+}
+
+// Sends a GET request to the runner, returning the status code and the decoded JSON response
+func (h *Harness) Get(path string) (int, map[string]interface{}) {
+	return h.request("GET", path, nil)
+}
+
+// Sends a GET request with body encoded as JSON (E.g. for /addChallenge), returning the status code and the decoded JSON response
+func (h *Harness) GetJSON(path string, body interface{}) (int, map[string]interface{}) {
+	return h.request("GET", path, body)
+}
+
+func (h *Harness) request(method string, path string, body interface{}) (int, map[string]interface{}) {
+	var reader *bytes.Reader
+	if body != nil {
+		json_body, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		reader = bytes.NewReader(json_body)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, h.Server.URL+path, reader)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", APIAuthorization)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+
+	defer resp.Body.Close()
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+
+	var raw map[string]interface{}
+	json.Unmarshal(resp_body, &raw)
+	return resp.StatusCode, raw
+}
+
+// Sends a GET request for instance_url (E.g. a URL from Connections) through the HTTP proxy, returning the status code and the response body
+func (h *Harness) ProxyGet(instance_url string) (int, string) {
+	u, err := url.Parse(instance_url)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("GET", h.HttpProxy.URL+u.RequestURI(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Host = u.Host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+
+	defer resp.Body.Close()
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return resp.StatusCode, string(resp_body)
+}
+
+// Blocks until every instance queued by /addInstance has finished launching, and every accepted /extendTimeLeft request has updated its instance
+func (h *Harness) Wait() {
+	background.Wait()
+}
+
+// Adds ch to the database directly, as /addChallenge adds challenges asynchronously
+func (h *Harness) AddChallenge(ch ds.RunnerChallenge) string {
+	ch.Challenge_Id = api_sql.GetOrCreateRunnerChallengeId(ch.Challenge_Name, ch.Docker_Compose, ch.Port_Count)
+	api_sql.UpdateRunnerChallenge(ch)
+	return ch.Challenge_Id
+}
+
+// Runs the health checker once
+func (h *Harness) CheckHealth() {
+	workers.CheckTargetHealth()
+}
+
+// Runs the reconciler once
+func (h *Harness) Reconcile() {
+	workers.Reconcile()
+}
+
+// Makes every instance expire, then runs the Kill Worker once
+func (h *Harness) ExpireAll() {
+	for i, instance := range api_sql.GetInstances() {
+		timestamp := ds.State.QueueInstance(int64(i), instance.Instance_Id)
+		api_sql.UpdateInstanceTime(instance.Instance_Id, timestamp)
+	}
+	workers.ClearInstanceQueue()
+}
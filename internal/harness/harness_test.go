@@ -0,0 +1,1127 @@
+package harness_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/harness"
+	"runner/internal/workers"
+)
+
+var target = ds.Target{Url: "http://docker.local", Environment_Id: 0}
+
+func imageChallenge(name string) ds.RunnerChallenge {
+	return ds.RunnerChallenge{Challenge_Name: name, Port_Types: "nc", Port_Count: 1, Image_Name: "alpine", Internal_Port: "80"}
+}
+
+func stackChallenge(name string) ds.RunnerChallenge {
+	return ds.RunnerChallenge{Challenge_Name: name, Port_Types: "http", Port_Count: 1, Docker_Compose: true, Docker_Compose_File: "services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n"}
+}
+
+// Starts the runner with the PORTAINER backend on a fake Portainer, configured by configure before the runner starts, and stops both once the test ends
+func newPortainerHarness(t *testing.T, configure ...func(portainer *harness.FakePortainer)) (*harness.Harness, *harness.FakePortainer) {
+	t.Helper()
+	portainer := harness.NewFakePortainer()
+	t.Cleanup(portainer.Close)
+	for _, c := range configure {
+		c(portainer)
+	}
+	h := harness.StartWithPortainer(harness.InMemory(), portainer)
+	t.Cleanup(h.Close)
+	return h, portainer
+}
+
+func addInstance(t *testing.T, h *harness.Harness, userid string, challid string) int {
+	t.Helper()
+	status, body := h.Get("/addInstance?userid=" + userid + "&challid=" + challid)
+	if status != 200 {
+		t.Fatalf("addInstance returned %d: %v", status, body)
+	}
+	h.Wait()
+	return int(body["Instance_Id"].(float64))
+}
+
+func getInstance(t *testing.T, instance_id int) *ds.Instance {
+	t.Helper()
+	instance, err := api_sql.GetInstance(instance_id)
+	if err != nil {
+		t.Fatalf("Instance %d does not exist: %v", instance_id, err)
+	}
+	return instance
+}
+
+// Waits for the asynchronous part of /extendTimeLeft to update the instance
+func waitForTimeout(t *testing.T, instance_id int, after int64) int64 {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if timeout := getInstance(t, instance_id).Instance_Timeout; timeout > after {
+			return timeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Instance %d was not extended", instance_id)
+	return 0
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	instance_id := addInstance(t, h, "alice", challid)
+	instance := getInstance(t, instance_id)
+	if instance.State != ds.InstanceStateRunning || instance.Portainer_Id == "" {
+		t.Fatalf("Instance should be running after the launch, got %+v", instance)
+	}
+	if b.Count() != 1 {
+		t.Fatalf("Expected 1 resource on the backend, got %d", b.Count())
+	}
+
+	status, body := h.Get("/getUserStatus?userid=alice")
+	if status != 200 || body["State"] != ds.InstanceStateRunning {
+		t.Fatalf("getUserStatus returned %d: %v", status, body)
+	}
+
+	if status, body := h.Get("/addInstance?userid=alice&challid=" + challid); status != 400 {
+		t.Fatalf("A second instance for the same user should be rejected, got %d: %v", status, body)
+	}
+
+	if status, body := h.Get("/extendTimeLeft?userid=alice"); status != 200 {
+		t.Fatalf("extendTimeLeft returned %d: %v", status, body)
+	}
+	extended := waitForTimeout(t, instance_id, instance.Instance_Timeout)
+	if timeout, ok := ds.State.InstanceTimeout(instance_id); !ok || timeout != extended {
+		t.Fatalf("InstanceQueue should hold the extended timeout %d, got %d (%v)", extended, timeout, ok)
+	}
+
+	h.ExpireAll()
+	if _, err := api_sql.GetInstance(instance_id); err == nil {
+		t.Fatal("Instance should be deleted once it expires")
+	}
+	if b.Count() != 0 || b.Stops != 1 {
+		t.Fatalf("Instance should be stopped once, got %d resources and %d stops", b.Count(), b.Stops)
+	}
+	if _, ok := ds.State.InstanceTimeout(instance_id); ok {
+		t.Fatal("Expired instance is still queued")
+	}
+
+	next_id := addInstance(t, h, "alice", challid)
+	if next_id <= instance_id {
+		t.Fatalf("Instance ids should not be reused, got %d after %d", next_id, instance_id)
+	}
+}
+
+func TestRemoveInstance(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	instance_id := addInstance(t, h, "bob", challid)
+	if status, body := h.Get("/removeInstance?userid=bob"); status != 200 {
+		t.Fatalf("removeInstance returned %d: %v", status, body)
+	}
+	if _, err := api_sql.GetInstance(instance_id); err == nil {
+		t.Fatal("Instance should be deleted once it is removed")
+	}
+	if b.Count() != 0 {
+		t.Fatalf("Instance should be stopped, got %d resources", b.Count())
+	}
+	if status, _ := h.Get("/removeInstance?userid=bob"); status != 400 {
+		t.Fatalf("Removing an instance twice should fail, got %d", status)
+	}
+}
+
+func TestInstanceLifecyclePortainer(t *testing.T) {
+	h, portainer := newPortainerHarness(t)
+	image_challid := h.AddChallenge(imageChallenge("image"))
+	stack_challid := h.AddChallenge(stackChallenge("stack"))
+
+	image_id := addInstance(t, h, "alice", image_challid)
+	stack_id := addInstance(t, h, "bob", stack_challid)
+	if len(portainer.Containers) != 1 || len(portainer.Stacks) != 1 {
+		t.Fatalf("Expected 1 container and 1 stack, got %d and %d", len(portainer.Containers), len(portainer.Stacks))
+	}
+	for _, container := range portainer.Containers {
+		if !container.Running {
+			t.Fatalf("Container %s was not started", container.Id)
+		}
+	}
+	for _, instance_id := range []int{image_id, stack_id} {
+		if state := getInstance(t, instance_id).State; state != ds.InstanceStateRunning {
+			t.Fatalf("Instance %d should be running, got %s", instance_id, state)
+		}
+	}
+
+	instance := getInstance(t, image_id)
+	h.Get("/extendTimeLeft?userid=alice")
+	waitForTimeout(t, image_id, instance.Instance_Timeout)
+
+	h.ExpireAll()
+	if len(portainer.Stopped) != 2 {
+		t.Fatalf("Every container should be stopped before it is deleted, got %v", portainer.Stopped)
+	}
+	if portainer.Count() != 0 {
+		t.Fatalf("Every container and stack should be deleted once the instances expire, got %d", portainer.Count())
+	}
+	for name := range portainer.Networks {
+		t.Fatalf("Network %s of an expired instance was not deleted", name)
+	}
+	if count := len(api_sql.GetInstances()); count != 0 {
+		t.Fatalf("Expected no instances, got %d", count)
+	}
+}
+
+func TestMaxInstanceCount(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	ds.MaxInstanceCount = 2
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	for i := 0; i < 2; i++ {
+		addInstance(t, h, "user"+strconv.Itoa(i), challid)
+	}
+	if status, body := h.Get("/addInstance?userid=user2&challid=" + challid); status != 400 {
+		t.Fatalf("addInstance beyond Max_Instance_Count should be rejected, got %d: %v", status, body)
+	}
+}
+
+func TestKillStaleInstance(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	instance_id := addInstance(t, h, "alice", challid)
+	stale := *getInstance(t, instance_id)
+	stale.State = ds.InstanceStateStarting //As read by a request before the launch completed
+	if err := workers.KillInstance(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api_sql.GetInstance(instance_id); err == nil || b.Count() != 0 {
+		t.Fatal("Instance should be stopped even though it was running rather than starting")
+	}
+	if _, ok := ds.State.InstanceTimeout(instance_id); ok {
+		t.Fatal("Killed instance is still queued")
+	}
+
+	instance_id = addInstance(t, h, "bob", challid)
+	instance := *getInstance(t, instance_id)
+	if err := api_sql.SetInstanceState(instance_id, ds.InstanceStateRunning, ds.InstanceStateStopping, ""); err != nil { //As if another request is killing it
+		t.Fatal(err)
+	}
+	if err := workers.KillInstance(instance); !errors.Is(err, workers.ErrInstanceStopping) {
+		t.Fatalf("Expected ErrInstanceStopping, got %v", err)
+	}
+	if _, ok := ds.State.InstanceTimeout(instance_id); !ok {
+		t.Fatal("Instance should stay queued while another request is killing it")
+	}
+}
+
+func TestLaunchPanic(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	b.LaunchPanic = "index out of range"
+	instance_id := addInstance(t, h, "alice", challid)
+	instance := getInstance(t, instance_id)
+	if instance.State != ds.InstanceStateFailed || !strings.Contains(instance.Failure_Reason, "index out of range") {
+		t.Fatalf("Instance should fail when the launch panics, got %+v", instance)
+	}
+
+	b.LaunchPanic = nil
+	instance_id = addInstance(t, h, "alice", challid) //Failed instances do not stop the user from trying again
+	if state := getInstance(t, instance_id).State; state != ds.InstanceStateRunning {
+		t.Fatalf("Instance should be running, got %s", state)
+	}
+}
+
+func TestAddChallengeUnsupportedPorts(t *testing.T) {
+	h := harness.Start(harness.InMemory(), harness.NewFakeBackend(), target)
+	defer h.Close()
+
+	for ports, expected := range map[string]string{
+		`"8080"`:                        "not of the form",
+		`8080`:                          "not of the form",
+		`"8080-8081:80"`:                "invalid external port",
+		`"8080:http"`:                   "invalid internal port",
+		`{target: 80, published: 8080}`: "long syntax",
+		`"127.0.0.1:8080:80:80"`:        "not of the form",
+	} {
+		docker_compose := "services:\n  web:\n    image: nginx\n    ports:\n      - " + ports + "\n"
+		ch := ds.RunnerChallenge{Challenge_Name: "chall", Port_Types: "http", Docker_Compose: true, Docker_Compose_File: base64.StdEncoding.EncodeToString([]byte(docker_compose))}
+		status, body := h.GetJSON("/addChallenge", ch)
+		if message, _ := body["Error"].(string); status != 400 || !strings.Contains(message, expected) {
+			t.Errorf("Expected an error mentioning %q for ports %s, got %d: %v", expected, ports, status, body)
+		}
+	}
+}
+
+func TestPublishedHostIp(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	ds.HttpProxyPort, ds.HttpProxyDomain = 8080, "chall.local"
+	ds.PublishedHostIp = "10.0.0.5"
+	ch := imageChallenge("chall")
+	ch.Port_Types, ch.Port_Count = "http", 1
+	http_challid := h.AddChallenge(ch)
+	nc_challid := h.AddChallenge(imageChallenge("nc"))
+
+	http_id := addInstance(t, h, "alice", http_challid)
+	nc_id := addInstance(t, h, "bob", nc_challid)
+	if host_ip := b.Options[getInstance(t, http_id).Portainer_Id].HostIp(0); host_ip != "10.0.0.5" {
+		t.Fatalf("Ports behind the HTTP proxy should be published on Published_Host_Ip, got %q", host_ip)
+	}
+	if host_ip := b.Options[getInstance(t, nc_id).Portainer_Id].HostIp(0); host_ip != "" {
+		t.Fatalf("Ports that are not proxied should be published on every interface, got %q", host_ip)
+	}
+}
+
+func TestFlagTemplate(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	creds.FlagSecret = "secret"
+
+	for _, flag_template := range []string{"CTF{static}", "CTF{%s_%s}"} {
+		ch := imageChallenge("chall")
+		ch.Flag_Template = flag_template
+		if status, body := h.GetJSON("/addChallenge", ch); status != 400 {
+			t.Errorf("flag_template %s should be rejected, got %d: %v", flag_template, status, body)
+		}
+	}
+
+	ch := imageChallenge("chall")
+	ch.Flag_Template, ch.Flag_Env = "CTF{%s_%s}", "FLAG" //Added before flag templates were validated
+	challid := h.AddChallenge(ch)
+	instance_id := addInstance(t, h, "alice", challid)
+	if instance := getInstance(t, instance_id); instance.State != ds.InstanceStateFailed {
+		t.Fatalf("Instance of a challenge with an invalid flag_template should fail, got %s", instance.State)
+	}
+
+	ch = imageChallenge("valid")
+	ch.Flag_Template, ch.Flag_Env = "CTF{%s}", "FLAG"
+	ch.Challenge_Id = h.AddChallenge(ch)
+	instance := getInstance(t, addInstance(t, h, "bob", ch.Challenge_Id))
+	flag := b.Options[instance.Portainer_Id].Env["FLAG"]
+	if !strings.HasPrefix(flag, "CTF{") || !creds.VerifyFlag(ch, "bob", flag) || creds.VerifyFlag(ch, "alice", flag) {
+		t.Fatalf("Unexpected flag %s", flag)
+	}
+}
+
+// Collects the output of the log package, which is also written to by the workers
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	h, _ := newPortainerHarness(t)
+	creds.FlagSecret, creds.EnvSecret = "secret", "key"
+	output := &logBuffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	password, err := creds.EncryptSecret("hunter2") //As /addChallenge stores secret env variables
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ch := range []ds.RunnerChallenge{imageChallenge("image"), stackChallenge("stack")} {
+		ch.Flag_Template, ch.Flag_Env = "CTF{%s}", "FLAG"
+		ch.Env = ds.ChallengeEnv{"PASSWORD": {Value: password, Secret: true}}
+		ch.Challenge_Id = h.AddChallenge(ch)
+		userid := "user_" + ch.Challenge_Name
+		if instance := getInstance(t, addInstance(t, h, userid, ch.Challenge_Id)); instance.State != ds.InstanceStateRunning {
+			t.Fatalf("Instance of %s should be running, got %+v", ch.Challenge_Name, instance)
+		}
+
+		flag, err := creds.GenerateFlag(ch, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(output.String(), flag) {
+			t.Errorf("The flag of %s was written to the log", ch.Challenge_Name)
+		}
+		if strings.Contains(output.String(), "hunter2") {
+			t.Errorf("The secret env variable of %s was written to the log", ch.Challenge_Name)
+		}
+	}
+	if !strings.Contains(output.String(), "launch") {
+		t.Fatal("Expected the launches to be logged")
+	}
+}
+
+func TestReadOnlyRootfsFlagFile(t *testing.T) {
+	h, portainer := newPortainerHarness(t)
+	creds.FlagSecret = "secret"
+	read_only := true
+
+	ch := imageChallenge("chall")
+	ch.Flag_Template, ch.Flag_File, ch.Read_Only_Rootfs = "CTF{%s}", "/flag.txt", &read_only
+	if status, body := h.GetJSON("/addChallenge", ch); status != 400 {
+		t.Fatalf("flag_file with read_only_rootfs should be rejected, got %d: %v", status, body)
+	}
+
+	ds.DefaultContainerLimits.Read_Only_Rootfs = true
+	ch.Read_Only_Rootfs = nil
+	if status, body := h.GetJSON("/addChallenge", ch); status != 400 {
+		t.Fatalf("flag_file with Default_Read_Only_Rootfs should be rejected, got %d: %v", status, body)
+	}
+
+	challid := h.AddChallenge(ch) //As if Default_Read_Only_Rootfs was turned on after the challenge was added
+	instance := getInstance(t, addInstance(t, h, "alice", challid))
+	if instance.State != ds.InstanceStateFailed || !strings.Contains(instance.Failure_Reason, "read-only") {
+		t.Fatalf("Instance should fail before it is launched, got %+v", instance)
+	}
+	if portainer.Count() != 0 {
+		t.Fatalf("Nothing should be launched, got %d", portainer.Count())
+	}
+}
+
+func TestEgressPortainer(t *testing.T) {
+	h, portainer := newPortainerHarness(t)
+
+	ch := imageChallenge("chall")
+	ch.Egress = ds.EgressNone
+	if status, body := h.GetJSON("/addChallenge", ch); status != 400 {
+		t.Fatalf("Restricting egress without an Egress_Filter_Image should be rejected, got %d: %v", status, body)
+	}
+	ds.EgressFilterImage = "egress-filter"
+	ch.Egress, ch.Egress_Allowlist = ds.EgressAllowlist, "bridge"
+	if status, body := h.GetJSON("/addChallenge", ch); status != 400 {
+		t.Fatalf("An allowlist of Docker networks should be rejected, got %d: %v", status, body)
+	}
+
+	ch.Egress, ch.Egress_Allowlist = ds.EgressNone, ""
+	challid := h.AddChallenge(ch)
+	instance := getInstance(t, addInstance(t, h, "alice", challid))
+	prefix := backend.EgressBridgePrefix(instance.Instance_Id)
+	if len(portainer.Egress_Scripts) != 1 || portainer.Egress_Scripts[0] != backend.EgressRulesScript(instance.Instance_Id, ds.EgressPolicy{Egress: ds.EgressNone}) || !strings.Contains(portainer.Egress_Scripts[0], "ip6tables -w -I $forward6 -i "+prefix+"+ ! -o "+prefix+"+") {
+		t.Fatalf("Expected the IPv4 and IPv6 egress rules of the instance to be installed, got %v", portainer.Egress_Scripts)
+	}
+	for _, network := range portainer.Networks {
+		if network.Options["com.docker.network.bridge.name"] != prefix+"0" || network.Options["com.docker.network.bridge.enable_ip_masquerade"] != "false" {
+			t.Fatalf("Network %s is not filtered by the egress rules, got %v", network.Name, network.Options)
+		}
+	}
+
+	stack := stackChallenge("stack")
+	stack.Egress, stack.Egress_Allowlist = ds.EgressAllowlist, "10.0.0.0/8,192.0.2.1"
+	stack_instance := getInstance(t, addInstance(t, h, "bob", h.AddChallenge(stack)))
+	if len(portainer.Egress_Scripts) != 2 || !strings.Contains(portainer.Egress_Scripts[1], "-d 10.0.0.0/8 -j ACCEPT") || !strings.Contains(portainer.Egress_Scripts[1], "-d 192.0.2.1 -j ACCEPT") {
+		t.Fatalf("Expected the allowlist to be accepted, got %v", portainer.Egress_Scripts)
+	}
+	for _, stack := range portainer.Stacks {
+		bridge := "com.docker.network.bridge.name: " + backend.EgressBridge(stack_instance.Instance_Id, 0)
+		if !strings.Contains(stack.Stack_File_Content, bridge) || strings.Contains(stack.Stack_File_Content, "enable_ip_masquerade") {
+			t.Fatalf("The default network of the stack is not filtered by the egress rules, got %s", stack.Stack_File_Content)
+		}
+	}
+
+	h.ExpireAll()
+	if len(portainer.Egress_Scripts) != 4 {
+		t.Fatalf("Expected the egress rules to be removed along with the instances, got %v", portainer.Egress_Scripts)
+	}
+	if removed := strings.Join(portainer.Egress_Scripts[2:], ""); !strings.Contains(removed, backend.EgressCleanupScript(instance.Instance_Id)) || !strings.Contains(removed, backend.EgressCleanupScript(stack_instance.Instance_Id)) {
+		t.Fatalf("Expected the egress rules to be removed along with the instances, got %v", portainer.Egress_Scripts)
+	}
+	if portainer.Count() != 0 {
+		t.Fatalf("Every container should be deleted, including the egress filters, got %d", portainer.Count())
+	}
+
+	portainer.Egress_Status = 1
+	failed := getInstance(t, addInstance(t, h, "carol", challid))
+	if failed.State != ds.InstanceStateFailed || portainer.Count() != 0 || len(portainer.Networks) != 0 {
+		t.Fatalf("An instance should not be launched without its egress rules, got %+v", failed)
+	}
+}
+
+func TestRemoveInstanceAdmin(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	alice := addInstance(t, h, "alice", challid)
+	if status, body := h.Get("/removeInstance/admin?instanceid=" + strconv.Itoa(alice)); status != 200 || b.Graceful != 1 {
+		t.Fatalf("Instance should be stopped gracefully, got %d (%d graceful stops): %v", status, b.Graceful, body)
+	}
+	bob := addInstance(t, h, "bob", challid)
+	if status, body := h.Get("/removeInstance/admin?force=true&instanceid=" + strconv.Itoa(bob)); status != 200 || b.Stops != 2 || b.Graceful != 1 {
+		t.Fatalf("Forced removal should skip the graceful stop, got %d (%d stops, %d graceful): %v", status, b.Stops, b.Graceful, body)
+	}
+
+	//Carol's instance is stopped by another request after /removeInstance/admin read it as running
+	carol := getInstance(t, addInstance(t, h, "carol", challid))
+	dave := getInstance(t, addInstance(t, h, "dave", challid))
+	b.StopBlock[carol.Portainer_Id], b.StopBlock[dave.Portainer_Id] = make(chan struct{}), make(chan struct{})
+	type response struct {
+		status int
+		body   map[string]interface{}
+	}
+	admin := make(chan response)
+	go func() {
+		status, body := h.Get("/removeInstance/admin?challid=" + challid)
+		admin <- response{status, body}
+	}()
+	stopping := func(instances ...*ds.Instance) *ds.Instance { //Waits for one of the instances to be stopping
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, instance := range instances {
+				if getInstance(t, instance.Instance_Id).State == ds.InstanceStateStopping {
+					return instance
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(b.StopBlock[carol.Portainer_Id]) //Otherwise the requests never return
+		close(b.StopBlock[dave.Portainer_Id])
+		t.Fatal("No instance is stopping")
+		return nil
+	}
+	first, second := carol, dave //The instances of the challenge are removed in no particular order
+	if stopping(carol, dave) == dave {
+		first, second = dave, carol
+	}
+	user := make(chan int)
+	go func() {
+		status, _ := h.Get("/removeInstance?userid=" + second.Usr_Id)
+		user <- status
+	}()
+	stopping(second)
+	close(b.StopBlock[first.Portainer_Id])
+
+	result := <-admin
+	ids, _ := result.body["Instance_Ids"].([]interface{})
+	if result.status != 409 || len(ids) != 1 || int(ids[0].(float64)) != first.Instance_Id {
+		t.Fatalf("Only instance %d should be reported as removed, got %d: %v", first.Instance_Id, result.status, result.body)
+	}
+	close(b.StopBlock[second.Portainer_Id])
+	if status := <-user; status != 200 {
+		t.Fatalf("The other request should remove instance %d, got %d", second.Instance_Id, status)
+	}
+	if count := len(api_sql.GetInstances()); count != 0 {
+		t.Fatalf("Expected no instances, got %d", count)
+	}
+}
+
+func TestRemoveChallengeStopsInstances(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+	alice := getInstance(t, addInstance(t, h, "alice", challid))
+	addInstance(t, h, "bob", challid)
+
+	b.StopBlock[alice.Portainer_Id] = make(chan struct{})
+	if status, body := h.Get("/removeChallenge?challid=" + challid); status != 200 {
+		close(b.StopBlock[alice.Portainer_Id])
+		t.Fatalf("removeChallenge returned %d: %v", status, body)
+	}
+	time.Sleep(100 * time.Millisecond)
+	valid := api_sql.ValidRunnerChallenge(challid)
+	close(b.StopBlock[alice.Portainer_Id])
+	if !valid {
+		t.Fatal("The challenge should only be deleted once its instances are stopped, as stopping them needs the challenge")
+	}
+
+	h.Wait()
+	if api_sql.ValidRunnerChallenge(challid) || b.Count() != 0 || len(api_sql.GetInstances()) != 0 {
+		t.Fatalf("The challenge and its instances should be removed, got %d running instances", b.Count())
+	}
+}
+
+// Exercises the state shared by the API handlers and the Kill Worker from many goroutines, run it with go test -race
+func TestConcurrentInstances(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+	const users = 8
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 2*users; i++ { //Every user adds an instance twice at once
+		wg.Add(1)
+		go func(userid string) {
+			defer wg.Done()
+			if status, _ := h.Get("/addInstance?userid=" + userid + "&challid=" + challid); status == 200 {
+				atomic.AddInt32(&added, 1)
+			}
+		}("user" + strconv.Itoa(i%users))
+	}
+	wg.Wait()
+	h.Wait()
+	if added != users || b.Count() != users || ds.State.Ports.Count(target) != users {
+		t.Fatalf("Every user should have exactly one instance, got %d added, %d launched and %d ports used", added, b.Count(), ds.State.Ports.Count(target))
+	}
+
+	for i := 0; i < users; i++ { //Extend and remove instances while they expire
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userid := "user" + strconv.Itoa(i)
+			if i%2 == 0 {
+				h.Get("/removeInstance?userid=" + userid)
+			} else {
+				h.Get("/extendTimeLeft?userid=" + userid)
+				h.Get("/getUserStatus?userid=" + userid)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ExpireAll()
+	}()
+	wg.Wait()
+	h.Wait()
+	h.ExpireAll() //Instances that were extended before they expired
+
+	if count := len(api_sql.GetInstances()); count != 0 || b.Count() != 0 {
+		t.Fatalf("Every instance should be killed, got %d instances and %d resources", count, b.Count())
+	}
+	if ds.State.Ports.Count(target) != 0 || ds.State.Targets.InstanceCount(target) != 0 {
+		t.Fatalf("Every port and slot should be released, got %d ports and %d instances on the target", ds.State.Ports.Count(target), ds.State.Targets.InstanceCount(target))
+	}
+	if _, ok := ds.State.PopExpiredInstance(1 << 62); ok {
+		t.Fatal("No instance should be left in the expiry queue")
+	}
+}
+
+func TestAddInstanceWriteFailure(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	//Fails every insert the way a duplicate Instance_Id would
+	if err := api_sql.DB.Exec("CREATE TRIGGER fail_insert BEFORE INSERT ON instances BEGIN SELECT RAISE(ABORT, 'UNIQUE constraint failed: instances.instance_id'); END").Error; err != nil {
+		t.Fatal(err)
+	}
+	if status, body := h.Get("/addInstance?userid=alice&challid=" + challid); status != 500 {
+		t.Fatalf("addInstance should fail when the instance cannot be written, got %d: %v", status, body)
+	}
+	h.Wait()
+	if len(api_sql.GetInstances()) != 0 || b.Count() != 0 {
+		t.Fatal("Nothing should be launched for an instance that could not be written")
+	}
+	if ds.State.Ports.Count(target) != 0 || ds.State.Targets.InstanceCount(target) != 0 {
+		t.Fatalf("Ports and balancer counts should be released, got %d ports and %d instances", ds.State.Ports.Count(target), ds.State.Targets.InstanceCount(target))
+	}
+
+	if err := api_sql.DB.Exec("DROP TRIGGER fail_insert").Error; err != nil {
+		t.Fatal(err)
+	}
+	if instance := getInstance(t, addInstance(t, h, "alice", challid)); instance.State != ds.InstanceStateRunning {
+		t.Fatalf("Instance should be running once inserts succeed again, got %+v", instance)
+	}
+}
+
+func TestExpireReadFailure(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+	instance_id := addInstance(t, h, "alice", challid)
+
+	ds.State.QueueInstance(0, instance_id)
+	if err := api_sql.DB.Exec("ALTER TABLE instances RENAME TO instances_unreachable").Error; err != nil { //Fails every read of an instance
+		t.Fatal(err)
+	}
+	workers.ClearInstanceQueue()
+	if err := api_sql.DB.Exec("ALTER TABLE instances_unreachable RENAME TO instances").Error; err != nil {
+		t.Fatal(err)
+	}
+	if timeout, ok := ds.State.InstanceTimeout(instance_id); !ok || timeout <= time.Now().UnixNano() {
+		t.Fatalf("An instance that could not be read should be retried later, got %d (%v)", timeout, ok)
+	}
+	if b.Count() != 1 {
+		t.Fatal("An instance that could not be read should not be stopped")
+	}
+
+	h.ExpireAll()
+	if _, err := api_sql.GetInstance(instance_id); err == nil || b.Count() != 0 {
+		t.Fatal("The instance should be killed once it can be read again")
+	}
+}
+
+func TestInstanceIdSequence(t *testing.T) {
+	dialector := harness.PostgresFromEnv()
+	if dialector == nil {
+		t.Skip("RUNNER_TEST_POSTGRES_DSN is not set")
+	}
+	b := harness.NewFakeBackend()
+	h := harness.Start(dialector, b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	first_id := addInstance(t, h, "alice", challid)
+	h.ExpireAll()
+
+	//Instance_Ids picked by older runners do not advance the sequence
+	picked := ds.Instance{Instance_Id: first_id + 1000, Usr_Id: "bob", Challenge_Id: challid, Portainer_Url: target.Url, State: ds.InstanceStateFailed}
+	if err := api_sql.DB.Create(&picked).Error; err != nil {
+		t.Fatal(err)
+	}
+	api_sql.SyncWithDialector(dialector)
+	second_id := addInstance(t, h, "alice", challid)
+	if second_id <= picked.Instance_Id {
+		t.Fatalf("The sequence should continue after the largest Instance_Id %d, got %d", picked.Instance_Id, second_id)
+	}
+	h.ExpireAll()
+
+	//Without any instances left, syncing again must not move the sequence backward
+	api_sql.DB.Where("1 = 1").Delete(&ds.Instance{})
+	api_sql.SyncWithDialector(dialector)
+	if third_id := addInstance(t, h, "alice", challid); third_id <= second_id {
+		t.Fatalf("Instance ids should not be reused after a resync, got %d after %d", third_id, second_id)
+	}
+}
+
+func TestSyncOnlyRunnerInstances(t *testing.T) {
+	dialector := harness.InMemory()
+	b := harness.NewFakeBackend()
+	h := harness.Start(dialector, b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	timeout := time.Now().UnixNano() + ds.DefaultNanosecondsPerInstance
+	other := ds.Instance{Usr_Id: "bob", Challenge_Id: challid, Portainer_Url: "http://elsewhere.local", Instance_Timeout: timeout, State: ds.InstanceStatePending, Runner_Id: "other"} //Still launching on another runner, on a target this runner does not know
+	starting := ds.Instance{Usr_Id: "alice", Challenge_Id: challid, Portainer_Url: target.Url, Instance_Timeout: timeout, State: ds.InstanceStateStarting, Runner_Id: ds.RunnerId}
+	legacy := ds.Instance{Usr_Id: "carol", Challenge_Id: challid, Portainer_Url: target.Url, Instance_Timeout: timeout, Ports_Used: "30000", State: ds.InstanceStateRunning} //Added before instances recorded their runner
+	for _, instance := range []*ds.Instance{&other, &starting, &legacy} {
+		if err := api_sql.DB.Create(instance).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api_sql.SyncWithDialector(dialector) //As if the runner restarted
+	if instance := getInstance(t, other.Instance_Id); instance.State != ds.InstanceStatePending || instance.Runner_Id != "other" {
+		t.Fatalf("Instances of other runners should be left alone, got %+v", instance)
+	}
+	if _, ok := ds.State.InstanceTimeout(other.Instance_Id); ok {
+		t.Fatal("Instances of other runners should not be queued to be killed")
+	}
+	if instance := getInstance(t, starting.Instance_Id); instance.State != ds.InstanceStateFailed {
+		t.Fatalf("Instances of this runner that were launching should fail, got %s", instance.State)
+	}
+	if instance := getInstance(t, legacy.Instance_Id); instance.Runner_Id != ds.RunnerId {
+		t.Fatalf("Instances without a runner should be taken over, got %q", instance.Runner_Id)
+	}
+	if _, ok := ds.State.InstanceTimeout(legacy.Instance_Id); !ok || ds.State.Ports.Count(target) != 1 {
+		t.Fatal("Instances taken over should be queued and hold their ports")
+	}
+}
+
+func TestReconcileRemovesOrphan(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+
+	b.AddResource(target, backend.Resource{Id: "orphan", Name: "chall_1", Instance_Id: 1000}, ds.RunnerId) //Its instance never made it to the database
+	ds.OrphanGraceSeconds = 3600
+	h.Reconcile()
+	h.Reconcile()
+	if b.Count() != 1 {
+		t.Fatal("Orphans should be left alone during the grace period")
+	}
+
+	ds.OrphanGraceSeconds = 0
+	h.Reconcile()
+	if b.Count() != 0 || b.Stops != 1 {
+		t.Fatalf("Orphans should be removed after the grace period, got %d resources and %d stops", b.Count(), b.Stops)
+	}
+	actions := workers.GetReconcileActions()
+	if len(actions) != 1 || actions[0].Action != "removed_orphan" || actions[0].Resource_Id != "orphan" || actions[0].Instance_Id != 1000 || actions[0].Error != "" {
+		t.Fatalf("The removal should be recorded, got %+v", actions)
+	}
+}
+
+func TestReconcileRelaunchesVanishedInstance(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	instance_id := addInstance(t, h, "alice", challid)
+	instance := getInstance(t, instance_id)
+	if err := b.Stop(*instance, ds.RunnerChallenge{}, false); err != nil { //Removed behind the runner's back
+		t.Fatal(err)
+	}
+
+	h.Reconcile()
+	h.Wait()
+	relaunched := getInstance(t, instance_id)
+	if relaunched.State != ds.InstanceStateRunning || relaunched.Portainer_Id == "" || relaunched.Portainer_Id == instance.Portainer_Id {
+		t.Fatalf("Instance should be running on a new resource, got %+v", relaunched)
+	}
+	if b.Count() != 1 || b.Launches != 2 {
+		t.Fatalf("Instance should be launched again, got %d resources and %d launches", b.Count(), b.Launches)
+	}
+	actions := workers.GetReconcileActions()
+	if len(actions) != 1 || actions[0].Action != "relaunched_instance" || actions[0].Instance_Id != instance_id {
+		t.Fatalf("The relaunch should be recorded, got %+v", actions)
+	}
+
+	h.Reconcile()
+	h.Reconcile()
+	if b.Count() != 1 || b.Launches != 2 || len(workers.GetReconcileActions()) != 1 {
+		t.Fatal("Instances whose resources exist should be left alone")
+	}
+}
+
+func TestReconcileIgnoresOtherRunners(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+
+	b.AddResource(target, backend.Resource{Id: "other", Name: "chall_1", Instance_Id: 1000}, "other-runner")
+	h.Reconcile()
+	h.Reconcile()
+	if b.Count() != 1 || b.Stops != 0 || len(workers.GetReconcileActions()) != 0 {
+		t.Fatalf("Resources of other runners sharing the target should be left alone, got %d resources and %d stops", b.Count(), b.Stops)
+	}
+}
+
+// Returns the number of instances on each of targets
+func instancesPerTarget(targets ...ds.Target) []int {
+	counts := []int{}
+	for _, target := range targets {
+		counts = append(counts, ds.State.Targets.InstanceCount(target))
+	}
+	return counts
+}
+
+func TestReservedResourcesStrategy(t *testing.T) {
+	large, small := ds.Target{Url: "http://large.local"}, ds.Target{Url: "http://small.local"}
+	b := harness.NewFakeBackend()
+	b.Hosts[large] = ds.HostResources{Cpu_Millicores: 4000, Memory_Mb: 8192}
+	b.Hosts[small] = ds.HostResources{Cpu_Millicores: 2000, Memory_Mb: 2048}
+	h := harness.Start(harness.InMemory(), b, large, small)
+	defer h.Close()
+	ds.PortainerBalanceStrategy = "RESERVED_RESOURCES"
+	ch := imageChallenge("chall")
+	ch.Cpu_Millicores, ch.Memory_Mb = 1000, 1024
+	challid := h.AddChallenge(ch)
+
+	//Every instance goes where the largest fraction of CPU and memory stays unreserved, the first target on ties
+	expected := [][]int{{1, 0}, {2, 0}, {2, 1}, {3, 1}, {4, 1}, {4, 2}}
+	for i, counts := range expected {
+		addInstance(t, h, "user"+strconv.Itoa(i), challid)
+		if got := instancesPerTarget(large, small); got[0] != counts[0] || got[1] != counts[1] {
+			t.Fatalf("Instance %d: expected %v instances per target, got %v", i, counts, got)
+		}
+	}
+	if status, body := h.Get("/addInstance?userid=overcommit&challid=" + challid); status != 400 {
+		t.Fatalf("Instances that would overcommit every target should be rejected, got %d: %v", status, body)
+	}
+
+	h.ExpireAll()
+	addInstance(t, h, "alice", challid)
+	if got := instancesPerTarget(large, small); got[0] != 1 || got[1] != 0 {
+		t.Fatalf("The resources of removed instances should be released, got %v", got)
+	}
+}
+
+func TestReservedResourcesStrategyUnknownResources(t *testing.T) {
+	known, unknown := ds.Target{Url: "http://known.local"}, ds.Target{Url: "http://unknown.local"}
+	b := harness.NewFakeBackend()
+	b.Hosts[known] = ds.HostResources{Cpu_Millicores: 1000, Memory_Mb: 1024}
+	b.Hosts[unknown] = ds.HostResources{} //Not reported by the backend
+	h := harness.Start(harness.InMemory(), b, unknown, known)
+	defer h.Close()
+	ds.PortainerBalanceStrategy = "RESERVED_RESOURCES"
+	ch := imageChallenge("chall")
+	ch.Cpu_Millicores, ch.Memory_Mb = 1000, 1024
+	challid := h.AddChallenge(ch)
+
+	addInstance(t, h, "alice", challid)
+	if got := instancesPerTarget(unknown, known); got[0] != 0 || got[1] != 1 {
+		t.Fatalf("Targets with unknown resources should be skipped, got %v", got)
+	}
+	if status, body := h.Get("/addInstance?userid=bob&challid=" + challid); status != 400 {
+		t.Fatalf("Targets with unknown resources should not take the instances that do not fit elsewhere, got %d: %v", status, body)
+	}
+
+	b.Hosts[known] = ds.HostResources{}
+	h.CheckHealth()
+	addInstance(t, h, "bob", challid)
+	addInstance(t, h, "carol", challid)
+	if got := instancesPerTarget(unknown, known); got[0] != 2 || got[1] != 1 { //The fewest instances, the first target on ties
+		t.Fatalf("Without the resources of any target, instances should be distributed, got %v", got)
+	}
+}
+
+func TestPortainerReauthentication(t *testing.T) {
+	h, portainer := newPortainerHarness(t)
+	challid := h.AddChallenge(imageChallenge("chall"))
+	logins := portainer.Logins
+
+	portainer.RevokeJWT() //As if Portainer restarted
+	if instance := getInstance(t, addInstance(t, h, "alice", challid)); instance.State != ds.InstanceStateRunning {
+		t.Fatalf("The launch should log in again and succeed, got %+v", instance)
+	}
+	if portainer.Logins != logins+1 {
+		t.Fatalf("Expected a single login, got %d", portainer.Logins-logins)
+	}
+
+	portainer.RevokeJWT()
+	const users = 4
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(userid string) {
+			defer wg.Done()
+			h.Get("/addInstance?userid=" + userid + "&challid=" + challid)
+		}("user" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	h.Wait()
+	if portainer.Count() != users+1 {
+		t.Fatalf("Every launch should succeed after the JWT was revoked, got %d containers", portainer.Count())
+	}
+	if portainer.Logins != logins+2 {
+		t.Fatalf("Concurrent requests rejected at once should wait for a single login, got %d logins", portainer.Logins-logins-1)
+	}
+
+	portainer.RevokeJWT()
+	portainer.Credentials.Password = "changed"
+	if instance := getInstance(t, addInstance(t, h, "bob", challid)); instance.State != ds.InstanceStateFailed {
+		t.Fatalf("The launch should fail if logging in again fails, got %+v", instance)
+	}
+}
+
+func TestPortainerApiKey(t *testing.T) {
+	h, portainer := newPortainerHarness(t, func(portainer *harness.FakePortainer) {
+		portainer.Api_Key = "api-key"
+		portainer.Credentials.Api_Key = "api-key"
+	})
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	if instance := getInstance(t, addInstance(t, h, "alice", challid)); instance.State != ds.InstanceStateRunning {
+		t.Fatalf("Instances should be launched with the API key, got %+v", instance)
+	}
+	portainer.Api_Key = "revoked"
+	if instance := getInstance(t, addInstance(t, h, "bob", challid)); instance.State != ds.InstanceStateFailed {
+		t.Fatalf("The launch should fail once the API key is revoked, got %+v", instance)
+	}
+	if portainer.Logins != 0 {
+		t.Fatalf("Runners with an API key should never log in, got %d logins", portainer.Logins)
+	}
+}
+
+// Returns the health of target from /getStatus
+func getTargetHealth(t *testing.T, h *harness.Harness, target ds.Target) map[string]interface{} {
+	t.Helper()
+	status, body := h.Get("/getStatus")
+	if status != 200 {
+		t.Fatalf("getStatus returned %d: %v", status, body)
+	}
+	for _, health := range body["Targets"].([]interface{}) {
+		health := health.(map[string]interface{})
+		if health["Url"] == target.Url && int(health["Environment_Id"].(float64)) == target.Environment_Id {
+			return health
+		}
+	}
+	t.Fatalf("Target %s is not in getStatus", target.ToString())
+	return nil
+}
+
+func TestUnhealthyTargets(t *testing.T) {
+	down, up := ds.Target{Url: "http://down.local"}, ds.Target{Url: "http://up.local"}
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, down, up)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	b.PingErr[down] = errors.New("connection refused")
+	for i := 1; i < ds.HealthCheckMaxFailures; i++ {
+		h.CheckHealth()
+	}
+	if health := getTargetHealth(t, h, down); health["Healthy"] != true || int(health["Consecutive_Failures"].(float64)) != ds.HealthCheckMaxFailures-1 {
+		t.Fatalf("Targets should stay healthy until Health_Check_Max_Failures checks failed, got %v", health)
+	}
+	h.CheckHealth()
+	if health := getTargetHealth(t, h, down); health["Healthy"] != false || health["Last_Error"] != "connection refused" {
+		t.Fatalf("Target should be unhealthy, got %v", health)
+	}
+
+	for i, strategy := range []string{"RANDOM", "DISTRIBUTE"} { //DISTRIBUTE would pick the first target, which has the fewest instances
+		ds.PortainerBalanceStrategy = strategy
+		for j := 0; j < 4; j++ {
+			addInstance(t, h, "user"+strconv.Itoa(4*i+j), challid)
+		}
+		if got := instancesPerTarget(down, up); got[0] != 0 {
+			t.Fatalf("%s should not launch instances on unhealthy targets, got %v", strategy, got)
+		}
+	}
+
+	b.PingErr[up] = errors.New("connection refused")
+	for i := 0; i < ds.HealthCheckMaxFailures; i++ {
+		h.CheckHealth()
+	}
+	if status, body := h.Get("/addInstance?userid=alice&challid=" + challid); status != 503 {
+		t.Fatalf("Instances should not be added while every target is unhealthy, got %d: %v", status, body)
+	}
+
+	delete(b.PingErr, down)
+	h.CheckHealth()
+	if health := getTargetHealth(t, h, down); health["Healthy"] != true || int(health["Consecutive_Failures"].(float64)) != 0 || health["Last_Error"] != "" {
+		t.Fatalf("Target should be healthy again after a successful check, got %v", health)
+	}
+	addInstance(t, h, "alice", challid)
+	if got := instancesPerTarget(down, up); got[0] != 1 {
+		t.Fatalf("Instances should be launched on targets that recovered, got %v", got)
+	}
+}
+
+func TestLeastLoadedStrategy(t *testing.T) {
+	small, large := ds.Target{Url: "http://small.local"}, ds.Target{Url: "http://large.local"}
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, small, large)
+	defer h.Close()
+	creds.PortainerCreds[small.Url] = ds.ThirdPartyCredentialsJson{Url: small.Url, Max_Instances: 2}
+	creds.PortainerCreds[large.Url] = ds.ThirdPartyCredentialsJson{Url: large.Url, Max_Instances: 6}
+	ds.PortainerBalanceStrategy = "LEAST_LOADED"
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	//Every instance goes to the target using the smallest fraction of its Max_Instances, the first target on ties
+	expected := [][]int{{1, 0}, {1, 1}, {1, 2}, {1, 3}, {2, 3}, {2, 4}, {2, 5}, {2, 6}}
+	for i, counts := range expected {
+		addInstance(t, h, "user"+strconv.Itoa(i), challid)
+		if got := instancesPerTarget(small, large); got[0] != counts[0] || got[1] != counts[1] {
+			t.Fatalf("Instance %d: expected %v instances per target, got %v", i, counts, got)
+		}
+	}
+	status, body := h.Get("/addInstance?userid=full&challid=" + challid)
+	if status != 400 || !strings.Contains(body["Error"].(string), "No capacity") {
+		t.Fatalf("Instances should be rejected once every target is full, got %d: %v", status, body)
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	light, heavy := ds.Target{Url: "http://light.local"}, ds.Target{Url: "http://heavy.local"}
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, light, heavy)
+	defer h.Close()
+	creds.PortainerCreds[light.Url] = ds.ThirdPartyCredentialsJson{Url: light.Url} //Defaults to a Weight of 1
+	creds.PortainerCreds[heavy.Url] = ds.ThirdPartyCredentialsJson{Url: heavy.Url, Weight: 5}
+	ds.PortainerBalanceStrategy = "WEIGHTED"
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	for i := 0; i < 60; i++ {
+		addInstance(t, h, "user"+strconv.Itoa(i), challid)
+	}
+	if got := instancesPerTarget(light, heavy); got[0] == 0 || got[1] <= got[0] || got[0]+got[1] != 60 { //10 and 50 on average
+		t.Fatalf("Instances should be added in proportion to the Weight of the targets, got %v", got)
+	}
+
+	creds.PortainerCreds[light.Url] = ds.ThirdPartyCredentialsJson{Url: light.Url, Max_Instances: ds.State.Targets.InstanceCount(light)}
+	for i := 60; i < 70; i++ {
+		addInstance(t, h, "user"+strconv.Itoa(i), challid)
+	}
+	if got := instancesPerTarget(light, heavy); got[0]+got[1] != 70 || got[0] != creds.PortainerCreds[light.Url].Max_Instances {
+		t.Fatalf("Full targets should be skipped whatever their Weight, got %v", got)
+	}
+}
+
+func TestPortsPerTarget(t *testing.T) {
+	first, second := ds.Target{Url: "http://first.local"}, ds.Target{Url: "http://second.local"}
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, first, second)
+	defer h.Close()
+	ds.State.Ports.SetRange(first, 30000, 30001)
+	ds.State.Ports.SetRange(second, 30000, 30000)
+	ds.ReservedPorts[30001] = true
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	alice := getInstance(t, addInstance(t, h, "alice", challid))
+	bob := getInstance(t, addInstance(t, h, "bob", challid))
+	if alice.GetTarget() != first || bob.GetTarget() != second {
+		t.Fatalf("Expected an instance on each target, got %s and %s", alice.GetTarget().ToString(), bob.GetTarget().ToString())
+	}
+	if alice.Ports_Used != "30000" || bob.Ports_Used != "30000" {
+		t.Fatalf("Every target should allocate from its own range (without reserved ports), got %s and %s", alice.Ports_Used, bob.Ports_Used)
+	}
+
+	status, body := h.Get("/addInstance?userid=carol&challid=" + challid)
+	if status != 503 || !strings.Contains(body["Error"].(string), "No ports") {
+		t.Fatalf("Instances should be rejected once the ports of the target are exhausted, got %d: %v", status, body)
+	}
+	if len(api_sql.GetInstances()) != 2 || ds.State.Targets.InstanceCount(first) != 1 {
+		t.Fatal("Nothing should be added for instances without ports")
+	}
+
+	h.ExpireAll()
+	if carol := getInstance(t, addInstance(t, h, "carol", challid)); carol.Ports_Used != "30000" {
+		t.Fatalf("Ports of expired instances should be allocated again, got %s", carol.Ports_Used)
+	}
+}
+
+func TestPortConflict(t *testing.T) {
+	b := harness.NewFakeBackend()
+	h := harness.Start(harness.InMemory(), b, target)
+	defer h.Close()
+	challid := h.AddChallenge(imageChallenge("chall"))
+
+	ds.State.Ports.SetRange(target, 30000, 30001)
+	b.Foreign[target] = []int{30000}                  //Taken by something else since the last health check
+	ds.State.Ports.SetPublished(target, []int{30001}) //The stale snapshot of the published ports, so that 30000 is allocated first
+	instance := getInstance(t, addInstance(t, h, "alice", challid))
+	if instance.State != ds.InstanceStateRunning || instance.Ports_Used != "30001" {
+		t.Fatalf("The launch should be retried on ports that are free on the host, got %+v", instance)
+	}
+	if ds.State.Ports.Count(target) != 1 {
+		t.Fatalf("The conflicting port should be released, got %d ports in use", ds.State.Ports.Count(target))
+	}
+	h.ExpireAll()
+
+	h.CheckHealth() //Refreshes the published ports
+	if instance := getInstance(t, addInstance(t, h, "alice", challid)); instance.Ports_Used != "30001" {
+		t.Fatalf("Ports published on the host should not be allocated, got %s", instance.Ports_Used)
+	}
+	h.ExpireAll()
+
+	b.Foreign[target] = []int{30000, 30001}
+	ds.State.Ports.SetPublished(target, nil)
+	instance = getInstance(t, addInstance(t, h, "bob", challid))
+	if instance.State != ds.InstanceStateFailed || !strings.Contains(instance.Failure_Reason, "already allocated") {
+		t.Fatalf("The instance should fail once no port is left on the host, got %+v", instance)
+	}
+	if ds.State.Ports.Count(target) != 0 {
+		t.Fatalf("The ports of the failed instance should be released, got %d ports in use", ds.State.Ports.Count(target))
+	}
+}
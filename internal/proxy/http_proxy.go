@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+//Serves the HTTP reverse proxy on ds.HttpProxyPort, routing <token>.<ds.HttpProxyDomain> to the instance's port
+func ServeHttp() {
+	log.Info("HTTP Proxy Started on port", ds.HttpProxyPort)
+	err := http.ListenAndServe(":"+strconv.Itoa(ds.HttpProxyPort), HttpHandler())
+	if err != nil {
+		panic(err)
+	}
+}
+
+func HttpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.Host
+		if host, _, err := net.SplitHostPort(hostname); err == nil {
+			hostname = host
+		}
+
+		route, ok := GetHttpRoute(hostname)
+		if !ok {
+			http.Error(w, "No such instance, it may have expired", http.StatusNotFound)
+			return
+		}
+
+		if presented := r.URL.Query().Get(AccessTokenName); presented != "" && route.Authorized(presented) { //Log in, then hide the token from the address bar
+			http.SetCookie(w, &http.Cookie{Name: AccessTokenName, Value: presented, Path: "/", HttpOnly: true})
+			query := r.URL.Query()
+			query.Del(AccessTokenName)
+			r.URL.RawQuery = query.Encode()
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+		if !route.Authorized(getHttpAccessToken(r)) {
+			http.Error(w, "Missing or invalid access token, open the URL from the runner again", http.StatusUnauthorized)
+			return
+		}
+		removeHttpAccessToken(r) //The instance must not see the token, so that it cannot be stolen by the challenge
+
+		reverse_proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: route.Upstream})
+		reverse_proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debug("Unable to proxy to Instance", route.Instance_Id, err)
+			http.Error(w, "The instance is not reachable, it may still be starting", http.StatusBadGateway)
+		}
+		reverse_proxy.ServeHTTP(w, r)
+	})
+}
+
+//Query parameter, cookie and header (as X-Runner-Token) that users present the access token in
+const AccessTokenName = "runner_token"
+const accessTokenHeader = "X-Runner-Token"
+
+func getHttpAccessToken(r *http.Request) string {
+	if token := r.Header.Get(accessTokenHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(AccessTokenName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func removeHttpAccessToken(r *http.Request) {
+	r.Header.Del(accessTokenHeader)
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != AccessTokenName {
+			r.AddCookie(cookie)
+		}
+	}
+}
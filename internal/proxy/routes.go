@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"runner/internal/ds"
+)
+
+type Route struct {
+	Instance_Id  int
+	Upstream     string //host:port that the instance's port is published on
+	Access_Token string //Secret that users must present before traffic is forwarded, "" for instances launched before access tokens were introduced
+}
+
+var routesLock sync.RWMutex
+var httpRoutes map[string]Route = make(map[string]Route) //Hostname -> Route
+var tcpRoutes map[string]Route = make(map[string]Route)  //SNI Hostname -> Route
+
+//Returns a random token that is used as the subdomain of an instance
+func NewToken() string {
+	return randomHex(8)
+}
+
+//Returns a random secret that users must present to the proxies to reach an instance
+func NewAccessToken() string {
+	return randomHex(16)
+}
+
+func randomHex(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//Returns true if presented is the access token of route
+func (route Route) Authorized(presented string) bool {
+	if route.Access_Token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(route.Access_Token)) == 1
+}
+
+//Returns the hostname of the index-th port of the instance with token, i.e. <token>.<domain> for the first port and <token>-<index>.<domain> otherwise
+func Hostname(token string, index int, domain string) string {
+	if index == 0 {
+		return token + "." + domain
+	}
+	return token + "-" + strconv.Itoa(index) + "." + domain
+}
+
+func HttpEnabled() bool {
+	return ds.HttpProxyPort != 0
+}
+
+//Returns the URL that users should open to reach the index-th port of the instance with token, which logs them in with access_token
+func HttpUrl(token string, index int, access_token string) string {
+	url := ds.HttpProxyScheme + "://" + Hostname(token, index, ds.HttpProxyDomain) + "/"
+	if access_token != "" {
+		url += "?" + AccessTokenName + "=" + access_token
+	}
+	return url
+}
+
+func TcpEnabled() bool {
+	return ds.TcpProxyPort != 0
+}
+
+//Returns true if ports of port_type are reached through one of the proxies rather than directly
+func Proxied(port_type string) bool {
+	return (port_type == "http" && HttpEnabled()) || ((port_type == "nc" || port_type == "ssh") && TcpEnabled())
+}
+
+//Returns the command that users should run to connect to the index-th port of the instance with token through the TCP proxy, presenting access_token as an ALPN protocol
+func TcpConnection(token string, index int, port_type string, access_token string) string {
+	hostname := Hostname(token, index, ds.TcpProxyDomain)
+	openssl := "openssl s_client -quiet -connect " + hostname + ":" + strconv.Itoa(ds.TcpProxyPublicPort) + " -servername " + hostname
+	if access_token != "" {
+		openssl += " -alpn " + AlpnPrefix + access_token
+	}
+	if port_type == "ssh" {
+		return "ssh -o ProxyCommand=\"" + openssl + "\" " + hostname
+	}
+	return openssl //Or (echo access_token; cat) | ncat --ssl hostname port
+}
+
+func AddHttpRoute(hostname string, route Route) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	httpRoutes[strings.ToLower(hostname)] = route
+}
+
+func GetHttpRoute(hostname string) (Route, bool) {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	route, ok := httpRoutes[strings.ToLower(hostname)]
+	return route, ok
+}
+
+func AddTcpRoute(hostname string, route Route) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	tcpRoutes[strings.ToLower(hostname)] = route
+}
+
+func GetTcpRoute(hostname string) (Route, bool) {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	route, ok := tcpRoutes[strings.ToLower(hostname)]
+	return route, ok
+}
+
+//Removes every route to the instance, so that it can no longer be reached through the proxy
+func RemoveInstanceRoutes(instance_id int) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	for _, routes := range []map[string]Route{httpRoutes, tcpRoutes} {
+		for hostname, route := range routes {
+			if route.Instance_Id == instance_id {
+				delete(routes, hostname)
+			}
+		}
+	}
+}
+
+func ClearRoutes() {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	httpRoutes = make(map[string]Route)
+	tcpRoutes = make(map[string]Route)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+var tcpHandshakeTimeout = 10 * time.Second //Also the time that clients without ALPN have to send their access token
+
+//ALPN protocol that users present the access token in, i.e. runner-<access token>
+const AlpnPrefix = "runner-"
+
+//Serves the TLS gateway on ds.TcpProxyPort, routing connections by their SNI hostname (<token>.<ds.TcpProxyDomain>) to the instance's port
+func ServeTcp() {
+	certificate, err := tls.LoadX509KeyPair(ds.ConfigFolderPath+ds.PS+ds.TcpProxyCert, ds.ConfigFolderPath+ds.PS+ds.TcpProxyKey)
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(ds.TcpProxyPort))
+	if err != nil {
+		panic(err)
+	}
+	log.Info("TCP Proxy Started on port", ds.TcpProxyPort)
+	ServeTcpListener(listener, certificate)
+}
+
+//Accepts connections on listener until it is closed
+func ServeTcpListener(listener net.Listener, certificate tls.Certificate) {
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) { //Accept the access token as an ALPN protocol, as the protocols have to be known before the handshake
+		client_config := config.Clone()
+		client_config.GetConfigForClient = nil
+		for _, protocol := range hello.SupportedProtos {
+			if strings.HasPrefix(protocol, AlpnPrefix) {
+				client_config.NextProtos = []string{protocol}
+				break
+			}
+		}
+		return client_config, nil
+	}
+	tls_listener := tls.NewListener(listener, config)
+	for {
+		conn, err := tls_listener.Accept()
+		if err != nil {
+			log.Debug("TCP Proxy stopped", err)
+			return
+		}
+		go handleTcpConnection(conn.(*tls.Conn))
+	}
+}
+
+func handleTcpConnection(conn *tls.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Debug("TLS handshake failed", err)
+		return
+	}
+
+	route, ok := GetTcpRoute(conn.ConnectionState().ServerName)
+	if !ok {
+		return
+	}
+
+	presented := strings.TrimPrefix(conn.ConnectionState().NegotiatedProtocol, AlpnPrefix)
+	var reader io.Reader = conn
+	if presented == "" && route.Access_Token != "" { //Clients without ALPN (E.g. ncat) send the access token as the first line instead
+		buffered := bufio.NewReader(conn)
+		line, err := buffered.ReadString('\n')
+		if err != nil {
+			return
+		}
+		presented = strings.TrimSpace(line)
+		reader = buffered
+	}
+	conn.SetDeadline(time.Time{})
+	if !route.Authorized(presented) {
+		conn.Write([]byte("Missing or invalid access token\n"))
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", route.Upstream, tcpHandshakeTimeout)
+	if err != nil {
+		log.Debug("Unable to proxy to Instance", route.Instance_Id, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, reader)
+		if tcp_upstream, ok := upstream.(*net.TCPConn); ok { //Let the instance know that the user is done sending
+			tcp_upstream.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
@@ -0,0 +1,47 @@
+package workers
+
+import (
+	"time"
+
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/log"
+)
+
+//Periodically pings every target, so that unhealthy targets are excluded from scheduling until they recover, and refreshes the resources of healthy targets
+func HealthCheckWorker() {
+	tick := time.Tick(time.Duration(ds.HealthCheckSecondsPerCheck) * time.Second)
+	for range tick {
+		CheckTargetHealth()
+	}
+}
+
+func CheckTargetHealth() {
+	for _, target := range creds.PortainerTargets {
+		err := backend.Active.Ping(target)
+		ds.State.Targets.RecordHealthCheck(target, err)
+		if err != nil {
+			continue
+		}
+
+		resources, err := backend.Active.Info(target)
+		if err != nil {
+			log.Warn("Unable to get resources of target", target.ToString(), err)
+			continue
+		}
+		ds.State.Targets.SetHostResources(target, resources)
+
+		refreshPublishedPorts(target)
+	}
+}
+
+//Fetches the ports published on target, so that ports taken by containers the runner did not launch are skipped
+func refreshPublishedPorts(target ds.Target) {
+	ports, err := backend.Active.PublishedPorts(target)
+	if err != nil {
+		log.Warn("Unable to get published ports of target", target.ToString(), err)
+		return
+	}
+	ds.State.Ports.SetPublished(target, ports)
+}
@@ -1,13 +1,16 @@
 package workers
 
 import (
+	"errors"
 	"time"
 
-	"runner/internal/api_portainer"
+	"gorm.io/gorm"
+
 	"runner/internal/api_sql"
-	"runner/internal/creds"
+	"runner/internal/backend"
 	"runner/internal/ds"
 	"runner/internal/log"
+	"runner/internal/proxy"
 )
 
 //
@@ -77,48 +80,92 @@ func ClearInstanceQueue() {
 	// too much log spam
 	// log.Info("Kill Worker", current_timestamp)
 
-	for !ds.InstanceQueue.Empty() {
-		it := ds.InstanceQueue.Iterator()
-		it.Next()
-		timestamp, InstanceId := it.Key().(int64), it.Value().(int)
-
-		if timestamp > current_timestamp {
+	for {
+		InstanceId, ok := ds.State.PopExpiredInstance(current_timestamp)
+		if !ok {
 			break
 		}
 
 		log.Info("Clearing Instance", InstanceId)
 
 		instance, err := api_sql.GetInstance(InstanceId)
-		if instance == nil {
-			// instance doesn't exist; let's remove from our internal queue
-			ds.InstanceQueue.Remove(timestamp)
-		} else if err != nil {
-			panic(err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// instance doesn't exist; it was already removed from our internal queue
+		} else if err != nil { //E.g. the database is unreachable, so try again later instead of forgetting about the instance
+			log.Warn("Unable to read Instance", InstanceId, "retrying later", err)
+			ds.State.QueueInstance(current_timestamp+killRetryNanoseconds, InstanceId)
 		} else {
 			KillInstance(*instance)
-			ds.InstanceQueue.Remove(timestamp)
 		}
 
 	}
 }
 
-func KillInstance(instance ds.Instance) {
+//Instances that could not be stopped are retried after this delay
+var killRetryNanoseconds int64 = 30 * 1e9
+
+var ErrInstanceStopping = errors.New("instance is already being stopped by another request")
+
+func KillInstance(instance ds.Instance) error {
+	return killInstance(instance, false)
+}
+
+//Unlike KillInstance, deletes the instance even if the backend fails to stop it, leaving its resources to the reconciler
+func ForceKillInstance(instance ds.Instance) error {
+	return killInstance(instance, true)
+}
+
+func killInstance(instance ds.Instance, force bool) error {
 	log.Info("Clearing Instance", instance.Instance_Id)
+	defer notifyUser(instance.Usr_Id)
 
-	api_sql.DeleteInstance(instance.Instance_Id)
+	for instance.State != ds.InstanceStateStopping && instance.State != ds.InstanceStateFailed { //Instances that are already stopping are being retried after a failed stop
+		err := api_sql.SetInstanceState(instance.Instance_Id, instance.State, ds.InstanceStateStopping, "")
+		if err == nil {
+			notifyUser(instance.Usr_Id)
+			break
+		} else if !errors.Is(err, api_sql.ErrStateChanged) {
+			return err
+		}
 
-	if api_sql.GetRunnerChallenge(instance.Challenge_Id).Docker_Compose {
-		api_portainer.DeleteStack(instance.Portainer_Url, instance.Portainer_Id)
-	} else {
-		api_portainer.DeleteContainer(instance.Portainer_Url, instance.Portainer_Id)
+		current, _ := api_sql.GetInstance(instance.Instance_Id) //The instance changed since it was read, E.g. from starting to running, so try again with its current state
+		if current == nil { //Another request already killed the instance
+			return nil
+		} else if current.State == ds.InstanceStateStopping { //Another request is killing the instance
+			log.Warn("Not clearing Instance", instance.Instance_Id, "it is already stopping")
+			return ErrInstanceStopping
+		}
+		instance = *current
 	}
+	ds.State.DequeueInstance(instance.Instance_Id) //Only once the instance is stopping, so that it is still killed when it expires if the state changes
 
-	creds.DecrementPortainerQueue(instance.Portainer_Url)
-
-	a, _ := ds.InstanceQueue.GetKey(instance.Instance_Id)
-	ds.InstanceQueue.Remove(a)
+	if instance.State == ds.InstanceStateFailed { //Resources of failed instances were already released when the launch failed
+		api_sql.DeleteInstance(instance.Instance_Id)
+		return nil
+	}
+	proxy.RemoveInstanceRoutes(instance.Instance_Id)
+
+	if instance.Portainer_Id != "" { //Instances that are still launching are stopped once the launch completes
+		err := backend.Active.Stop(instance, api_sql.GetRunnerChallenge(instance.Challenge_Id), !force) //Forced kills do not wait for the containers to exit
+		if err != nil && !errors.Is(err, backend.ErrNotFound) && force {
+			log.Warn("Unable to stop Instance", instance.Instance_Id, "removing it anyway", err)
+		} else if err != nil && !errors.Is(err, backend.ErrNotFound) { //Keep the instance (and its resources) around, so that the Kill Worker tries again later
+			log.Warn("Unable to stop Instance", instance.Instance_Id, err)
+			retry_timestamp := ds.State.QueueInstance(time.Now().UnixNano()+killRetryNanoseconds, instance.Instance_Id)
+			api_sql.UpdateInstanceTime(instance.Instance_Id, retry_timestamp)
+			return err
+		}
+	}
 
-	for _, v := range api_sql.DeserializeI(instance.Ports_Used) {
-		delete(ds.UsedPorts, v)
+	if api_sql.DeleteInstance(instance.Instance_Id) { //Otherwise, another request already deleted the instance and released its resources
+		releaseInstanceResources(instance)
 	}
+	return nil
+}
+
+func releaseInstanceResources(instance ds.Instance) {
+	ds.State.Targets.DecrementInstanceCount(instance.GetTarget())
+	ds.State.Targets.ReleaseResources(instance.Instance_Id)
+
+	ds.State.Ports.Release(instance.GetTarget(), api_sql.DeserializeI(instance.Ports_Used))
 }
@@ -0,0 +1,201 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/log"
+	"runner/internal/proxy"
+)
+
+type launchRequest struct {
+	instance     ds.Instance
+	discriminant string
+}
+
+var launchQueue chan launchRequest
+
+//Tracks the work that requests leave running in the background (launches, /extendTimeLeft and /removeChallenge), so that tests can wait for it.
+//nil outside of tests, see internal/harness
+var Background interface {
+	Add(delta int)
+	Done()
+}
+
+func startBackground() {
+	if Background != nil {
+		Background.Add(1)
+	}
+}
+
+func finishBackground() {
+	if Background != nil {
+		Background.Done()
+	}
+}
+
+//Starts ds.MaxConcurrentLaunches workers that launch queued instances, so that slow launches do not block /addInstance
+func StartLaunchWorkers() {
+	if launchQueue != nil { //Stop the previous workers
+		close(launchQueue)
+	}
+	launchQueue = make(chan launchRequest, ds.MaxInstanceCount+1) //There can never be more pending instances than instances
+	for i := 0; i < ds.MaxConcurrentLaunches; i++ {
+		go launchWorker(launchQueue) //Not the variable, which is replaced when the workers are restarted
+	}
+	log.Info("Launch Workers Started:", ds.MaxConcurrentLaunches)
+}
+
+func launchWorker(queue chan launchRequest) {
+	for request := range queue {
+		launchRecovered(request)
+	}
+}
+
+//Launches the instance, failing it instead of crashing the runner if the launch panics
+func launchRecovered(request launchRequest) {
+	defer finishBackground()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Launch of Instance", request.instance.Instance_Id, "panicked", r)
+			if instance, _ := api_sql.GetInstance(request.instance.Instance_Id); instance != nil && instance.State == ds.InstanceStateStarting { //Re-read, as the launch may have moved the instance to other ports
+				failInstance(*instance, fmt.Sprint("The launch failed unexpectedly: ", r))
+			}
+		}
+	}()
+
+	launchInstance(request.instance, request.discriminant)
+}
+
+func QueueLaunch(instance ds.Instance, discriminant string) {
+	startBackground()
+	launchQueue <- launchRequest{instance: instance, discriminant: discriminant}
+}
+
+func launchInstance(instance ds.Instance, discriminant string) { //Run Async
+	log.Debug("Start Launch", instance.Instance_Id)
+	defer notifyUser(instance.Usr_Id)
+
+	if err := api_sql.SetInstanceState(instance.Instance_Id, ds.InstanceStatePending, ds.InstanceStateStarting, ""); err != nil { //The instance was killed before it could be launched
+		log.Warn("Not launching Instance", instance.Instance_Id, err)
+		return
+	}
+	notifyUser(instance.Usr_Id)
+
+	ch := api_sql.GetRunnerChallenge(instance.Challenge_Id)
+	PortainerId := ""
+	options, err := launchOptions(instance, ch)
+	if err == nil { //Otherwise, a secret env variable cannot be decrypted or the flag cannot be generated, and the instance fails below
+		PortainerId, err = backend.Active.Launch(instance.GetTarget(), ch, api_sql.DeserializeI(instance.Ports_Used), discriminant, options)
+	}
+	for attempt := 0; errors.Is(err, backend.ErrPortConflict) && attempt < ds.PortConflictMaxRetries; attempt++ { //Something else took the ports on the host, try again on other ports
+		log.Warn("Ports of Instance", instance.Instance_Id, "are already in use, retrying on new ports", err)
+		if !reallocatePorts(&instance) {
+			break
+		}
+		notifyUser(instance.Usr_Id)
+		PortainerId, err = backend.Active.Launch(instance.GetTarget(), ch, api_sql.DeserializeI(instance.Ports_Used), strconv.FormatInt(time.Now().UnixNano(), 10), options)
+	}
+	if err != nil {
+		log.Warn("Unable to launch Instance", instance.Instance_Id, err)
+		failInstance(instance, err.Error())
+		return
+	}
+
+	log.Debug("Instance ID:", instance.Instance_Id)
+	log.Debug("Portainer ID:", PortainerId)
+
+	api_sql.SetInstancePortainerId(instance.Instance_Id, PortainerId) //Update PortainerId once it's available
+	instance.Portainer_Id = PortainerId
+
+	addProxyRoutes(instance, ch) //Before the instance is running, so that a kill right after it is running always removes them
+	if err := api_sql.SetInstanceState(instance.Instance_Id, ds.InstanceStateStarting, ds.InstanceStateRunning, ""); err != nil { //The instance was killed during the launch, so nothing else will stop it
+		log.Warn("Instance", instance.Instance_Id, "was killed while launching, stopping it", err)
+		proxy.RemoveInstanceRoutes(instance.Instance_Id)
+		if err := backend.Active.Stop(instance, ch, false); err != nil {
+			log.Warn("Unable to stop Instance", instance.Instance_Id, err)
+		}
+		return
+	}
+
+	log.Debug("Finish Launch", instance.Instance_Id)
+}
+
+//Marks the starting instance as failed with reason, so that the user sees why it did not launch
+func failInstance(instance ds.Instance, reason string) {
+	if api_sql.SetInstanceState(instance.Instance_Id, ds.InstanceStateStarting, ds.InstanceStateFailed, reason) == nil { //Otherwise, the instance was killed during the launch and its resources have already been released
+		releaseInstanceResources(instance)
+	}
+}
+
+//Returns the data that is passed into the containers of the instance, i.e. the env, limits and egress policy of the challenge and the user's flag
+func launchOptions(instance ds.Instance, ch ds.RunnerChallenge) (backend.LaunchOptions, error) {
+	options := backend.LaunchOptions{Instance_Id: instance.Instance_Id, Env: make(map[string]string), Files: make(map[string]string), Limits: ch.GetContainerLimits(), Egress: ch.GetEgressPolicy(), Labels: backend.InstanceLabels(instance)}
+	for name, value := range ch.Env {
+		if value.Secret {
+			plaintext, err := creds.DecryptSecret(value.Value)
+			if err != nil {
+				return options, errors.New("env variable " + name + ": " + err.Error())
+			}
+			value.Value = plaintext
+		}
+		options.Env[name] = value.Value
+	}
+	if ds.PublishedHostIp != "" { //Ports that are only reached through a proxy do not need to be public
+		for _, port_type := range api_sql.Deserialize(ch.Port_Types, ",") {
+			if proxy.Proxied(port_type) {
+				options.HostIps = append(options.HostIps, ds.PublishedHostIp)
+			} else {
+				options.HostIps = append(options.HostIps, "")
+			}
+		}
+	}
+	if ch.Flag_Template != "" { //The flag overrides an env variable of the same name
+		flag, err := creds.GenerateFlag(ch, instance.Usr_Id)
+		if err != nil { //The challenge was added before flag templates were validated
+			return options, err
+		}
+		if ch.Flag_Env != "" {
+			options.Env[ch.Flag_Env] = flag
+		}
+		if ch.Flag_File != "" {
+			if options.Limits.Read_Only_Rootfs && copiesFiles(ch) { //E.g. Default_Read_Only_Rootfs was turned on after the challenge was added
+				return options, errors.New("flag_file cannot be used with a read-only root filesystem by the " + ds.Backend + " backend")
+			}
+			options.Files[ch.Flag_File] = flag + "\n"
+		}
+	}
+	return options, nil
+}
+
+//Files are copied into the containers of ch before they start (rather than mounted), which fails if their root filesystem is read-only
+func copiesFiles(ch ds.RunnerChallenge) bool {
+	return ds.Backend == "DOCKER" || (ds.Backend == "PORTAINER" && !ch.Docker_Compose)
+}
+
+//Moves the instance to new ports, skipping the ports currently published on its target. Returns false if the instance cannot be moved
+func reallocatePorts(instance *ds.Instance) bool {
+	target := instance.GetTarget()
+	refreshPublishedPorts(target)
+
+	old_ports := api_sql.DeserializeI(instance.Ports_Used)
+	new_ports, err := ds.State.Ports.Allocate(target, len(old_ports)) //The old ports are still held, so they cannot be handed out again
+	if err != nil {
+		log.Warn("Unable to reallocate ports of Instance", instance.Instance_Id, err)
+		return false
+	}
+	if err := api_sql.SetStartingInstancePorts(instance.Instance_Id, api_sql.SerializeI(new_ports, ",")); err != nil { //The instance was killed, and its old ports are released by the kill
+		log.Warn("Not reallocating ports of Instance", instance.Instance_Id, err)
+		ds.State.Ports.Release(target, new_ports)
+		return false
+	}
+	ds.State.Ports.Release(target, old_ports)
+	instance.Ports_Used = api_sql.SerializeI(new_ports, ",")
+	return true
+}
@@ -0,0 +1,46 @@
+package workers
+
+import (
+	"net"
+	"strconv"
+
+	"runner/internal/api_sql"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/proxy"
+)
+
+//Routes the http ports of the instance through the HTTP proxy, and its nc and ssh ports through the TCP proxy
+func addProxyRoutes(instance ds.Instance, ch ds.RunnerChallenge) {
+	if instance.Proxy_Token == "" {
+		return
+	}
+
+	host := creds.GetPublicHost(instance.Portainer_Url)
+	if ds.PublishedHostIp != "" { //Proxied ports are only published on this IP, see launchOptions
+		host = ds.PublishedHostIp
+	}
+	port_types := api_sql.Deserialize(ch.Port_Types, ",")
+	for i, port := range api_sql.DeserializeI(instance.Ports_Used) {
+		if i >= len(port_types) {
+			break
+		}
+		route := proxy.Route{Instance_Id: instance.Instance_Id, Upstream: net.JoinHostPort(host, strconv.Itoa(port)), Access_Token: instance.Access_Token}
+		switch {
+		case port_types[i] == "http" && proxy.HttpEnabled():
+			proxy.AddHttpRoute(proxy.Hostname(instance.Proxy_Token, i, ds.HttpProxyDomain), route)
+		case (port_types[i] == "nc" || port_types[i] == "ssh") && proxy.TcpEnabled():
+			proxy.AddTcpRoute(proxy.Hostname(instance.Proxy_Token, i, ds.TcpProxyDomain), route)
+		}
+	}
+}
+
+//Routes every running instance through the proxy, E.g. after the runner restarts
+func RestoreProxyRoutes() {
+	proxy.ClearRoutes()
+	for _, instance := range api_sql.GetInstances() {
+		if instance.State == ds.InstanceStateRunning {
+			addProxyRoutes(instance, api_sql.GetRunnerChallenge(instance.Challenge_Id))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package workers
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"runner/internal/api_sql"
+	"runner/internal/backend"
+	"runner/internal/creds"
+	"runner/internal/ds"
+	"runner/internal/log"
+	"runner/internal/proxy"
+)
+
+//Periodically compares the resources on every target with the instances in the database, removing resources without an instance (E.g. if the runner stopped during a launch, or a stop failed after the instance was deleted) and relaunching instances whose resources vanished
+func ReconcileWorker() {
+	tick := time.Tick(time.Duration(ds.ReconcileSecondsPerCheck) * time.Second)
+	for range tick {
+		Reconcile()
+	}
+}
+
+var reconcileLock sync.Mutex
+var orphanFirstSeen map[string]int64 = make(map[string]int64) //Target + Resource_Id -> Unix (Nano) timestamp of when the resource was first seen without an instance
+
+const maxReconcileActions = 100
+
+var reconcileActionsLock sync.Mutex
+var reconcileActions []ds.ReconcileAction //Most recent last, at most maxReconcileActions
+
+func Reconcile() {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	instances := api_sql.GetRunnerInstances() //Resources are only listed if they have the label of this runner. Read before listing resources, so that instances launched in between are only orphans until the grace period is over
+	instance_ids := make(map[int]bool)
+	for _, instance := range instances {
+		instance_ids[instance.Instance_Id] = true
+	}
+
+	orphans := make(map[string]bool)
+	for _, target := range creds.PortainerTargets {
+		if !ds.State.Targets.IsHealthy(target) {
+			continue
+		}
+		resources, err := backend.Active.List(target)
+		if err != nil {
+			log.Warn("Unable to list resources of target", target.ToString(), err)
+			continue
+		}
+		for _, resource := range resources {
+			if !instance_ids[resource.Instance_Id] {
+				key := target.ToString() + " " + resource.Id
+				orphans[key] = true
+				removeOrphan(target, resource, key)
+			}
+		}
+	}
+	for key := range orphanFirstSeen { //The resource was removed or its instance showed up
+		if !orphans[key] {
+			delete(orphanFirstSeen, key)
+		}
+	}
+
+	for _, instance := range instances {
+		if instance.State == ds.InstanceStateRunning && instance.Portainer_Id != "" && ds.State.Targets.IsHealthy(instance.GetTarget()) {
+			relaunchIfVanished(instance)
+		}
+	}
+}
+
+func removeOrphan(target ds.Target, resource backend.Resource, key string) {
+	first_seen, ok := orphanFirstSeen[key]
+	if !ok {
+		log.Info("Resource", resource.Name, "on target", target.ToString(), "has no instance, removing it in", ds.OrphanGraceSeconds, "seconds")
+		orphanFirstSeen[key] = time.Now().UnixNano()
+		return
+	}
+	if time.Now().UnixNano()-first_seen < int64(ds.OrphanGraceSeconds)*1e9 {
+		return
+	}
+
+	log.Info("Removing resource", resource.Name, "on target", target.ToString(), "of Instance", resource.Instance_Id, "which no longer exists")
+	orphan := ds.Instance{Portainer_Url: target.Url, Portainer_Environment_Id: target.Environment_Id, Portainer_Id: resource.Id, Instance_Id: resource.Instance_Id}
+	err := backend.Active.Stop(orphan, ds.RunnerChallenge{Docker_Compose: resource.Stack}, false)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		log.Warn("Unable to remove resource", resource.Name, "on target", target.ToString(), err)
+		recordReconcileAction(target, "removed_orphan", resource.Id, resource.Instance_Id, err)
+		return
+	}
+	delete(orphanFirstSeen, key)
+	recordReconcileAction(target, "removed_orphan", resource.Id, resource.Instance_Id, nil)
+}
+
+func relaunchIfVanished(instance ds.Instance) {
+	ch := api_sql.GetRunnerChallenge(instance.Challenge_Id)
+	if _, err := backend.Active.Inspect(instance, ch); !errors.Is(err, backend.ErrNotFound) {
+		return
+	}
+
+	if err := api_sql.SetInstanceState(instance.Instance_Id, ds.InstanceStateRunning, ds.InstanceStatePending, ""); err != nil { //The instance was killed in the meantime
+		return
+	}
+	log.Warn("Resources of Instance", instance.Instance_Id, "vanished from the backend, relaunching it")
+	proxy.RemoveInstanceRoutes(instance.Instance_Id) //Added again once the instance is running
+	api_sql.SetInstancePortainerId(instance.Instance_Id, "")
+	instance.State = ds.InstanceStatePending
+	instance.Portainer_Id = ""
+	recordReconcileAction(instance.GetTarget(), "relaunched_instance", "", instance.Instance_Id, nil)
+	notifyUser(instance.Usr_Id)
+	QueueLaunch(instance, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+//Forgets every orphan seen and every action recorded so far
+func ClearReconcileState() {
+	reconcileLock.Lock()
+	orphanFirstSeen = make(map[string]int64)
+	reconcileLock.Unlock()
+
+	reconcileActionsLock.Lock()
+	reconcileActions = nil
+	reconcileActionsLock.Unlock()
+}
+
+func recordReconcileAction(target ds.Target, action string, resource_id string, instance_id int, err error) {
+	reconcileActionsLock.Lock()
+	defer reconcileActionsLock.Unlock()
+
+	reconcile_action := ds.ReconcileAction{Timestamp: time.Now().Unix(), Target: target.ToString(), Action: action, Resource_Id: resource_id, Instance_Id: instance_id}
+	if err != nil {
+		reconcile_action.Error = err.Error()
+	}
+	reconcileActions = append(reconcileActions, reconcile_action)
+	if len(reconcileActions) > maxReconcileActions {
+		reconcileActions = reconcileActions[len(reconcileActions)-maxReconcileActions:]
+	}
+}
+
+func GetReconcileActions() []ds.ReconcileAction {
+	reconcileActionsLock.Lock()
+	defer reconcileActionsLock.Unlock()
+
+	return append([]ds.ReconcileAction{}, reconcileActions...)
+}
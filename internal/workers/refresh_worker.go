@@ -18,7 +18,15 @@ func JWTRefreshWorker() {
 		log.Info("JWT Refresh Worker", current_timestamp)
 
 		for _, credentials := range creds.PortainerCreds {
-			creds.PortainerJWT[credentials.Url] = creds.GetPortainerJWT(credentials)
+			if credentials.Api_Key != "" { //API access tokens do not expire
+				continue
+			}
+			jwt, err := creds.GetPortainerJWT(credentials)
+			if err != nil { //Keep using the previous token, which may still be valid
+				log.Warn("Unable to refresh Portainer JWT", credentials.Url, err)
+				continue
+			}
+			creds.SetPortainerJWT(credentials.Url, jwt)
 		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,57 @@
+package workers
+
+import (
+	"sync"
+	"time"
+
+	"runner/internal/ds"
+)
+
+const sseKeepAliveInterval = 15 * time.Second
+
+var userSubscribers map[string]map[chan ds.UserStatus]bool = make(map[string]map[chan ds.UserStatus]bool) //UserId -> {Channels of /getUserStatus/stream requests}
+var userSubscribersLock sync.Mutex
+
+func subscribeUser(userid string) chan ds.UserStatus {
+	userSubscribersLock.Lock()
+	defer userSubscribersLock.Unlock()
+
+	updates := make(chan ds.UserStatus, 8)
+	if userSubscribers[userid] == nil {
+		userSubscribers[userid] = make(map[chan ds.UserStatus]bool)
+	}
+	userSubscribers[userid][updates] = true
+	return updates
+}
+
+func unsubscribeUser(userid string, updates chan ds.UserStatus) {
+	userSubscribersLock.Lock()
+	defer userSubscribersLock.Unlock()
+
+	delete(userSubscribers[userid], updates)
+	if len(userSubscribers[userid]) == 0 {
+		delete(userSubscribers, userid)
+	}
+}
+
+//Sends the user's current status to all of the user's /getUserStatus/stream requests
+func notifyUser(userid string) {
+	userSubscribersLock.Lock()
+	subscribers := []chan ds.UserStatus{} //Copied, so that the DB is queried without holding the lock
+	for updates := range userSubscribers[userid] {
+		subscribers = append(subscribers, updates)
+	}
+	userSubscribersLock.Unlock()
+
+	if len(subscribers) == 0 { //Avoid querying the DB when nobody is listening
+		return
+	}
+
+	status := _getUserStatus(userid)
+	for _, updates := range subscribers { //Channels are never closed, so sending to one that was unsubscribed in the meantime is safe
+		select {
+		case updates <- status:
+		default: //Drop the update rather than block if the client is not keeping up
+		}
+	}
+}
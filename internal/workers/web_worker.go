@@ -2,33 +2,45 @@ package workers
 
 import (
 	"encoding/base64"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"runner/internal/api_portainer"
 	"runner/internal/api_sql"
+	"runner/internal/backend"
 	"runner/internal/creds"
 	"runner/internal/ds"
 	"runner/internal/log"
+	"runner/internal/proxy"
 	"runner/internal/yaml"
 )
 
 func HandleRequests() {
+	NewRouter().Run(":" + strconv.Itoa(ds.RunnerPort))
+}
+
+func NewRouter() *gin.Engine {
 	r := gin.Default()
-	
+
 	r.GET("/addInstance", addInstance)
 	r.GET("/removeInstance", removeInstance)
 	r.GET("/removeInstance/admin", removeInstanceAdmin)
 	r.GET("/getUserStatus", getUserStatus)
+	r.GET("/getUserStatus/stream", getUserStatusStream)
 	r.GET("/extendTimeLeft", extendTimeLeft)
 	r.GET("/addChallenge", addChallenge)
 	r.GET("/removeChallenge", removeChallenge)
 	r.GET("/getStatus", getStatus)
+	r.GET("/verifyFlag", verifyFlag)
 
-	r.Run(":" + strconv.Itoa(ds.RunnerPort))
+	return r
 }
 
 //fmt.Fprintf() - print to web
@@ -40,11 +52,24 @@ func validateUserid(userid string) bool {
 func validateChallid(challid string) bool {
 	valid := api_sql.ValidRunnerChallenge(challid)
 	if valid { //If challid exists in ChallengeMap, check if it is not unsafe to launch
-		return !ds.ChallengeUnsafeToLaunch[challid]
+		return !ds.State.IsChallengeUnsafe(challid)
 	}
 	return false //challid does not exist in ChallengeMap
 }
 
+func backendErrorStatus(err error) int { //HTTP status code to respond with when the backend returns err
+	switch {
+	case errors.Is(err, backend.ErrUnreachable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, backend.ErrAuthExpired), errors.Is(err, backend.ErrImageMissing), errors.Is(err, backend.ErrPortConflict), errors.Is(err, backend.ErrNameConflict):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrInstanceStopping):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func activeUserInstance(userid string) bool {
 	instance := api_sql.GetActiveUserInstance(userid) //TODO: Optimize
 	return instance.Usr_Id != ""
@@ -73,11 +98,18 @@ func addInstance(c *gin.Context) {
 		return
 	}
 
+	ds.State.LockAdmission() //Until the instance is written, so that concurrent requests cannot add more than one instance per user or exceed the max number of instances
+	defer ds.State.UnlockAdmission()
+
 	if activeUserInstance(userid) {
 		c.JSON(http.StatusBadRequest, gin.H{"Error": "User is already running an instance"})
 		return
 	}
 
+	for _, instance := range api_sql.GetFailedUserInstances(userid) { //Failed instances are kept around until the user tries again, so that the failure reason can be shown
+		KillInstance(instance)
+	}
+
 	if api_sql.GetInstanceCount() >= ds.MaxInstanceCount { //Use >= instead of == just in case
 		c.JSON(http.StatusBadRequest, gin.H{"Error": "The max number of instances for the platform has already been reached, try again later"})
 		return
@@ -85,50 +117,63 @@ func addInstance(c *gin.Context) {
 
 	ch := api_sql.GetRunnerChallenge(challid)
 
+	target, err := creds.GetBestPortainer(ch)
+	if errors.Is(err, creds.ErrNoHealthyTargets) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"Error": "No servers are available to launch instances on, try again later"})
+		return
+	}
+	if errors.Is(err, creds.ErrNoCapacity) {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "No capacity: every server is already running its max number of instances (or does not have enough CPU and memory left), try again later"})
+		return
+	}
+
 	var ports ds.PortsInfo
-	ports.Ports_Used = make([]int, ch.Port_Count) //Cannot directly use [ch.PortCount]int
-	for i := 0; i < ch.Port_Count; i++ {
-		ports.Ports_Used[i] = ds.GetRandomPort()
+	ports.Ports_Used, err = ds.State.Ports.Allocate(target, ch.Port_Count)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"Error": "No ports are left on the server, try again later"})
+		return
 	}
-	portainer_url := creds.GetBestPortainer()
-	ports.Host = creds.ExtractHost(portainer_url)
+	ports.Host = creds.GetPublicHost(target.Url)
 	ports.Port_Types = api_sql.Deserialize(ch.Port_Types, ",")
 
-	_addInstance(userid, challid, portainer_url, ports.Ports_Used)
+	instance, err := _addInstance(userid, ch, target, ports.Ports_Used)
+	if err != nil {
+		log.Warn("Unable to write instance of user", userid, err)
+		ds.State.Ports.Release(target, ports.Ports_Used)
+		c.JSON(http.StatusInternalServerError, gin.H{"Error": "Unable to add instance, try again later"})
+		return
+	}
+	ports.Instance_Id = instance.Instance_Id
+	ports.State = instance.State
+	ports.Connections = getConnections(instance, ports.Port_Types)
+	ports.Access_Token = instance.Access_Token
 
 	c.JSON(http.StatusOK, ports)
 }
 
-func _addInstance(userid string, challid string, portainer_url string, Ports []int) { //Run Async
+//Writes the instance to the DB and queues it to be launched, returning the pending instance. Nothing is queued if the instance cannot be written
+func _addInstance(userid string, ch ds.RunnerChallenge, target ds.Target, Ports []int) (ds.Instance, error) {
 	log.Debug("Start /addInstance Request")
-	InstanceId := ds.NextInstanceId
-	ds.NextInstanceId++
 	InstanceTimeout := time.Now().UnixNano() + ds.DefaultNanosecondsPerInstance
-	ds.InstanceQueue.Put(InstanceTimeout, InstanceId) //Use higher precision time to (hopefully) prevent duplicates
 	discriminant := strconv.FormatInt(time.Now().UnixNano(), 10) // prevent container name conflict
-	creds.IncrementPortainerQueue(portainer_url)
-
-    // no longer relevant, since we wait for the response from portainer
-	// instance := ds.Instance{Instance_Id: InstanceId, Usr_Id: userid, Challenge_Id: challid, Portainer_Url: portainer_url, Instance_Timeout: InstanceTimeout, Ports_Used: api_sql.SerializeI(Ports, ",")} //Everything except PortainerId first, to prevent issues when querying getTimeLeft, etc. while the instance is launching
-	// api_sql.AddInstance(instance)
 
-	var PortainerId string
-
-	ch := api_sql.GetRunnerChallenge(challid)
-	if ch.Docker_Compose {
-		new_docker_compose := yaml.DockerComposeCopy(ch.Docker_Compose_File, Ports)
-		PortainerId = api_portainer.LaunchStack(portainer_url, ch.Challenge_Name, new_docker_compose, discriminant)
-	} else {
-		PortainerId = api_portainer.LaunchContainer(portainer_url, ch.Challenge_Name, ch.Image_Name, api_sql.DeserializeNL(ch.Docker_Cmds), ch.Internal_Port, Ports[0], discriminant)
+	instance := ds.Instance{Usr_Id: userid, Challenge_Id: ch.Challenge_Id, Portainer_Url: target.Url, Portainer_Environment_Id: target.Environment_Id, Instance_Timeout: InstanceTimeout, Ports_Used: api_sql.SerializeI(Ports, ","), State: ds.InstanceStatePending, Proxy_Token: proxy.NewToken(), Access_Token: proxy.NewAccessToken()} //Everything except PortainerId first, to prevent issues when querying getTimeLeft, etc. while the instance is launching
+	instance, err := api_sql.AddInstance(instance) //Generates the Instance_Id
+	if err != nil {
+		return ds.Instance{}, err
 	}
 
-	log.Debug("Instance ID:", InstanceId)
-	log.Debug("Portainer ID:", PortainerId)
+	if queued_timeout := ds.State.QueueInstance(InstanceTimeout, instance.Instance_Id); queued_timeout != InstanceTimeout { //Another instance expires at the same time
+		instance.Instance_Timeout = queued_timeout
+		api_sql.UpdateInstanceTime(instance.Instance_Id, queued_timeout)
+	}
+	ds.State.Targets.IncrementInstanceCount(target)
+	ds.State.Targets.ReserveResources(instance.Instance_Id, target, ch.GetResources())
 
-    instance := ds.Instance{Instance_Id: InstanceId, Usr_Id: userid, Challenge_Id: challid, Portainer_Url: portainer_url, Instance_Timeout: InstanceTimeout, Ports_Used: api_sql.SerializeI(Ports, ","), Portainer_Id: PortainerId}
-	api_sql.AddInstance(instance) //Update PortainerId once it's available
+	QueueLaunch(instance, discriminant)
 
 	log.Debug("Finish /addInstance Request")
+	return instance, nil
 }
 
 func removeInstance(c *gin.Context) {
@@ -150,74 +195,131 @@ func removeInstance(c *gin.Context) {
 	}
 
 	instance := api_sql.GetActiveUserInstance(userid)
-	if instance.Portainer_Id == "" {
+	if instance.State == ds.InstanceStatePending || instance.State == ds.InstanceStateStarting {
 		c.JSON(http.StatusBadRequest, gin.H{"Error": "The instance is still starting"})
 		return
 	}
+	if instance.State == ds.InstanceStateStopping {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "The instance is already stopping"})
+		return
+	}
 
-	_removeInstance(userid)
+	if err := _removeInstance(userid); err != nil {
+		c.JSON(backendErrorStatus(err), gin.H{"Error": "Unable to remove instance, it will be removed automatically later: " + err.Error()})
+		return
+	}
 
     log.Debug("returning")
 
 	c.JSON(http.StatusOK, gin.H{"Success": true})
 }
 
-func _removeInstance(userid string) {
+func _removeInstance(userid string) error {
 	log.Debug("Start /removeInstance Request")
 
 	instance := api_sql.GetActiveUserInstance(userid)
 
 	instance.Instance_Timeout = int64(0) // Make sure that the instance will be killed in the next kill cycle
-	api_sql.UpdateInstance(instance)
-
-	_, b := ds.InstanceQueue.GetKey(instance.Instance_Id)
-	if !b {
-		panic("InstanceId is missing in InstanceQueue!")
-	}
-
-    // this causes race condition
-	// ds.InstanceQueue.Remove(a) 
-	// ds.InstanceQueue.Put(int64(0), instance.Instance_Id) // Replace
+	api_sql.UpdateInstanceTime(instance.Instance_Id, instance.Instance_Timeout) //Only update the timeout, as the state may be changed concurrently
 
-    KillInstance(instance)
+	err := KillInstance(instance) //Removes the instance from the InstanceQueue
 
 	log.Debug("Finish /removeInstance Request")
+	return err
 }
 
 func removeInstanceAdmin(c *gin.Context) {
 	log.Debug("Received /removeInstance/admin Request")
 
-	userid, ok := c.GetQuery("userid")
-	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing userid"})
-		return
+	selectors := 0
+	for _, key := range []string{"userid", "instanceid", "challid", "portainer_url"} {
+		if _, ok := c.GetQuery(key); ok {
+			selectors++
+		}
 	}
-	if !validateUserid(userid) {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid userid"})
+	if selectors != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Specify exactly one of userid, instanceid, challid or portainer_url"})
 		return
 	}
+	force := c.Query("force") == "true"
 
-	if !activeUserInstance(userid) {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "User does not have an instance"})
-		return
+	var instances []ds.Instance
+	if userid, ok := c.GetQuery("userid"); ok {
+		if !validateUserid(userid) {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid userid"})
+			return
+		}
+		if !activeUserInstance(userid) {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "User does not have an instance"})
+			return
+		}
+		instances = append(instances, api_sql.GetActiveUserInstance(userid))
+	} else if raw_instance_id, ok := c.GetQuery("instanceid"); ok {
+		instance_id, err := strconv.Atoi(raw_instance_id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid instanceid"})
+			return
+		}
+		instance, err := api_sql.GetInstance(instance_id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Instance does not exist"})
+			return
+		}
+		instances = append(instances, *instance)
+	} else if challid, ok := c.GetQuery("challid"); ok { //Not validated, so that instances of removed challenges can be removed too
+		instances = api_sql.GetChallengeInstances(challid)
+	} else {
+		portainer_url := c.Query("portainer_url")
+		environment_id := -1 //Every environment
+		if raw_environment_id, ok := c.GetQuery("environment_id"); ok {
+			var err error
+			environment_id, err = strconv.Atoi(raw_environment_id)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid environment_id"})
+				return
+			}
+		}
+		for _, instance := range api_sql.GetPortainerInstances(portainer_url) {
+			if environment_id == -1 || instance.Portainer_Environment_Id == environment_id {
+				instances = append(instances, instance)
+			}
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"Success": true})
+	removed, err := _removeInstancesAdmin(instances, force)
+	if err != nil {
+		c.JSON(backendErrorStatus(err), gin.H{"Error": "Unable to remove every instance, the rest will be removed automatically later (or use force): " + err.Error(), "Instance_Ids": removed})
+		return
+	}
 
-	go _removeInstanceAdmin(userid)
+	c.JSON(http.StatusOK, gin.H{"Success": true, "Instance_Ids": removed})
 }
 
-func _removeInstanceAdmin(userid string) { //Run Async
+//Returns the ids of the instances that were removed, and the first error of the instances that could not be stopped
+func _removeInstancesAdmin(instances []ds.Instance, force bool) ([]int, error) {
 	log.Debug("Start /removeInstance/admin Request")
 
-	instance := api_sql.GetActiveUserInstance(userid)
-
-	//Essentially makes the Runner forget that the user is running an instance (bypassing the "User does not have an instance" error)
-	//Note that in reality, the instance spinned up by the user is still running or being created (and will only be automatically deleted when the instance expires)
-	instance.Usr_Id = "" //Make sure the instance is no longer tied to any user id
-	api_sql.UpdateInstance(instance)
+	removed := []int{}
+	var first_err error
+	for _, instance := range instances {
+		var err error
+		if force {
+			err = ForceKillInstance(instance)
+		} else {
+			err = KillInstance(instance)
+		}
+		if err != nil {
+			log.Warn("Unable to remove Instance", instance.Instance_Id, err)
+			if first_err == nil {
+				first_err = err
+			}
+			continue
+		}
+		removed = append(removed, instance.Instance_Id)
+	}
 
 	log.Debug("Finish /removeInstance/admin Request")
+	return removed, first_err
 }
 
 func getUserStatus(c *gin.Context) {
@@ -233,18 +335,83 @@ func getUserStatus(c *gin.Context) {
 		return
 	}
 
+	log.Debug("Start /getUserStatus Request")
+
+	c.JSON(http.StatusOK, _getUserStatus(userid))
+
+	log.Debug("Finish /getUserStatus Request")
+}
+
+func _getUserStatus(userid string) ds.UserStatus {
 	if !activeUserInstance(userid) {
-		c.JSON(http.StatusOK, ds.UserStatus{Running_Instance: false})
+		failed_instances := api_sql.GetFailedUserInstances(userid)
+		if len(failed_instances) > 0 { //Let the user know why their last instance failed to launch
+			instance := failed_instances[0]
+			return ds.UserStatus{Running_Instance: false, Instance_Id: instance.Instance_Id, State: instance.State, Failure_Reason: instance.Failure_Reason, Challenge_Id: instance.Challenge_Id}
+		}
+		return ds.UserStatus{Running_Instance: false}
+	}
+
+	instance := api_sql.GetActiveUserInstance(userid)
+	port_types := api_sql.Deserialize(api_sql.GetRunnerChallenge(instance.Challenge_Id).Port_Types, ",")
+
+	return ds.UserStatus{Running_Instance: true, Instance_Id: instance.Instance_Id, State: instance.State, Challenge_Id: instance.Challenge_Id, Time_Left: int((instance.Instance_Timeout-time.Now().UnixNano())/1e9), Host: creds.GetPublicHost(instance.Portainer_Url), Ports_Used: api_sql.DeserializeI(instance.Ports_Used), Port_Types: port_types, Connections: getConnections(instance, port_types), Access_Token: instance.Access_Token}
+}
+
+//Returns how users should connect to each port of the instance through the proxies (if enabled), or host:port otherwise
+func getConnections(instance ds.Instance, port_types []string) []string {
+	connections := []string{}
+	host := creds.GetPublicHost(instance.Portainer_Url)
+	for i, port := range api_sql.DeserializeI(instance.Ports_Used) {
+		port_type := ""
+		if i < len(port_types) {
+			port_type = port_types[i]
+		}
+		switch {
+		case instance.Proxy_Token != "" && port_type == "http" && proxy.HttpEnabled():
+			connections = append(connections, proxy.HttpUrl(instance.Proxy_Token, i, instance.Access_Token))
+		case instance.Proxy_Token != "" && (port_type == "nc" || port_type == "ssh") && proxy.TcpEnabled():
+			connections = append(connections, proxy.TcpConnection(instance.Proxy_Token, i, port_type, instance.Access_Token))
+		default:
+			connections = append(connections, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return connections
+}
+
+//Streams the user's status as Server-Sent Events, sending a new status event whenever the user's instance changes state
+func getUserStatusStream(c *gin.Context) {
+	log.Debug("Received /getUserStatus/stream Request")
+
+	userid, ok := c.GetQuery("userid")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing userid"})
+		return
+	}
+	if !validateUserid(userid) {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid userid"})
 		return
 	}
 
-	log.Debug("Start /getUserStatus Request")
+	updates := subscribeUser(userid)
+	defer unsubscribeUser(userid, updates)
 
-	instance := api_sql.GetActiveUserInstance(userid)
+	c.SSEvent("status", _getUserStatus(userid))
+	c.Writer.Flush()
 
-	c.JSON(http.StatusOK, ds.UserStatus{Running_Instance: true, Challenge_Id: instance.Challenge_Id, Time_Left: int((instance.Instance_Timeout-time.Now().UnixNano())/1e9), Host: creds.ExtractHost(instance.Portainer_Url), Ports_Used: api_sql.DeserializeI(instance.Ports_Used), Port_Types: api_sql.Deserialize(api_sql.GetRunnerChallenge(instance.Challenge_Id).Port_Types, ",")})
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case status := <-updates:
+			c.SSEvent("status", status)
+		case <-time.After(sseKeepAliveInterval): //Prevent proxies from closing idle connections
+			c.SSEvent("ping", gin.H{})
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
 
-	log.Debug("Finish /getUserStatus Request")
+	log.Debug("Finish /getUserStatus/stream Request")
 }
 
 func extendTimeLeft(c *gin.Context) {
@@ -274,20 +441,19 @@ func extendTimeLeft(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"Success": true})
 
+	startBackground()
 	go _extendTimeLeft(userid)
 }
 
 func _extendTimeLeft(userid string) { //Run Async
+	defer finishBackground()
 	log.Debug("Start /extendTimeLeft Request")
 	instance := api_sql.GetActiveUserInstance(userid)
-	NewInstanceTimeout := time.Now().UnixNano() + ds.DefaultNanosecondsPerInstance
-
-	a, b := ds.InstanceQueue.GetKey(instance.Instance_Id)
-	if !b {
-		panic("InstanceId is missing in InstanceQueue!")
+	NewInstanceTimeout, ok := ds.State.RequeueInstance(time.Now().UnixNano()+ds.DefaultNanosecondsPerInstance, instance.Instance_Id)
+	if !ok { //The instance expired or was removed in the meantime
+		log.Debug("Not extending Instance", instance.Instance_Id, "which is being killed")
+		return
 	}
-	ds.InstanceQueue.Remove(a)
-	ds.InstanceQueue.Put(NewInstanceTimeout, instance.Instance_Id) //Replace
 
 	api_sql.UpdateInstanceTime(instance.Instance_Id, NewInstanceTimeout)
 	log.Debug("Finish /extendTimeLeft Request")
@@ -315,6 +481,86 @@ func addChallenge(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing challenge_name"})
 		return
 	}
+	if raw_challenge_data.Cpu_Millicores < 0 || raw_challenge_data.Memory_Mb < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid cpu_millicores or memory_mb"})
+		return
+	}
+	if raw_challenge_data.Flag_Template != "" {
+		if creds.FlagSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Flag_Secret must be set in the credentials to use flag_template"})
+			return
+		}
+		if !creds.ValidFlagTemplate(raw_challenge_data.Flag_Template) {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid flag_template, " + creds.ErrInvalidFlagTemplate.Error()})
+			return
+		}
+		if raw_challenge_data.Flag_Env == "" && raw_challenge_data.Flag_File == "" {
+			raw_challenge_data.Flag_Env = "FLAG"
+		}
+		if raw_challenge_data.Flag_File != "" && !strings.HasPrefix(raw_challenge_data.Flag_File, "/") {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "flag_file must be an absolute path"})
+			return
+		}
+	}
+	if raw_challenge_data.Flag_Template != "" && raw_challenge_data.Flag_File != "" && raw_challenge_data.GetContainerLimits().Read_Only_Rootfs && copiesFiles(raw_challenge_data) {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "flag_file cannot be used with read_only_rootfs (or Default_Read_Only_Rootfs) by the " + ds.Backend + " backend, as the file is copied into the container"})
+		return
+	}
+	if raw_challenge_data.Memory_Limit_Mb < -1 || raw_challenge_data.Cpu_Shares < -1 || raw_challenge_data.Pids_Limit < -1 {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid memory_limit_mb, cpu_shares or pids_limit"})
+		return
+	}
+	if raw_challenge_data.Cpu_Shares > 0 && raw_challenge_data.Cpu_Shares < 2 { //Docker's minimum
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "cpu_shares must be at least 2"})
+		return
+	}
+	if raw_challenge_data.Cap_Drop != "" {
+		for _, capability := range api_sql.Deserialize(raw_challenge_data.Cap_Drop, ",") {
+			if capability == "" || strings.ContainsAny(capability, " \t") {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid capability " + capability + " in cap_drop"})
+				return
+			}
+		}
+	}
+	if raw_challenge_data.Egress != "" && !ds.ValidEgress(raw_challenge_data.Egress) {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid egress " + raw_challenge_data.Egress})
+		return
+	}
+	if raw_challenge_data.GetEgressPolicy().Egress == ds.EgressAllowlist && len(raw_challenge_data.GetEgressPolicy().Allowlist) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing egress_allowlist"})
+		return
+	}
+	if raw_challenge_data.Egress_Allowlist != "" {
+		for _, destination := range api_sql.Deserialize(raw_challenge_data.Egress_Allowlist, ",") {
+			if destination == "" || (ds.Backend != "KUBERNETES" && !ds.ValidEgressDestination(destination)) {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid egress_allowlist entry " + destination + ", expected IP addresses or CIDRs (namespaces for Kubernetes)"})
+				return
+			}
+		}
+	}
+	if raw_challenge_data.GetEgressPolicy().Egress != ds.EgressFull && ds.Backend != "KUBERNETES" && ds.EgressFilterImage == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Egress_Filter_Image must be set in the config to restrict egress"})
+		return
+	}
+	for name, value := range raw_challenge_data.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid env variable " + name})
+			return
+		}
+		if value.Secret {
+			if creds.EnvSecret == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": "Env_Secret must be set in the credentials to use secret env variables"})
+				return
+			}
+			encrypted, err := creds.EncryptSecret(value.Value)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"Error": "Unable to encrypt env variable " + name})
+				return
+			}
+			value.Value = encrypted
+			raw_challenge_data.Env[name] = value
+		}
+	}
 	if raw_challenge_data.Port_Types == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing port_types"})
 		return
@@ -338,7 +584,11 @@ func addChallenge(c *gin.Context) {
 			return
 		}
 		docker_compose_file := string(_docker_compose_file)
-		port_count := yaml.DockerComposePortCount(docker_compose_file)
+		port_count, err := yaml.DockerComposePortCount(docker_compose_file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid docker_compose_file: " + err.Error()})
+			return
+		}
 		if port_count == 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"Error": "docker_compose_file does not have any ports exposed"})
 			return
@@ -347,10 +597,17 @@ func addChallenge(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, gin.H{"Error": "Number of ports exposed in docker_compose_file does not match the number of port types specified"})
 			return
 		}
+		if ds.Backend == "DOCKER" || ds.Backend == "KUBERNETES" { //These backends convert the services into containers themselves, see yaml.DockerComposeServices
+			if _, err := yaml.DockerComposeServices(docker_compose_file); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": "docker_compose_file is not supported by the " + ds.Backend + " backend: " + err.Error()})
+				return
+			}
+		}
 
 		c.JSON(http.StatusOK, gin.H{"Success": true})
 
-		go _addChallengeDockerCompose(raw_challenge_data.Challenge_Name, raw_challenge_data.Port_Types, docker_compose_file)
+		raw_challenge_data.Docker_Compose_File = docker_compose_file
+		go _addChallengeDockerCompose(raw_challenge_data)
 	} else {
 		if raw_challenge_data.Internal_Port == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing internal_port"})
@@ -378,24 +635,25 @@ func addChallenge(c *gin.Context) {
 
 		c.JSON(http.StatusOK, gin.H{"Success": true})
 
-		go _addChallengeNonDockerCompose(raw_challenge_data.Challenge_Name, raw_challenge_data.Port_Types, raw_challenge_data.Internal_Port, raw_challenge_data.Image_Name, string(docker_cmds))
+		raw_challenge_data.Docker_Cmds = string(docker_cmds)
+		go _addChallengeNonDockerCompose(raw_challenge_data)
 	}
 }
 
-func _addChallengeDockerCompose(challenge_name string, port_types string, docker_compose_file string) { //Run Async
+func _addChallengeDockerCompose(raw ds.RunnerChallenge) { //Run Async, raw.Docker_Compose_File must already be decoded
 	log.Debug("Start /addChallenge Request (Docker Compose)")
-	port_count := yaml.DockerComposePortCount(docker_compose_file)
-	challenge_id := api_sql.GetOrCreateRunnerChallengeId(challenge_name, true, port_count)
-	ch := ds.RunnerChallenge{Challenge_Id: challenge_id, Challenge_Name: challenge_name, Port_Types: port_types, Docker_Compose: true, Port_Count: port_count, Docker_Compose_File: docker_compose_file}
+	port_count, _ := yaml.DockerComposePortCount(raw.Docker_Compose_File) //Already validated by addChallenge
+	challenge_id := api_sql.GetOrCreateRunnerChallengeId(raw.Challenge_Name, true, port_count)
+	ch := ds.RunnerChallenge{Challenge_Id: challenge_id, Challenge_Name: raw.Challenge_Name, Port_Types: raw.Port_Types, Docker_Compose: true, Port_Count: port_count, Docker_Compose_File: raw.Docker_Compose_File, Cpu_Millicores: raw.Cpu_Millicores, Memory_Mb: raw.Memory_Mb, Flag_Template: raw.Flag_Template, Flag_Env: raw.Flag_Env, Flag_File: raw.Flag_File, Env: raw.Env, Memory_Limit_Mb: raw.Memory_Limit_Mb, Cpu_Shares: raw.Cpu_Shares, Pids_Limit: raw.Pids_Limit, Cap_Drop: raw.Cap_Drop, No_New_Privileges: raw.No_New_Privileges, Read_Only_Rootfs: raw.Read_Only_Rootfs, Egress: raw.Egress, Egress_Allowlist: raw.Egress_Allowlist}
 	api_sql.UpdateRunnerChallenge(ch)
 
 	log.Debug("Finish /addChallenge Request (Docker Compose)")
 }
 
-func _addChallengeNonDockerCompose(challenge_name string, port_types string, internal_port string, image_name string, docker_cmds string) { //Run Async
+func _addChallengeNonDockerCompose(raw ds.RunnerChallenge) { //Run Async, raw.Docker_Cmds must already be decoded
 	log.Debug("Start /addChallenge Request (Non Docker Compose)")
-	challenge_id := api_sql.GetOrCreateRunnerChallengeId(challenge_name, false, 1)
-	ch := ds.RunnerChallenge{Challenge_Id: challenge_id, Challenge_Name: challenge_name, Port_Types: port_types, Docker_Compose: false, Port_Count: 1, Internal_Port: internal_port, Image_Name: image_name, Docker_Cmds: docker_cmds}
+	challenge_id := api_sql.GetOrCreateRunnerChallengeId(raw.Challenge_Name, false, 1)
+	ch := ds.RunnerChallenge{Challenge_Id: challenge_id, Challenge_Name: raw.Challenge_Name, Port_Types: raw.Port_Types, Docker_Compose: false, Port_Count: 1, Internal_Port: raw.Internal_Port, Image_Name: raw.Image_Name, Docker_Cmds: raw.Docker_Cmds, Cpu_Millicores: raw.Cpu_Millicores, Memory_Mb: raw.Memory_Mb, Flag_Template: raw.Flag_Template, Flag_Env: raw.Flag_Env, Flag_File: raw.Flag_File, Env: raw.Env, Memory_Limit_Mb: raw.Memory_Limit_Mb, Cpu_Shares: raw.Cpu_Shares, Pids_Limit: raw.Pids_Limit, Cap_Drop: raw.Cap_Drop, No_New_Privileges: raw.No_New_Privileges, Read_Only_Rootfs: raw.Read_Only_Rootfs, Egress: raw.Egress, Egress_Allowlist: raw.Egress_Allowlist}
 	api_sql.UpdateRunnerChallenge(ch)
 
 	log.Debug("Finish /addChallenge Request (Non Docker Compose)")
@@ -425,29 +683,83 @@ func removeChallenge(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"Success": true})
 
+	startBackground()
 	go _removeChallenge(challid)
 }
 
 func _removeChallenge(challid string) { //Run Async
+	defer finishBackground()
 	log.Debug("Start /removeChallenge Request")
 
-	ds.ChallengeUnsafeToLaunch[challid] = true; //Mark challenge as unsafe to launch
+	ds.State.SetChallengeUnsafe(challid, true) //Mark challenge as unsafe to launch
 
+	var wg sync.WaitGroup
 	for _, instance := range api_sql.GetInstances() {
 		if instance.Challenge_Id == challid {
-			go _removeInstance(instance.Usr_Id) //Make sure that all instances running this challenge are killed
+			wg.Add(1)
+			go func(instance ds.Instance) { //Make sure that all instances running this challenge are killed (including failed instances and instances no longer tied to a user)
+				defer wg.Done()
+				KillInstance(instance)
+			}(instance)
 		}
 	}
+	wg.Wait() //The challenge is needed to stop its instances, so it is only deleted once they are stopped
 
 	ClearInstanceQueue() //Manually trigger ClearInstanceQueue() rather than waiting for the Kill Worker
 
 	api_sql.DeleteRunnerChallenge(challid)
 
-	delete(ds.ChallengeUnsafeToLaunch, challid)
+	ds.State.SetChallengeUnsafe(challid, false)
 
 	log.Debug("Finish /removeChallenge Request")
 }
 
+func verifyFlag(c *gin.Context) {
+	log.Debug("Received /verifyFlag Request")
+
+	auth := c.Request.Header.Get("Authorization")
+	if auth == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Authorization missing"})
+		return
+	} else if auth != creds.APIAuthorization { //TODO: Make this comparison secure
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid authorization"})
+		return
+	}
+
+	userid, ok := c.GetQuery("userid")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing userid"})
+		return
+	}
+	if !validateUserid(userid) {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid userid"})
+		return
+	}
+	challid, ok := c.GetQuery("challid")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing challid"})
+		return
+	}
+	if !api_sql.ValidRunnerChallenge(challid) { //Flags of challenges that are being removed may still be submitted
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid challid"})
+		return
+	}
+	flag, ok := c.GetQuery("flag")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Missing flag"})
+		return
+	}
+
+	ch := api_sql.GetRunnerChallenge(challid)
+	if ch.Flag_Template == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Challenge does not use per-user flags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"Correct": creds.VerifyFlag(ch, userid, flag)})
+	log.Debug("Finish /verifyFlag Request")
+}
+
 func getStatus(c *gin.Context) {
 	log.Debug("Received /getStatus Request")
 
@@ -462,7 +774,7 @@ func getStatus(c *gin.Context) {
 
 	log.Debug("Start /getStatus Request")
 
-	c.JSON(http.StatusOK, ds.RunnerStatus{Current_Instance_Count: api_sql.GetInstanceCount(), Max_Instance_Count: ds.MaxInstanceCount, Instances: api_sql.GetInstances(), Challenges: api_sql.GetRunnerChallenges()})
+	c.JSON(http.StatusOK, ds.RunnerStatus{Current_Instance_Count: api_sql.GetInstanceCount(), Max_Instance_Count: ds.MaxInstanceCount, Instances: api_sql.GetInstances(), Challenges: api_sql.GetRunnerChallenges(), Targets: ds.State.Targets.Health(creds.PortainerTargets), Reconcile_Actions: GetReconcileActions()})
 
 	log.Debug("Finish /getStatus Request")
 }
@@ -1,64 +1,458 @@
 package yaml
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
-	
+
 	"gopkg.in/yaml.v2"
+
+	"runner/internal/ds"
 )
 
-func parseInternalPort(str string) string { //Returns the internal port
-	return strings.Split(str, ":")[1]
+//Returns the host IP ("" if there is none), external port and internal port of "[<host ip>:]<external port>:<internal port>[/<protocol>]", the internal port keeps its protocol
+func ParsePortMapping(mapping string) (string, string, string, error) {
+	parts := strings.Split(mapping, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return "", "", "", fmt.Errorf("port %s is not of the form <external port>:<internal port>", mapping)
+	}
+	host_ip, external_port, internal_port := "", parts[len(parts)-2], parts[len(parts)-1]
+	if len(parts) == 3 {
+		host_ip = parts[0]
+	}
+	if _, err := strconv.Atoi(external_port); err != nil {
+		return "", "", "", fmt.Errorf("port %s has an invalid external port %s", mapping, external_port)
+	}
+	if _, err := strconv.Atoi(strings.SplitN(internal_port, "/", 2)[0]); err != nil {
+		return "", "", "", fmt.Errorf("port %s has an invalid internal port %s", mapping, internal_port)
+	}
+	return host_ip, external_port, internal_port, nil
+}
+
+func parsePort(raw interface{}) (string, string, string, error) { //Only the short syntax with an external port is supported, as every port is published on a port reserved by the runner
+	switch v := raw.(type) {
+	case string:
+		return ParsePortMapping(v)
+	case map[interface{}]interface{}:
+		return "", "", "", fmt.Errorf("port %v uses the long syntax, which is not supported", v)
+	}
+	return "", "", "", fmt.Errorf("port %v is not of the form <external port>:<internal port>", raw)
+}
+
+func parsePorts(raw interface{}) ([]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	raw_ports, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ports must be a list")
+	}
+	return raw_ports, nil
 }
 
-func DockerComposeCopy(docker_compose string, ports []int) string {
+//Returns docker_compose and its services, or an error if it does not have any services
+func parseDockerCompose(docker_compose string) (map[interface{}]interface{}, map[interface{}]map[interface{}]interface{}, error) {
 	yml := make(map[interface{}]interface{})
-	err := yaml.Unmarshal([]byte(docker_compose), &yml)
+	if err := yaml.Unmarshal([]byte(docker_compose), &yml); err != nil {
+		return nil, nil, err
+	}
+	raw_services, ok := yml["services"].(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("docker compose file does not have any services")
+	}
+	services := make(map[interface{}]map[interface{}]interface{})
+	for name, raw_service := range raw_services {
+		service, ok := raw_service.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("service %v is not a mapping", name)
+		}
+		services[name] = service
+	}
+	return yml, services, nil
+}
+
+//Returns the names of services in sorted order, which is the order that ports are published in (see DockerComposeCopy), as the order of the file is lost when it is parsed
+func serviceNames(services map[interface{}]map[interface{}]interface{}) []interface{} {
+	names := []interface{}{}
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return fmt.Sprint(names[i]) < fmt.Sprint(names[j]) })
+	return names
+}
+
+func marshalDockerCompose(yml map[interface{}]interface{}) (string, error) {
+	new_yml, err := yaml.Marshal(&yml)
+	if err != nil {
+		return "", err
+	}
+	return string(new_yml), nil
+}
+
+//Publishes the ports of docker_compose on ports, and on the corresponding host_ips if they are not "". env is merged into the environment of every service.
+//Ports are assigned in the order of the services' names, then in the order of the ports of each service, which is the order of Port_Types
+func DockerComposeCopy(docker_compose string, ports []int, host_ips []string, env map[string]string) (string, error) {
+	yml, services, err := parseDockerCompose(docker_compose)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	ports_idx := 0
-	for k1, v1 := range yml["services"].(map[interface{}]interface{}) {
-		raw_port_mappings := v1.(map[interface{}]interface{})["ports"]
+	for _, name := range serviceNames(services) {
+		service := services[name]
+		raw_port_mappings, err := parsePorts(service["ports"])
+		if err != nil {
+			return "", fmt.Errorf("service %v: %w", name, err)
+		}
 		if raw_port_mappings != nil { //There are ports
-			raw_port_mappings := raw_port_mappings.([]interface{})
 			new_port_mappings := make([]string, len(raw_port_mappings))
 			for k2, v2 := range raw_port_mappings {
-				new_port_mappings[k2] = strconv.Itoa(ports[ports_idx]) + ":" + parseInternalPort(v2.(string))
+				_, _, internal_port, err := parsePort(v2)
+				if err != nil {
+					return "", fmt.Errorf("service %v: %w", name, err)
+				}
+				if ports_idx >= len(ports) {
+					return "", fmt.Errorf("docker compose file exposes more than the %d reserved ports", len(ports))
+				}
+				new_port_mappings[k2] = strconv.Itoa(ports[ports_idx]) + ":" + internal_port
+				if ports_idx < len(host_ips) && host_ips[ports_idx] != "" {
+					new_port_mappings[k2] = host_ips[ports_idx] + ":" + new_port_mappings[k2]
+				}
 				ports_idx += 1
 			}
-			yml["services"].(map[interface{}]interface{})[k1].(map[interface{}]interface{})["ports"] = new_port_mappings //Override old port mappings
+			service["ports"] = new_port_mappings //Override old port mappings
 		}
 
-		container_name := v1.(map[interface{}]interface{})["container_name"]
-		if container_name != nil { //There is a container name
-			delete(yml["services"].(map[interface{}]interface{})[k1].(map[interface{}]interface{}), "container_name") //Clear container name, let portainer substitute from stack name instead to prevent duplicate container names
+		if len(env) > 0 {
+			service["environment"] = mergeEnvironment(parseEnvironment(service["environment"]), env)
 		}
+
+		delete(service, "container_name") //Clear container name, let portainer substitute from stack name instead to prevent duplicate container names
 	}
 
-	new_yml, err := yaml.Marshal(&yml)
+	return marshalDockerCompose(yml)
+}
+
+//Mounts files (Absolute path -> Content) into every service as configs with inline content, which requires Docker Compose 2.23 or later
+func DockerComposeAddFiles(docker_compose string, files map[string]string) (string, error) {
+	if len(files) == 0 {
+		return docker_compose, nil
+	}
+
+	yml, services, err := parseDockerCompose(docker_compose)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return string(new_yml)
+	paths := []string{}
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	configs, ok := yml["configs"].(map[interface{}]interface{})
+	if !ok {
+		configs = make(map[interface{}]interface{})
+	}
+	service_configs := []interface{}{}
+	for i, path := range paths {
+		name := "runner_file_" + strconv.Itoa(i)
+		configs[name] = map[interface{}]interface{}{"content": escapeInterpolation(files[path])}
+		service_configs = append(service_configs, map[interface{}]interface{}{"source": name, "target": path, "mode": 0444})
+	}
+	yml["configs"] = configs
+
+	for _, service := range services {
+		existing, _ := service["configs"].([]interface{})
+		service["configs"] = append(append([]interface{}{}, existing...), service_configs...)
+	}
+
+	return marshalDockerCompose(yml)
 }
 
-func DockerComposePortCount(docker_compose string) int {
-	yml := make(map[interface{}]interface{})
-	err := yaml.Unmarshal([]byte(docker_compose), &yml)
+//Applies limits to every service, replacing the limits of the service. Capabilities are dropped in addition to the cap_drop of the service
+func DockerComposeAddLimits(docker_compose string, limits ds.ContainerLimits) (string, error) {
+	yml, services, err := parseDockerCompose(docker_compose)
+	if err != nil {
+		return "", err
+	}
+
+	for _, service := range services {
+		if limits.Memory_Mb > 0 {
+			service["mem_limit"] = strconv.Itoa(limits.Memory_Mb) + "m"
+		}
+		if limits.Cpu_Shares > 0 {
+			service["cpu_shares"] = limits.Cpu_Shares
+		}
+		if limits.Pids_Limit > 0 {
+			service["pids_limit"] = limits.Pids_Limit
+		}
+		if len(limits.Cap_Drop) > 0 {
+			cap_drop := parseStringOrList(service["cap_drop"])
+			for _, capability := range limits.Cap_Drop {
+				if !containsString(cap_drop, capability) {
+					cap_drop = append(cap_drop, capability)
+				}
+			}
+			service["cap_drop"] = cap_drop
+		}
+		if limits.No_New_Privileges {
+			security_opt := parseStringOrList(service["security_opt"])
+			if !containsString(security_opt, "no-new-privileges:true") {
+				security_opt = append(security_opt, "no-new-privileges:true")
+			}
+			service["security_opt"] = security_opt
+		}
+		if limits.Read_Only_Rootfs {
+			service["read_only"] = true
+		}
+	}
+
+	return marshalDockerCompose(yml)
+}
+
+//Adds labels to every service, replacing labels of the service with the same name
+func DockerComposeAddLabels(docker_compose string, labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return docker_compose, nil
+	}
+
+	yml, services, err := parseDockerCompose(docker_compose)
+	if err != nil {
+		return "", err
+	}
+
+	for _, service := range services {
+		service["labels"] = mergeEnvironment(parseEnvironment(service["labels"]), labels) //Labels have the same format as the environment
+	}
+
+	return marshalDockerCompose(yml)
+}
+
+//Sets the driver_opts(i) of the i-th network created by the stack (including the default network, in the order of their names), nil driver_opts leaves the stack alone.
+//Services on the network of the host would bypass the egress rules of the networks, so they are rejected
+func DockerComposeSetEgress(docker_compose string, driver_opts func(i int) map[string]string) (string, error) {
+	if driver_opts == nil {
+		return docker_compose, nil
+	}
+
+	yml, services, err := parseDockerCompose(docker_compose)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range serviceNames(services) {
+		if services[name]["network_mode"] == "host" {
+			return "", fmt.Errorf("service %v may not use network_mode host with restricted egress", name)
+		}
+	}
+
+	networks, ok := yml["networks"].(map[interface{}]interface{})
+	if !ok {
+		networks = make(map[interface{}]interface{})
+	}
+	if _, ok := networks["default"]; !ok {
+		networks["default"] = nil
+	}
+	names := []string{}
+	for name := range networks {
+		names = append(names, fmt.Sprint(name))
+	}
+	sort.Strings(names)
+
+	i := 0
+	for _, name := range names {
+		network, ok := networks[name].(map[interface{}]interface{})
+		if !ok {
+			network = make(map[interface{}]interface{})
+		}
+		if network["external"] != nil { //Networks that are not created by the stack are left alone
+			continue
+		}
+		opts, ok := network["driver_opts"].(map[interface{}]interface{})
+		if !ok {
+			opts = make(map[interface{}]interface{})
+		}
+		for key, value := range driver_opts(i) {
+			opts[key] = value
+		}
+		network["driver_opts"] = opts
+		networks[name] = network
+		i++
+	}
+	yml["networks"] = networks
+
+	return marshalDockerCompose(yml)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the number of ports exposed by docker_compose, or an error if any of them cannot be published on a port reserved by the runner
+func DockerComposePortCount(docker_compose string) (int, error) {
+	_, services, err := parseDockerCompose(docker_compose)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	port_count := 0
-	for _, v1 := range yml["services"].(map[interface{}]interface{}) {
-		raw_port_mappings := v1.(map[interface{}]interface{})["ports"]
-		if raw_port_mappings != nil { //There are ports
-			port_count += len(raw_port_mappings.([]interface{}))
+	for _, name := range serviceNames(services) {
+		service := services[name]
+		raw_port_mappings, err := parsePorts(service["ports"])
+		if err != nil {
+			return 0, fmt.Errorf("service %v: %w", name, err)
 		}
+		for _, raw_port_mapping := range raw_port_mappings {
+			if _, _, _, err := parsePort(raw_port_mapping); err != nil {
+				return 0, fmt.Errorf("service %v: %w", name, err)
+			}
+		}
+		port_count += len(raw_port_mappings)
 	}
 
-	return port_count
-}
\ No newline at end of file
+	return port_count, nil
+}
+
+//A (very) small subset of a docker compose service, for backends that do not support docker compose natively
+type ComposeService struct {
+	Name        string
+	Image       string
+	Command     []string
+	Environment []string
+	Ports       []string //"[<host ip>:]<external port>:<internal port>"
+}
+
+func parseStringOrList(raw interface{}) []string {
+	switch v := raw.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, s := range v {
+			list[i] = fmt.Sprint(s)
+		}
+		return list
+	}
+	return nil
+}
+
+func parseEnvironment(raw interface{}) []string { //Environment can either be a list of KEY=VALUE or a map of KEY: VALUE
+	switch v := raw.(type) {
+	case []interface{}:
+		return parseStringOrList(v)
+	case map[interface{}]interface{}:
+		var env []string
+		for key, value := range v {
+			if value == nil {
+				env = append(env, fmt.Sprint(key))
+			} else {
+				env = append(env, fmt.Sprint(key)+"="+fmt.Sprint(value))
+			}
+		}
+		sort.Strings(env)
+		return env
+	}
+	return nil
+}
+
+//Docker compose interpolates $VARIABLE and ${VARIABLE} in the file, so values that the runner writes into it must have every $ escaped as $$
+func escapeInterpolation(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+//Reverses escapeInterpolation for backends that convert the services themselves rather than passing the file to docker compose
+func unescapeInterpolation(value string) string {
+	return strings.ReplaceAll(value, "$$", "$")
+}
+
+func mergeEnvironment(environment []string, env map[string]string) []string { //Variables in env replace variables with the same name in environment, values in env are escaped
+	merged := []string{}
+	for _, variable := range environment {
+		if _, ok := env[strings.SplitN(variable, "=", 2)[0]]; !ok {
+			merged = append(merged, variable)
+		}
+	}
+	names := []string{}
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, name+"="+escapeInterpolation(env[name]))
+	}
+	return merged
+}
+
+//Keys of a docker compose file (and of its services) that DockerComposeServices converts, anything else would be silently ignored by the backends that use it
+var supportedComposeKeys = map[string]bool{"version": true, "services": true}
+var supportedServiceKeys = map[string]bool{"image": true, "command": true, "environment": true, "ports": true}
+
+//Returns an error naming the first key of raw (in sorted order) that is not in supported
+func unsupportedKey(raw map[interface{}]interface{}, supported map[string]bool) error {
+	var keys []string
+	for key := range raw {
+		if !supported[fmt.Sprint(key)] {
+			keys = append(keys, fmt.Sprint(key))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("%s is not supported", keys[0])
+}
+
+//Returns the services of docker_compose, or an error if it uses anything that cannot be converted (only image, command, environment and ports are supported)
+func DockerComposeServices(docker_compose string) ([]ComposeService, error) {
+	yml, raw_services, err := parseDockerCompose(docker_compose)
+	if err != nil {
+		return nil, err
+	}
+	if err := unsupportedKey(yml, supportedComposeKeys); err != nil {
+		return nil, err
+	}
+
+	var services []ComposeService
+	for _, k1 := range serviceNames(raw_services) {
+		raw_service := raw_services[k1]
+		if err := unsupportedKey(raw_service, supportedServiceKeys); err != nil {
+			return nil, fmt.Errorf("service %v: %w", k1, err)
+		}
+
+		service := ComposeService{Name: fmt.Sprint(k1), Command: parseStringOrList(raw_service["command"]), Environment: parseEnvironment(raw_service["environment"])}
+		for i := range service.Command {
+			service.Command[i] = unescapeInterpolation(service.Command[i])
+		}
+		for i := range service.Environment {
+			service.Environment[i] = unescapeInterpolation(service.Environment[i])
+		}
+		if raw_service["image"] == nil {
+			return nil, fmt.Errorf("service %v does not specify an image", k1)
+		}
+		service.Image = fmt.Sprint(raw_service["image"])
+		raw_ports, err := parsePorts(raw_service["ports"])
+		if err != nil {
+			return nil, fmt.Errorf("service %v: %w", k1, err)
+		}
+		for _, raw_port := range raw_ports {
+			host_ip, external_port, internal_port, err := parsePort(raw_port)
+			if err != nil {
+				return nil, fmt.Errorf("service %v: %w", k1, err)
+			}
+			if host_ip != "" {
+				external_port = host_ip + ":" + external_port
+			}
+			service.Ports = append(service.Ports, external_port+":"+internal_port)
+		}
+		services = append(services, service)
+	}
+
+	return services, nil
+}
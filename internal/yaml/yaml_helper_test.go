@@ -0,0 +1,179 @@
+package yaml
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"runner/internal/ds"
+)
+
+func TestDockerComposeServices(t *testing.T) {
+	services, err := DockerComposeServices("services:\n  web:\n    image: nginx\n    command: nginx -g daemon\n    environment:\n      A: b\n    ports:\n      - 8080:80\n  db:\n    image: postgres\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ComposeService{
+		{Name: "db", Image: "postgres"},
+		{Name: "web", Image: "nginx", Command: []string{"nginx", "-g", "daemon"}, Environment: []string{"A=b"}, Ports: []string{"8080:80"}},
+	}
+	if !reflect.DeepEqual(services, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, services)
+	}
+}
+
+func TestDockerComposeServicesUnsupported(t *testing.T) {
+	for docker_compose, expected := range map[string]string{
+		"services:\n  web:\n    image: nginx\n    build: .\n":                       "build",
+		"services:\n  web:\n    image: nginx\n    volumes:\n      - data:/data\n":   "volumes",
+		"services:\n  web:\n    image: nginx\n    depends_on:\n      - db\n":        "depends_on",
+		"services:\n  web:\n    image: nginx\n    healthcheck:\n      test: true\n": "healthcheck",
+		"services:\n  web:\n    image: nginx\nnetworks:\n  internal: {}\n":          "networks",
+		"services:\n  web:\n    image: nginx\n    networks:\n      - internal\n":    "networks",
+		"services:\n  web: nginx\n":                                                 "not a mapping",
+		"version: '3'\n":                                                            "does not have any services",
+		"services:\n  web:\n    command: sh\n":                                      "does not specify an image",
+	} {
+		_, err := DockerComposeServices(docker_compose)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning %q for\n%s\ngot %v", expected, docker_compose, err)
+		}
+	}
+}
+
+func TestDockerComposeCopy(t *testing.T) {
+	docker_compose, err := DockerComposeCopy("services:\n  web:\n    image: nginx\n    container_name: web\n    ports:\n      - 127.0.0.1:8080:80/udp\n", []int{30000}, nil, map[string]string{"FLAG": "flag{test}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := DockerComposeServices(docker_compose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ComposeService{{Name: "web", Image: "nginx", Environment: []string{"FLAG=flag{test}"}, Ports: []string{"30000:80/udp"}}}
+	if !reflect.DeepEqual(services, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, services)
+	}
+
+	if _, err := DockerComposeCopy("services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n      - 8081:81\n", []int{30000}, nil, nil); err == nil {
+		t.Fatal("Expected an error when the docker compose file exposes more ports than were reserved")
+	}
+}
+
+func TestDockerComposeInvalid(t *testing.T) {
+	for _, docker_compose := range []string{
+		"services: []\n",
+		"services:\n  web: nginx\n",
+		"services:\n  web:\n    image: nginx\n    ports: 8080:80\n",
+		"services:\n  web:\n    image: nginx\n    ports:\n      - \"8080\"\n",
+		"services:\n  web:\n    image: nginx\n    ports:\n      - target: 80\n        published: 8080\n",
+	} {
+		if _, err := DockerComposePortCount(docker_compose); err == nil {
+			t.Errorf("DockerComposePortCount should fail for\n%s", docker_compose)
+		}
+		if _, err := DockerComposeCopy(docker_compose, []int{30000}, nil, nil); err == nil {
+			t.Errorf("DockerComposeCopy should fail for\n%s", docker_compose)
+		}
+		if _, err := DockerComposeAddLimits(docker_compose, ds.ContainerLimits{}); err == nil && !strings.Contains(docker_compose, "ports") {
+			t.Errorf("DockerComposeAddLimits should fail for\n%s", docker_compose)
+		}
+	}
+}
+
+func TestDockerComposeCopyHostIps(t *testing.T) {
+	docker_compose, err := DockerComposeCopy("services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n      - 2222:22\n", []int{30000, 30001}, []string{"10.0.0.5", ""}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := DockerComposeServices(docker_compose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.5:30000:80", "30001:22"}
+	if !reflect.DeepEqual(services[0].Ports, expected) {
+		t.Fatalf("Expected ports %v, got %v", expected, services[0].Ports)
+	}
+}
+
+func TestDockerComposeCopyServiceOrder(t *testing.T) {
+	//web is first in the file, but shell is first by name, so its ports come first in Ports_Used and Port_Types
+	docker_compose := "services:\n  web:\n    image: nginx\n    ports:\n      - 8080:80\n  shell:\n    image: alpine\n    ports:\n      - 1337:1337\n      - 2222:22\n"
+	expected := []ComposeService{
+		{Name: "shell", Image: "alpine", Ports: []string{"30000:1337", "10.0.0.5:30001:22"}},
+		{Name: "web", Image: "nginx", Ports: []string{"10.0.0.5:30002:80"}},
+	}
+	for i := 0; i < 20; i++ { //Services are stored in a map, so a single run could pass by chance
+		copied, err := DockerComposeCopy(docker_compose, []int{30000, 30001, 30002}, []string{"", "10.0.0.5", "10.0.0.5"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		services, err := DockerComposeServices(copied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(services, expected) {
+			t.Fatalf("Expected ports in the order of the services' names %+v, got %+v", expected, services)
+		}
+	}
+
+	if _, err := DockerComposePortCount("services:\n  b:\n    image: nginx\n    ports: 8080:80\n  a:\n    image: nginx\n    ports: 8081:80\n"); err == nil || !strings.Contains(err.Error(), "service a") {
+		t.Fatalf("Expected the error of the first service by name, got %v", err)
+	}
+}
+
+func TestDockerComposeEscape(t *testing.T) {
+	docker_compose, err := DockerComposeCopy("services:\n  web:\n    image: nginx\n    environment:\n      PRICE: $$5\n    ports:\n      - 8080:80\n", []int{30000}, nil, map[string]string{"FLAG": "CTF{$HOME_${PATH}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(docker_compose, "FLAG=CTF{$$HOME_$${PATH}}") || !strings.Contains(docker_compose, "PRICE=$$5") {
+		t.Fatalf("Values written into the docker compose file should be escaped, got\n%s", docker_compose)
+	}
+	docker_compose, err = DockerComposeAddFiles(docker_compose, map[string]string{"/flag.txt": "CTF{$HOME}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(docker_compose, "CTF{$$HOME}") {
+		t.Fatalf("Files written into the docker compose file should be escaped, got\n%s", docker_compose)
+	}
+
+	services, err := DockerComposeServices("services:\n  web:\n    image: nginx\n    command: echo $$5\n    environment:\n      - FLAG=CTF{$$HOME}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(services[0].Environment, []string{"FLAG=CTF{$HOME}"}) || !reflect.DeepEqual(services[0].Command, []string{"echo", "$5"}) {
+		t.Fatalf("Escaped values should be unescaped, got %+v", services[0])
+	}
+}
+
+func TestDockerComposeSetEgress(t *testing.T) {
+	driver_opts := func(i int) map[string]string {
+		return map[string]string{"com.docker.network.bridge.name": "br" + strconv.Itoa(i)}
+	}
+	docker_compose, err := DockerComposeSetEgress("services:\n  web:\n    image: nginx\n    networks:\n      - backend\n      - shared\nnetworks:\n  backend:\n  shared:\n    external: true\n", driver_opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yml, _, err := parseDockerCompose(docker_compose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks := yml["networks"].(map[interface{}]interface{})
+	for name, bridge := range map[string]string{"backend": "br0", "default": "br1"} {
+		opts := networks[name].(map[interface{}]interface{})["driver_opts"].(map[interface{}]interface{})
+		if opts["com.docker.network.bridge.name"] != bridge {
+			t.Fatalf("Expected network %s on bridge %s, got %v", name, bridge, opts)
+		}
+	}
+	if _, ok := networks["shared"].(map[interface{}]interface{})["driver_opts"]; ok {
+		t.Fatal("External networks should be left alone")
+	}
+
+	if _, err := DockerComposeSetEgress("services:\n  web:\n    image: nginx\n    network_mode: host\n", driver_opts); err == nil {
+		t.Fatal("Services on the network of the host should be rejected")
+	}
+	if docker_compose, err := DockerComposeSetEgress("services:\n  web:\n    image: nginx\n    network_mode: host\n", nil); err != nil || strings.Contains(docker_compose, "driver_opts") {
+		t.Fatalf("Full egress should leave the stack alone, got %v\n%s", err, docker_compose)
+	}
+}